@@ -33,7 +33,7 @@ func main() {
 	readBufferSize := flag.Int("read-buffer-size", 65536, readBufferSizeHelp)
 	flag.IntVar(readBufferSize, "r", 65536, readBufferSizeHelp)
 
-	maxMemtableSizeHelp := "Read buffer size: determines index size"
+	maxMemtableSizeHelp := "Maximum memtable size in bytes"
 	maxMemtableSize := flag.Int64("max-memtable-size", 16384, maxMemtableSizeHelp)
 	flag.Int64Var(maxMemtableSize, "m", 16384, maxMemtableSizeHelp)
 
@@ -44,14 +44,14 @@ func main() {
 
 	if *performanceMode {
 		db := initStorage(*maxMemtableSize, *readBufferSize)
-		defer db.Stop()
+		defer stopStorage(db)
 		performanceTest(db, *performanceMaxKeys, *checkKeys)
 		return
 	}
 
 	if *interactiveMode {
 		db := initStorage(*maxMemtableSize, *readBufferSize)
-		defer db.Stop()
+		defer stopStorage(db)
 		startMainWorkingLoop(db)
 		return
 	}
@@ -60,13 +60,17 @@ func main() {
 }
 
 func initStorage(maxMemtableSize int64, readBufferSize int) mdb.Storage {
-	db := mdb.NewLSMTStorage(lsmt.StorageConfig{
+	db, err := mdb.NewLSMTStorage(lsmt.StorageConfig{
 		WorkDir:               "./lsmt_data/",
 		CompactionEnabled:     true,
 		MinimumFilesToCompact: 2,
 		MaxMemtableSize:       maxMemtableSize,
 		SSTableReadBufferSize: readBufferSize,
 	})
+	if err != nil {
+		printlnRed(fmt.Sprintf("Can't start the storage: %v", err))
+		os.Exit(1)
+	}
 
 	c := make(chan os.Signal, 1)
 	signal.Notify(c, os.Interrupt)
@@ -126,7 +130,11 @@ func setCommand(db mdb.Storage, cmd []string) {
 		printlnRed("Unknown command")
 		return
 	}
-	db.Set(cmd[0], cmd[1])
+	err := db.Set(cmd[0], cmd[1])
+	if err != nil {
+		printlnRed(fmt.Sprintf("\nError: %v", err))
+		return
+	}
 	printlnYellow(fmt.Sprintf("\nSaved    %s=%s", cmd[0], cmd[1]))
 }
 
@@ -136,16 +144,27 @@ func getCommand(db mdb.Storage, cmd []string) {
 		return
 	}
 
-	value, exists := db.Get(cmd[0])
+	value, exists, err := db.Get(cmd[0])
+	if err != nil {
+		printlnRed(fmt.Sprintf("\nError: %v", err))
+		return
+	}
 	printlnGreen(fmt.Sprintf("\nvalue='%s', exists=%v", value, exists))
 }
 
 func exitCommand(db mdb.Storage) {
 	printlnYellow("\nShutting down...")
-	db.Stop()
+	stopStorage(db)
 	os.Exit(0)
 }
 
+func stopStorage(db mdb.Storage) {
+	err := db.Stop()
+	if err != nil {
+		printlnRed(fmt.Sprintf("Can't stop the storage properly: %v", err))
+	}
+}
+
 func helpCommand() {
 	help := `
 	Simple KV storage commands:
@@ -37,7 +37,11 @@ func performanceTest(db mdb.Storage, maxKeys int, checkKeys bool) {
 	for true == true {
 		k := randString(20)
 		v := randString(30)
-		db.Set(k, v)
+		err := db.Set(k, v)
+		if err != nil {
+			log.Printf("%sCan't insert key '%s': %v%s", colorRed, k, err, colorNeutral)
+			return
+		}
 		counter++
 		cycleCounter++
 
@@ -70,7 +74,11 @@ func printStatsEverySecond() {
 func assertKeyValues(db mdb.Storage, keyValues map[string]string) {
 	log.Println("Checking inserted keys")
 	for k, v := range keyValues {
-		value, found := db.Get(k)
+		value, found, err := db.Get(k)
+		if err != nil {
+			log.Printf("%sCan't read key '%s': %v%s", colorRed, k, err, colorNeutral)
+			return
+		}
 		if !found || v != value {
 			log.Panicf(
 				"Key '%s' has not been found or returned wrong value! returned='%s' found=%v",
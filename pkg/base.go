@@ -6,47 +6,70 @@ import (
 	"github.com/alexander-akhmetov/mdb/pkg/indexed_file"
 	"github.com/alexander-akhmetov/mdb/pkg/lsmt"
 	"github.com/alexander-akhmetov/mdb/pkg/memory"
+	"github.com/alexander-akhmetov/mdb/pkg/utils"
 )
 
-// Storage is a common interface for all storages
+// Errors returned by all storages. Use errors.Is to check them,
+// storages can wrap them with additional information.
+var (
+	// ErrClosed is returned when the storage is used before Start or after Stop.
+	ErrClosed = utils.ErrClosed
+	// ErrCorrupted is returned when the data on disk can't be read.
+	ErrCorrupted = utils.ErrCorrupted
+	// ErrLocked is returned when another instance of the database uses the same files.
+	ErrLocked = utils.ErrLocked
+	// ErrTooBig is returned when a write is bigger than the storage can save at once.
+	ErrTooBig = utils.ErrTooBig
+)
+
+// CorruptionError describes a place in a file where the data is corrupted.
+// Use errors.As to get it.
+type CorruptionError = utils.CorruptionError
+
+// Storage is a common interface for all storages.
+// Only lsmt.Storage can delete keys, see lsmt.Storage.Delete.
 type Storage interface {
-	Set(string, string)
-	Get(string) (string, bool)
-	// Delete(string)
-	Start()
-	Stop()
+	Set(string, string) error
+	Get(string) (string, bool, error)
+	Start() error
+	Stop() error
 }
 
 // NewFileStorage creates a new file.Storage
-func NewFileStorage(filepath string) (storage Storage) {
-	storage = &file.Storage{
+func NewFileStorage(filepath string) (Storage, error) {
+	storage := &file.Storage{
 		Filename: filepath,
 	}
-	storage.Start()
-	return storage
+	return start(storage)
 }
 
 // NewMemoryStorage creates a new memory.Storage
-func NewMemoryStorage(filepath string) (storage Storage) {
-	storage = &memory.Storage{}
-	storage.Start()
-	return storage
+func NewMemoryStorage(filepath string) (Storage, error) {
+	storage := &memory.Storage{}
+	return start(storage)
 }
 
 // NewIndexedFileStorage returns a new indexedfile.Storage
-func NewIndexedFileStorage(filepath string) (storage Storage) {
-	storage = &indexedfile.Storage{
+func NewIndexedFileStorage(filepath string) (Storage, error) {
+	storage := &indexedfile.Storage{
 		Filename: filepath,
 	}
-	storage.Start()
-	return storage
+	return start(storage)
 }
 
 // NewLSMTStorage returns a new lsmt.Storage
-func NewLSMTStorage(config lsmt.StorageConfig) (storage Storage) {
-	storage = &lsmt.Storage{
+func NewLSMTStorage(config lsmt.StorageConfig) (Storage, error) {
+	storage := &lsmt.Storage{
 		Config: config,
 	}
-	storage.Start()
-	return storage
+	return start(storage)
+}
+
+// start starts the storage and returns it if there were no errors
+func start(storage Storage) (Storage, error) {
+	err := storage.Start()
+	if err != nil {
+		return nil, err
+	}
+	return storage, nil
 }
@@ -8,39 +8,73 @@ import (
 	"github.com/alexander-akhmetov/mdb/pkg/utils"
 )
 
-var writeMutex = &sync.Mutex{}
-
 // Storage holds all information in a file.
+// It's safe for concurrent use: reads can run in parallel, writes are serialized.
 type Storage struct {
 	Filename string
+	mutex    sync.RWMutex // protects running, readers never see a partially appended line
+	running  bool
 }
 
 // Set saves the given key and value.
-func (s *Storage) Set(key string, value string) {
-	writeMutex.Lock()
-	defer writeMutex.Unlock()
+func (s *Storage) Set(key string, value string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.running {
+		return utils.ErrClosed
+	}
+
 	strToAppend := fmt.Sprintf("%s;%s\n", key, value)
-	utils.AppendToFile(s.Filename, strToAppend)
+	return utils.AppendToFile(s.Filename, strToAppend)
 }
 
 // Get returns a value for a given key and a boolean indicator of whether the key exists.
-func (s *Storage) Get(key string) (string, bool) {
-	line, found := utils.FindLineByKeyInFile(s.Filename, key)
-	if found {
-		return utils.TrimKey(key, line), true
+func (s *Storage) Get(key string) (string, bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if !s.running {
+		return "", false, utils.ErrClosed
+	}
+
+	line, found, err := utils.FindLineByKeyInFile(s.Filename, key)
+	if err != nil || !found {
+		return "", false, err
 	}
 
-	return "", false
+	return utils.TrimKey(key, line), true, nil
 }
 
 // Start initializes Storage and creates a file if needed.
-func (s *Storage) Start() {
+func (s *Storage) Start() error {
 	log.Println("[INFO] Starting file storage")
-	utils.StartFileDB()
-	utils.CreateFileIfNotExists(s.Filename)
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := utils.StartFileDB()
+	if err != nil {
+		return err
+	}
+
+	err = utils.CreateFileIfNotExists(s.Filename)
+	if err != nil {
+		utils.StopFileDB()
+		return err
+	}
+
+	s.running = true
+	return nil
 }
 
 // Stop stops the storage
-func (s *Storage) Stop() {
-	utils.StopFileDB()
+func (s *Storage) Stop() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.running {
+		return nil
+	}
+	s.running = false
+	return utils.StopFileDB()
 }
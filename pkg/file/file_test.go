@@ -1,12 +1,14 @@
 package file
 
 import (
+	"errors"
 	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 
 	"github.com/alexander-akhmetov/mdb/pkg/test_utils"
+	"github.com/alexander-akhmetov/mdb/pkg/utils"
 )
 
 func TestFileStorage(t *testing.T) {
@@ -17,7 +19,7 @@ func TestFileStorage(t *testing.T) {
 	storage := &Storage{
 		Filename: filename,
 	}
-	storage.Start()
+	assert.Nil(t, storage.Start())
 
 	testKey := "t_key"
 	testValue := "t_value"
@@ -33,11 +35,62 @@ func TestFileStorage(t *testing.T) {
 
 	// Let's read the content of this file
 
-	value, exists := storage.Get(testKey2)
+	value, exists, err := storage.Get(testKey2)
+	assert.Nil(t, err)
 	assert.Equal(t, testValue2, value, "Wrong value")
 	assert.True(t, exists)
 
-	value, exists = storage.Get(testKey)
+	value, exists, err = storage.Get(testKey)
+	assert.Nil(t, err)
 	assert.Equal(t, testValue, value, "Wrong value")
 	assert.True(t, exists)
 }
+
+func TestFileStorageClosed(t *testing.T) {
+	// the stopped storage must return an error instead of touching the file
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	storage := &Storage{
+		Filename: ".test/db.mdb",
+	}
+	assert.Equal(t, utils.ErrClosed, storage.Set("key", "value"))
+
+	assert.Nil(t, storage.Start())
+	assert.Nil(t, storage.Set("key", "value"))
+	assert.Nil(t, storage.Stop())
+
+	_, _, err := storage.Get("key")
+	assert.Equal(t, utils.ErrClosed, err)
+}
+
+func TestFileStorageLocked(t *testing.T) {
+	// only one instance can use the database at the same time
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	storage := &Storage{
+		Filename: ".test/db.mdb",
+	}
+	assert.Nil(t, storage.Start())
+	defer storage.Stop()
+
+	another := &Storage{
+		Filename: ".test/db.mdb",
+	}
+	assert.True(t, errors.Is(another.Start(), utils.ErrLocked))
+}
+
+func TestFileStorageConcurrentAccess(t *testing.T) {
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	storage := &Storage{
+		Filename: ".test/db.mdb",
+	}
+	assert.Nil(t, storage.Start())
+	defer storage.Stop()
+
+	// every read scans the whole file, so the test uses less keys than others
+	testutils.StressTest(t, storage, testutils.StressConfig{Writers: 4, Readers: 4, Keys: 20, Rounds: 3})
+}
@@ -11,55 +11,97 @@ import (
 	"github.com/alexander-akhmetov/mdb/pkg/utils"
 )
 
-var writeMutex = &sync.Mutex{}
-
-// Storage holds data in a file
+// Storage holds data in a file.
+// It's safe for concurrent use: reads can run in parallel, writes are serialized.
 type Storage struct {
 	Filename string
+	mutex    sync.RWMutex // protects index and running
 	index    map[string]int64
+	running  bool
 }
 
 // Set saves the given key and value.
-func (s *Storage) Set(key string, value string) {
-	writeMutex.Lock()
-	defer writeMutex.Unlock()
+func (s *Storage) Set(key string, value string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.running {
+		return utils.ErrClosed
+	}
 
 	strToAppend := fmt.Sprintf("%s;%s\n", key, value)
-	s.index[key] = utils.GetFileSize(s.Filename)
-	log.Printf("[DEBUG] Adding key=%s with indexOffset=%v", key, s.index[key])
-	utils.AppendToFile(s.Filename, strToAppend)
+	offset, err := utils.GetFileSize(s.Filename)
+	if err != nil {
+		return err
+	}
+
+	log.Printf("[DEBUG] Adding key=%s with indexOffset=%v", key, offset)
+	err = utils.AppendToFile(s.Filename, strToAppend)
+	if err != nil {
+		return err
+	}
+
+	// update the index only when the line is saved, otherwise it would point to garbage
+	s.index[key] = offset
+	return nil
 }
 
 // Get returns a value for a given key and a boolean indicator of whether the key exists.
-func (s *Storage) Get(key string) (string, bool) {
-	var line string
-	if offset, ok := s.index[key]; ok {
-		log.Printf("[DEBUG] Reading key=%s with indexOffset=%v", key, offset)
-		line = utils.ReadLineByOffset(s.Filename, offset)
-		return utils.TrimKey(key, line), true
+func (s *Storage) Get(key string) (string, bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if !s.running {
+		return "", false, utils.ErrClosed
 	}
 
-	return "", false
+	offset, ok := s.index[key]
+	if !ok {
+		return "", false, nil
+	}
+
+	log.Printf("[DEBUG] Reading key=%s with indexOffset=%v", key, offset)
+	line, err := utils.ReadLineByOffset(s.Filename, offset)
+	if err != nil {
+		return "", false, err
+	}
+	return utils.TrimKey(key, line), true, nil
 }
 
 // Start initializes the Storage, creates the file if needed and rebuilds the index.
-func (s *Storage) Start() {
+func (s *Storage) Start() error {
 	log.Println("[INFO] Starting indexed file storage")
-	utils.StartFileDB()
-	utils.CreateFileIfNotExists(s.Filename)
-	log.Println("[DEBUG] Storage: rebuilding index...")
-	s.rebuildIndex()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	err := utils.StartFileDB()
+	if err != nil {
+		return err
+	}
+
+	err = utils.CreateFileIfNotExists(s.Filename)
+	if err == nil {
+		log.Println("[DEBUG] Storage: rebuilding index...")
+		err = s.rebuildIndex()
+	}
+	if err != nil {
+		utils.StopFileDB()
+		return err
+	}
+
+	s.running = true
 	log.Println("[DEBUG] Storage: started")
+	return nil
 }
 
 // rebuildIndex reads the file and builds an initial index.
 // It is slow for large files.
-func (s *Storage) rebuildIndex() {
+func (s *Storage) rebuildIndex() error {
 	s.index = map[string]int64{}
 
 	file, err := os.OpenFile(s.Filename, os.O_RDONLY, 0600)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer file.Close()
 
@@ -73,9 +115,18 @@ func (s *Storage) rebuildIndex() {
 		s.index[key] = offset
 		offset += int64(len([]byte(line)) + 1)
 	}
+
+	return scanner.Err()
 }
 
 // Stop stops the storage
-func (s *Storage) Stop() {
-	utils.StopFileDB()
+func (s *Storage) Stop() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if !s.running {
+		return nil
+	}
+	s.running = false
+	return utils.StopFileDB()
 }
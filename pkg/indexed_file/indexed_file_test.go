@@ -17,7 +17,7 @@ func TestIndexedFileStorage(t *testing.T) {
 	storage := &Storage{
 		Filename: filename,
 	}
-	storage.Start()
+	assert.Nil(t, storage.Start())
 
 	testKey := "t_key"
 	testValue := "t_value"
@@ -33,11 +33,13 @@ func TestIndexedFileStorage(t *testing.T) {
 
 	// Let's read the content of this file
 
-	value, exists := storage.Get(testKey)
+	value, exists, err := storage.Get(testKey)
+	assert.Nil(t, err)
 	assert.Equal(t, testValue, value, "Wrong value")
 	assert.True(t, exists)
 
-	value, exists = storage.Get(testKey2)
+	value, exists, err = storage.Get(testKey2)
+	assert.Nil(t, err)
 	assert.Equal(t, testValue2, value, "Wrong value")
 	assert.True(t, exists)
 
@@ -54,7 +56,7 @@ func TestIndexedFileStorageIndexBuild(t *testing.T) {
 	storage := &Storage{
 		Filename: filename,
 	}
-	storage.Start()
+	assert.Nil(t, storage.Start())
 
 	// save some values to have initial data in the DB
 	testKey := "t_key"
@@ -70,8 +72,8 @@ func TestIndexedFileStorageIndexBuild(t *testing.T) {
 	assert.Equal(t, int64(0), storage.index[testKey2], "index must be empty")
 
 	// build the index again
-	storage.Stop()
-	storage.Start()
+	assert.Nil(t, storage.Stop())
+	assert.Nil(t, storage.Start())
 	assert.Equal(t, int64(0), storage.index[testKey], "wrong index offset")
 	secondOffset := len(fmt.Sprintf("%s;%s\n", testKey, testValue))
 	assert.Equal(t, int64(secondOffset), storage.index[testKey2], "wrong index offset")
@@ -86,11 +88,25 @@ func TestIndexedFileStorageWhenThereIsNoKey(t *testing.T) {
 		Filename: filename,
 		index:    map[string]int64{},
 	}
-	storage.Start()
+	assert.Nil(t, storage.Start())
 
 	assert.Equal(t, 0, len(storage.index), "Index must be empty")
 
-	value, exists := storage.Get("somekey")
+	value, exists, err := storage.Get("somekey")
+	assert.Nil(t, err)
 	assert.Equal(t, "", value, "Wrong value")
 	assert.False(t, exists)
 }
+
+func TestIndexedFileStorageConcurrentAccess(t *testing.T) {
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	storage := &Storage{
+		Filename: ".test/db.mdb",
+	}
+	assert.Nil(t, storage.Start())
+	defer storage.Stop()
+
+	testutils.StressTest(t, storage, testutils.StressConfig{Writers: 4, Readers: 4, Keys: 50, Rounds: 3})
+}
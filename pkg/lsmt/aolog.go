@@ -0,0 +1,115 @@
+package lsmt
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// SyncMode defines when AOLog records are synced to disk.
+type SyncMode int
+
+const (
+	// SyncNone never syncs AOLog: the operating system decides when to write the data to disk.
+	// The fastest mode, but the latest writes can be lost if the machine crashes.
+	SyncNone SyncMode = iota
+	// SyncPeriodic syncs AOLog in the background every SyncInterval:
+	// only the writes of the last interval can be lost.
+	SyncPeriodic
+	// SyncEveryWrite syncs AOLog before a write returns, so a successful write is never lost.
+	// Concurrent writes share one sync.
+	SyncEveryWrite
+)
+
+const defaultSyncInterval = time.Millisecond * 100
+
+// aoLogConfig holds parameters of AOLog writers.
+type aoLogConfig struct {
+	syncMode     SyncMode
+	syncInterval time.Duration // only for SyncPeriodic, the default is used if it's not set
+}
+
+// aoLogWriter keeps an AOLog file open and appends records to it.
+type aoLogWriter struct {
+	file   *os.File
+	config aoLogConfig
+	mutex  sync.Mutex // protects closed
+	closed bool
+	stop   chan struct{} // stops the periodic sync process
+	done   chan struct{} // is closed when the periodic sync process exits
+}
+
+// write appends records to the file and syncs it if the mode requires that.
+// The records are written with one system call.
+func (w *aoLogWriter) write(records []byte) error {
+	_, err := w.file.Write(records)
+	if err != nil {
+		return err
+	}
+	if w.config.syncMode == SyncEveryWrite {
+		return w.file.Sync()
+	}
+	return nil
+}
+
+// syncPeriodically syncs the file every interval until the writer is closed.
+func (w *aoLogWriter) syncPeriodically(interval time.Duration) {
+	defer close(w.done)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			err := w.file.Sync()
+			if err != nil {
+				log.Printf("[ERROR] Can't sync AOLog file=%s: %v", w.file.Name(), err)
+			}
+		}
+	}
+}
+
+// close syncs and closes the file. It's safe to call it many times.
+func (w *aoLogWriter) close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	if w.stop != nil {
+		close(w.stop)
+		<-w.done
+	}
+	err := w.file.Sync()
+	if err != nil {
+		w.file.Close()
+		return err
+	}
+	return w.file.Close()
+}
+
+// newAOLogWriter opens the AOLog file for appending records.
+func newAOLogWriter(filename string, config aoLogConfig) (*aoLogWriter, error) {
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_APPEND|os.O_WRONLY, filePermissions)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &aoLogWriter{file: file, config: config}
+	if config.syncMode == SyncPeriodic {
+		interval := config.syncInterval
+		if interval <= 0 {
+			interval = defaultSyncInterval
+		}
+		w.stop = make(chan struct{})
+		w.done = make(chan struct{})
+		go w.syncPeriodically(interval)
+	}
+	return w, nil
+}
@@ -0,0 +1,76 @@
+package lsmt
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/entry"
+	"github.com/alexander-akhmetov/mdb/pkg/test_utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestAOLogWriterSyncModes(t *testing.T) {
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	for _, config := range []aoLogConfig{
+		{syncMode: SyncNone},
+		{syncMode: SyncPeriodic, syncInterval: time.Millisecond},
+		{syncMode: SyncEveryWrite},
+	} {
+		filename := ".test/test.aolog"
+		testutils.CreateFile(filename, "")
+
+		w, err := newAOLogWriter(filename, config)
+		assert.Nil(t, err)
+		assert.Nil(t, w.write(encodeRecord(&entry.DBEntry{Key: "k1", Value: "v1"})))
+		assert.Nil(t, w.write(encodeRecord(&entry.DBEntry{Key: "k2", Value: "v2"})))
+		if config.syncMode == SyncPeriodic {
+			// the periodic sync must not break writes
+			time.Sleep(time.Millisecond * 10)
+		}
+		assert.Nil(t, w.close())
+		// it's safe to close the writer twice
+		assert.Nil(t, w.close())
+
+		testutils.AssertKeysInFile(t, filename, [][2]string{{"k1", "v1"}, {"k2", "v2"}})
+	}
+}
+
+func TestMemtableGroupCommit(t *testing.T) {
+	// concurrent writes must be saved to AOLog and to the memtable
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	f := ".test/test.aolog"
+	m, err := newMemtable(f, aoLogConfig{syncMode: SyncEveryWrite})
+	assert.Nil(t, err)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				assert.Nil(t, m.Set(fmt.Sprintf("k-%v-%v", i, j), "v"))
+			}
+		}(i)
+	}
+	wg.Wait()
+	assert.Equal(t, 200, m.data.Len())
+	assert.Equal(t, 0, len(m.writeQueue))
+	assert.Nil(t, m.closeLog())
+
+	m = restoreMemtable(t, f)
+	assert.Equal(t, 200, m.data.Len())
+}
+
+// writeTestRecord appends the entry to the file as an AOLog record.
+func writeTestRecord(t *testing.T, filename string, e *entry.DBEntry) {
+	w, err := newAOLogWriter(filename, aoLogConfig{})
+	assert.Nil(t, err)
+	assert.Nil(t, w.write(encodeRecord(e)))
+	assert.Nil(t, w.close())
+}
@@ -0,0 +1,39 @@
+package lsmt
+
+import (
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/entry"
+)
+
+// WriteBatch holds a group of changes which are applied to the storage atomically:
+// after a crash, either all of them are restored or none.
+// The zero value is an empty batch ready to use.
+//
+//	batch := &lsmt.WriteBatch{}
+//	batch.Set("k1", "v1")
+//	batch.Delete("k2")
+//	err := storage.Write(batch)
+type WriteBatch struct {
+	entries []*entry.DBEntry
+}
+
+// Set adds the key and value to the batch.
+func (b *WriteBatch) Set(key string, value string) {
+	b.entries = append(b.entries, &entry.DBEntry{
+		Type:  entry.TypeValue,
+		Key:   key,
+		Value: value,
+	})
+}
+
+// Delete adds a tombstone for the key to the batch.
+func (b *WriteBatch) Delete(key string) {
+	b.entries = append(b.entries, &entry.DBEntry{
+		Type: entry.TypeTombstone,
+		Key:  key,
+	})
+}
+
+// Len returns the number of changes in the batch.
+func (b *WriteBatch) Len() int {
+	return len(b.entries)
+}
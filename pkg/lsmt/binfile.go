@@ -2,57 +2,126 @@ package lsmt
 
 import (
 	"bufio"
-	"log"
+	"encoding/binary"
+	"hash/crc32"
 	"os"
 
 	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/entry"
+	"github.com/alexander-akhmetov/mdb/pkg/utils"
 )
 
 const filePermissions = 0600
 
-// binScanner scans a binary file and automatically splits data into entry.DBEntry.
-type binScanner struct {
-	*bufio.Scanner
-}
+// maxEntrySize is the maximum size of one record in a binary file.
+const maxEntrySize = 64 * 1024 * 1024
 
-// appendBinaryToFile writes key-value pairs in binary format.
-func appendBinaryToFile(filename string, entry *entry.DBEntry) {
-	// todo: move to entry
-	file, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, filePermissions)
-	if err != nil {
-		log.Panic(err)
-	}
-	defer file.Close()
+// checksumSize is the size of CRC32 checksums of AOLog records and SSTable blocks.
+const checksumSize = 4
 
-	_, err = entry.Write(file)
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
 
-	if err != nil {
-		log.Panic(err)
-	}
+// checksum returns the CRC32 checksum of the data.
+func checksum(data []byte) uint32 {
+	return crc32.Checksum(data, crcTable)
+}
+
+// encodeRecord returns the binary record of the entry in the AOLog format:
+// [crc32 of the entry: 4bytes][entry]
+func encodeRecord(e *entry.DBEntry) []byte {
+	data := e.Binary()
+	record := make([]byte, checksumSize, checksumSize+len(data))
+	binary.BigEndian.PutUint32(record, checksum(data))
+	return append(record, data...)
 }
 
+// binScanner scans an AOLog file and automatically splits data into entry.DBEntry records.
+// It checks the checksum of every record.
+type binScanner struct {
+	*bufio.Scanner
+	offset int64 // offset of the end of the last returned record
+}
+
+// newBinFileScanner returns a scanner of AOLog records.
+// An incomplete record at the end of the file stops the scanner without an error:
+// it means that the process crashed while the record was being written.
+// A record with a wrong checksum at the end of the file is treated the same way,
+// but in the middle of the file it means that the file is corrupted.
+// The same is true for an incomplete record which is followed by complete ones.
 func newBinFileScanner(file *os.File, readBufferSize int) *binScanner {
-	scanner := bufio.NewScanner(file)
+	scanner := &binScanner{Scanner: bufio.NewScanner(file)}
 	split := func(data []byte, atEOF bool) (advance int, token []byte, err error) {
-		entry, err := entry.NewDBEntry(data)
-		if err == nil {
-			length := entry.Length()
-			return length, data[:length], nil
+		if len(data) < checksumSize {
+			return 0, nil, nil
+		}
+		entryLength, err := entry.BinaryLength(data[checksumSize:])
+		if err != nil {
+			// wait for more data
+			return 0, nil, nil
+		}
+		if entryLength > maxEntrySize-checksumSize {
+			return 0, nil, &utils.CorruptionError{Filename: file.Name(), Offset: scanner.offset, Reason: "record is too big"}
+		}
+		length := checksumSize + entryLength
+		if len(data) < length {
+			if atEOF && containsRecord(data[1:]) {
+				// A torn write is always the last record. If complete records follow,
+				// the length of this one is broken, and truncating the file would lose them.
+				return 0, nil, &utils.CorruptionError{Filename: file.Name(), Offset: scanner.offset, Reason: "wrong record length"}
+			}
+			return 0, nil, nil
+		}
+
+		record := data[checksumSize:length]
+		if binary.BigEndian.Uint32(data[:checksumSize]) != checksum(record) {
+			if len(data) == length {
+				// It can be the last record, it will be clear when we get more data.
+				// At the end of the file, the scanner stops without an error.
+				return 0, nil, nil
+			}
+			return 0, nil, &utils.CorruptionError{Filename: file.Name(), Offset: scanner.offset, Reason: "checksum mismatch"}
 		}
 
-		return 0, nil, nil
+		scanner.offset += int64(length)
+		return length, record, nil
 	}
 
 	buf := make([]byte, readBufferSize)
-	// we will need to change buffer's maximum capacity here later
-	scanner.Buffer(buf, bufio.MaxScanTokenSize)
+	// the buffer grows up to this limit only when an entry doesn't fit into it (big batches, for example)
+	scanner.Buffer(buf, maxEntrySize)
 
 	// set up custom split function
 	scanner.Split(split)
-	return &binScanner{scanner}
+	return scanner
+}
+
+// containsRecord returns true if a complete record with a correct checksum starts anywhere in the data.
+func containsRecord(data []byte) bool {
+	for i := 0; i+checksumSize < len(data); i++ {
+		entryLength, err := entry.BinaryLength(data[i+checksumSize:])
+		if err != nil {
+			return false
+		}
+		if entryLength > len(data)-i-checksumSize {
+			continue
+		}
+		end := i + checksumSize + entryLength
+		if binary.BigEndian.Uint32(data[i:]) == checksum(data[i+checksumSize:end]) {
+			return true
+		}
+	}
+	return false
 }
 
+// Offset returns the offset of the end of the last record returned by the scanner.
+func (b *binScanner) Offset() int64 {
+	return b.offset
+}
+
+// ReadEntry reads the next entry.
+// It returns entry.IncompleteEntryError when there are no entries left.
 func (b *binScanner) ReadEntry() (*entry.DBEntry, error) {
-	b.Scanner.Scan()
+	if !b.Scanner.Scan() && b.Scanner.Err() != nil {
+		return &entry.DBEntry{}, b.Scanner.Err()
+	}
 	return entry.NewDBEntry(b.Scanner.Bytes())
 }
@@ -10,9 +10,8 @@ import (
 	"github.com/alexander-akhmetov/mdb/pkg/test_utils"
 )
 
-func TestAppendBinaryToFile(t *testing.T) {
-	// test appendBinaryToFile
-	// file must exist
+func TestAOLogRecord(t *testing.T) {
+	// test the binary format of AOLog records
 	testutils.SetUp()
 	defer testutils.Teardown()
 
@@ -25,7 +24,7 @@ func TestAppendBinaryToFile(t *testing.T) {
 
 	testutils.AssertFileEmpty(t, filename)
 
-	appendBinaryToFile(filename, &entry.DBEntry{
+	writeTestRecord(t, filename, &entry.DBEntry{
 		Key:   key,
 		Value: value,
 	})
@@ -36,7 +35,7 @@ func TestAppendBinaryToFile(t *testing.T) {
 
 	// check the binary content
 	bytes := testutils.ReadFileBinary(filename)
-	expBytes := []byte{0x0, 0x0, 0x0, 0x0, 0x8, 0x0, 0x0, 0x0, 0xa, 0x74, 0x65, 0x73, 0x74, 0x2d, 0x6b, 0x65, 0x79, 0x74, 0x65, 0x73, 0x74, 0x2d, 0x76, 0x61, 0x6c, 0x75, 0x65}
+	expBytes := []byte{0xe7, 0x87, 0xd9, 0x98, 0x0, 0x0, 0x0, 0x0, 0x8, 0x0, 0x0, 0x0, 0xa, 0x74, 0x65, 0x73, 0x74, 0x2d, 0x6b, 0x65, 0x79, 0x74, 0x65, 0x73, 0x74, 0x2d, 0x76, 0x61, 0x6c, 0x75, 0x65}
 	assert.Equal(t, expBytes, bytes)
 }
 
@@ -55,13 +54,13 @@ func TestNewBinFileScanner(t *testing.T) {
 
 	testutils.AssertFileEmpty(t, filename)
 
-	appendBinaryToFile(filename, &entry.DBEntry{
+	writeTestRecord(t, filename, &entry.DBEntry{
 		Key:   key,
 		Value: value,
 	})
 
 	bytes := testutils.ReadFileBinary(filename)
-	expBytes := []byte{0x0, 0x0, 0x0, 0x0, 0x8, 0x0, 0x0, 0x0, 0xa, 0x74, 0x65, 0x73, 0x74, 0x2d, 0x6b, 0x65, 0x79, 0x74, 0x65, 0x73, 0x74, 0x2d, 0x76, 0x61, 0x6c, 0x75, 0x65}
+	expBytes := []byte{0xe7, 0x87, 0xd9, 0x98, 0x0, 0x0, 0x0, 0x0, 0x8, 0x0, 0x0, 0x0, 0xa, 0x74, 0x65, 0x73, 0x74, 0x2d, 0x6b, 0x65, 0x79, 0x74, 0x65, 0x73, 0x74, 0x2d, 0x76, 0x61, 0x6c, 0x75, 0x65}
 	assert.Equal(t, expBytes, bytes)
 
 	f, _ := os.Open(filename)
@@ -0,0 +1,452 @@
+package lsmt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/entry"
+	"github.com/alexander-akhmetov/mdb/pkg/utils"
+)
+
+// SSTable file format:
+//
+//	[data block 1]...[data block N][meta block][index block][footer]
+//
+// Data blocks keep sorted entries with prefix compressed keys, see blockBuilder.
+// A new block starts when the current one becomes bigger than the block size.
+// Every block can be compressed, and it's followed by a trailer with the compression
+// and the CRC32 checksum of the stored block and the compression byte:
+//
+//	[block][compression: 1byte][crc32: 4bytes]
+//
+// Block handles point to the stored block and don't include the trailer into the block size.
+// Tables of the format version 1 don't compress blocks and don't have the compression byte.
+// Blocks of the versions 1 and 2 are sequences of entries in the entry.DBEntry binary format without restart points.
+//
+// The index block has one entry per data block: the key is the last key of the block
+// and the value is the block handle: [offset: 8bytes][size: 8bytes].
+//
+// The meta block keeps additional information about the table as entries:
+// the level of the table, the smallest and the largest keys, the creation time, and the Bloom filter.
+//
+// The footer has a fixed size, so we can always find it at the end of the file:
+//
+//	[meta block handle: 16bytes][index block handle: 16bytes][version: 4bytes][magic: 8bytes]
+const (
+	ssTableFormatVersion   uint32 = 3
+	ssTableFormatVersionV1 uint32 = 1 // blocks without compression
+	ssTableFormatVersionV2 uint32 = 2 // blocks without prefix compression of keys
+
+	defaultBlockRestartInterval        = 16
+	ssTableMagic                uint64 = 0x6d64622d73737462 // "mdb-sstb"
+
+	blockHandleSize = 16
+	footerSize      = 2*blockHandleSize + 4 + 8
+)
+
+// Keys of the meta block entries
+const (
+	metaBloomFilterKey = "bloom"
+	metaLevelKey       = "level"
+	metaSmallestKey    = "smallest"
+	metaLargestKey     = "largest"
+	metaCreatedAtKey   = "created"
+)
+
+// blockHandle points to a block in an SSTable file.
+type blockHandle struct {
+	offset uint64
+	size   uint64
+}
+
+// Binary returns byte array with the handle.
+func (h blockHandle) Binary() []byte {
+	data := make([]byte, blockHandleSize)
+	binary.BigEndian.PutUint64(data[:8], h.offset)
+	binary.BigEndian.PutUint64(data[8:], h.size)
+	return data
+}
+
+// newBlockHandle parses a block handle from binary data.
+func newBlockHandle(data []byte) (blockHandle, error) {
+	if len(data) != blockHandleSize {
+		return blockHandle{}, fmt.Errorf("wrong block handle size=%v", len(data))
+	}
+	return blockHandle{
+		offset: binary.BigEndian.Uint64(data[:8]),
+		size:   binary.BigEndian.Uint64(data[8:]),
+	}, nil
+}
+
+// footer is the last part of an SSTable file which points to the meta and index blocks.
+type footer struct {
+	meta    blockHandle
+	index   blockHandle
+	version uint32
+}
+
+// Binary returns byte array with the footer.
+func (f *footer) Binary() []byte {
+	data := append(f.meta.Binary(), f.index.Binary()...)
+	tail := make([]byte, 12)
+	binary.BigEndian.PutUint32(tail[:4], f.version)
+	binary.BigEndian.PutUint64(tail[4:], ssTableMagic)
+	return append(data, tail...)
+}
+
+// newFooter parses the footer and checks the magic number and the format version.
+func newFooter(data []byte) (*footer, error) {
+	if len(data) != footerSize {
+		return nil, fmt.Errorf("wrong footer size=%v", len(data))
+	}
+	if binary.BigEndian.Uint64(data[footerSize-8:]) != ssTableMagic {
+		return nil, errors.New("wrong magic number")
+	}
+
+	f := &footer{version: binary.BigEndian.Uint32(data[2*blockHandleSize : 2*blockHandleSize+4])}
+	if f.version < ssTableFormatVersionV1 || f.version > ssTableFormatVersion {
+		return nil, fmt.Errorf("unsupported sstable format version=%v", f.version)
+	}
+
+	var err error
+	f.meta, err = newBlockHandle(data[:blockHandleSize])
+	if err != nil {
+		return nil, err
+	}
+	f.index, err = newBlockHandle(data[blockHandleSize : 2*blockHandleSize])
+	if err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// blockTrailerSize returns the size of the data after every block in tables of the format version.
+func blockTrailerSize(version uint32) uint64 {
+	if version == ssTableFormatVersionV1 {
+		return checksumSize
+	}
+	return 1 + checksumSize
+}
+
+// readBlock reads the block from the file, verifies its checksum and decompresses it.
+// dataSize is the size of the file without the footer, the block must be inside it.
+func readBlock(file *os.File, h blockHandle, dataSize int64, version uint32) ([]byte, error) {
+	err := checkBlockHandle(file.Name(), h, dataSize, version)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make([]byte, h.size+blockTrailerSize(version))
+	_, err = file.ReadAt(data, int64(h.offset))
+	if err != nil {
+		return nil, err
+	}
+	return decodeBlock(file.Name(), h, data, version)
+}
+
+// readMappedBlock returns the block from the mapped file without copying it if it's not compressed:
+// in this case mapped is true, and the block is valid only while the file is mapped.
+func readMappedBlock(mapping []byte, filename string, h blockHandle, dataSize int64, version uint32) (block []byte, mapped bool, err error) {
+	err = checkBlockHandle(filename, h, dataSize, version)
+	if err != nil {
+		return nil, false, err
+	}
+
+	data := mapping[h.offset : h.offset+h.size+blockTrailerSize(version)]
+	block, err = decodeBlock(filename, h, data, version)
+	if err != nil {
+		return nil, false, err
+	}
+	return block, isStoredUncompressed(mapping, h, version), nil
+}
+
+// isStoredUncompressed returns true if the block is stored in the file without compression.
+// The block handle must be checked by the caller.
+func isStoredUncompressed(data []byte, h blockHandle, version uint32) bool {
+	return version == ssTableFormatVersionV1 || Compression(data[h.offset+h.size]) == NoCompression
+}
+
+// checkBlockHandle returns an error if the block with its trailer is out of the data part of the file.
+func checkBlockHandle(filename string, h blockHandle, dataSize int64, version uint32) error {
+	trailerSize := blockTrailerSize(version)
+	if h.offset > uint64(dataSize) || h.size > uint64(dataSize) || h.offset+h.size+trailerSize > uint64(dataSize) {
+		return &utils.CorruptionError{
+			Filename: filename,
+			Offset:   int64(h.offset),
+			Reason:   fmt.Sprintf("block size=%v is out of the file", h.size),
+		}
+	}
+	return nil
+}
+
+// decodeBlock verifies the checksum of the stored block with its trailer and decompresses it.
+func decodeBlock(filename string, h blockHandle, data []byte, version uint32) ([]byte, error) {
+	// the checksum covers the compression byte too
+	checked := data[:len(data)-checksumSize]
+	if binary.BigEndian.Uint32(data[len(checked):]) != checksum(checked) {
+		return nil, &utils.CorruptionError{Filename: filename, Offset: int64(h.offset), Reason: "block checksum mismatch"}
+	}
+	if version == ssTableFormatVersionV1 {
+		return data[:h.size], nil
+	}
+
+	block, err := decompressBlock(data[:h.size], Compression(data[h.size]))
+	if err != nil {
+		return nil, &utils.CorruptionError{
+			Filename: filename,
+			Offset:   int64(h.offset),
+			Reason:   fmt.Sprintf("can't decompress block: %v", err),
+		}
+	}
+	return block, nil
+}
+
+// blockBuilder builds a block of the format version 3 with prefix compressed keys.
+// Every entry stores only the part of the key which differs from the previous key:
+//
+//	[type: 1byte][shared key length: uvarint][unshared key length: uvarint][value length: uvarint][unshared key][value]
+//
+// Every restartInterval entries the key is stored in full, such entries are restart points.
+// Offsets of restart points are saved at the end of the block, so the block can be searched with a binary search:
+//
+//	[entries][restart offset: 4bytes]...[restart offset: 4bytes][restarts count: 4bytes]
+type blockBuilder struct {
+	data            []byte
+	restarts        []uint32
+	restartInterval int
+	counter         int // entries since the last restart point
+	lastKey         string
+}
+
+func newBlockBuilder(restartInterval int) *blockBuilder {
+	if restartInterval <= 0 {
+		restartInterval = defaultBlockRestartInterval
+	}
+	return &blockBuilder{restartInterval: restartInterval}
+}
+
+// add appends the entry to the block.
+func (b *blockBuilder) add(e *entry.DBEntry) {
+	shared := 0
+	if b.counter < b.restartInterval && len(b.restarts) > 0 {
+		shared = sharedPrefixLength(b.lastKey, e.Key)
+	} else {
+		b.restarts = append(b.restarts, uint32(len(b.data)))
+		b.counter = 0
+	}
+
+	header := make([]byte, 1+3*binary.MaxVarintLen64)
+	header[0] = e.Type
+	n := 1
+	n += binary.PutUvarint(header[n:], uint64(shared))
+	n += binary.PutUvarint(header[n:], uint64(len(e.Key)-shared))
+	n += binary.PutUvarint(header[n:], uint64(len(e.Value)))
+
+	b.data = append(b.data, header[:n]...)
+	b.data = append(b.data, e.Key[shared:]...)
+	b.data = append(b.data, e.Value...)
+	b.lastKey = e.Key
+	b.counter++
+}
+
+// size returns the size of the block if it's finished now, or 0 if the block is empty.
+func (b *blockBuilder) size() int {
+	if b.empty() {
+		return 0
+	}
+	return len(b.data) + 4*len(b.restarts) + 4
+}
+
+// empty returns true if no entries have been added since the last reset.
+func (b *blockBuilder) empty() bool {
+	return len(b.data) == 0
+}
+
+// finish appends the restart points to the entries and returns the block.
+// The result is valid until the next reset.
+func (b *blockBuilder) finish() []byte {
+	for _, offset := range b.restarts {
+		b.data = appendUint32(b.data, offset)
+	}
+	return appendUint32(b.data, uint32(len(b.restarts)))
+}
+
+// reset prepares the builder for the next block.
+func (b *blockBuilder) reset() {
+	b.data = b.data[:0]
+	b.restarts = b.restarts[:0]
+	b.counter = 0
+	b.lastKey = ""
+}
+
+func appendUint32(data []byte, value uint32) []byte {
+	buf := make([]byte, 4)
+	binary.BigEndian.PutUint32(buf, value)
+	return append(data, buf...)
+}
+
+// sharedPrefixLength returns the length of the common prefix of two keys.
+func sharedPrefixLength(a string, b string) int {
+	n := 0
+	for n < len(a) && n < len(b) && a[n] == b[n] {
+		n++
+	}
+	return n
+}
+
+// errIncompleteEntry is returned when an entry doesn't fit into the rest of the block.
+var errIncompleteEntry = fmt.Errorf("block has an incomplete entry: %w", utils.ErrCorrupted)
+
+// blockIterator iterates over entries of one block.
+// Blocks of the format version 3 have prefix compressed keys and restart points,
+// blocks of older versions are sequences of entries in the entry.DBEntry binary format.
+type blockIterator struct {
+	data     []byte // entries of the block
+	restarts []byte // restart offsets, only in prefix compressed blocks
+	prefixed bool
+	offset   int // offset of the next entry
+	key      []byte
+	current  *entry.DBEntry
+	err      error
+}
+
+func newBlockIterator(data []byte, version uint32) *blockIterator {
+	if version <= ssTableFormatVersionV2 {
+		return &blockIterator{data: data}
+	}
+
+	it := &blockIterator{prefixed: true}
+	if len(data) < 4 {
+		it.err = fmt.Errorf("block is too small: %w", utils.ErrCorrupted)
+		return it
+	}
+	count := uint64(binary.BigEndian.Uint32(data[len(data)-4:]))
+	if count*4+4 > uint64(len(data)) {
+		it.err = fmt.Errorf("block has a wrong number of restart points=%v: %w", count, utils.ErrCorrupted)
+		return it
+	}
+	entriesEnd := len(data) - 4 - int(count)*4
+	it.data = data[:entriesEnd]
+	it.restarts = data[entriesEnd : len(data)-4]
+	return it
+}
+
+func (it *blockIterator) Next() bool {
+	if it.offset >= len(it.data) || it.err != nil {
+		it.current = nil
+		return false
+	}
+
+	if !it.prefixed {
+		e, err := entry.NewDBEntry(it.data[it.offset:])
+		if err != nil {
+			it.err = errIncompleteEntry
+			return false
+		}
+		it.current = e
+		it.offset += e.Length()
+		return true
+	}
+
+	e, length, err := it.decodeEntry(it.offset)
+	if err != nil {
+		it.err = err
+		return false
+	}
+	it.current = e
+	it.offset += length
+	return true
+}
+
+// decodeEntry decodes the prefix compressed entry at the offset and returns it with its length.
+// The key is restored from the key of the previous entry.
+func (it *blockIterator) decodeEntry(offset int) (*entry.DBEntry, int, error) {
+	data := it.data[offset:]
+	if len(data) < 1 {
+		return nil, 0, errIncompleteEntry
+	}
+
+	n := 1
+	lengths := [3]uint64{}
+	for i := range lengths {
+		value, size := binary.Uvarint(data[n:])
+		if size <= 0 {
+			return nil, 0, errIncompleteEntry
+		}
+		lengths[i] = value
+		n += size
+	}
+	shared, unshared, valueLength := lengths[0], lengths[1], lengths[2]
+	if shared > uint64(len(it.key)) || unshared+valueLength > uint64(len(data)-n) {
+		return nil, 0, errIncompleteEntry
+	}
+
+	it.key = append(it.key[:shared], data[n:n+int(unshared)]...)
+	n += int(unshared)
+	e := &entry.DBEntry{
+		Type:  data[0],
+		Key:   string(it.key),
+		Value: string(data[n : n+int(valueLength)]),
+	}
+	return e, n + int(valueLength), nil
+}
+
+// Seek moves the iterator to the first entry with a key which is not less than the given one
+// and returns false if there is no such entry. Next continues from the entry after it.
+// Blocks with restart points are searched with a binary search over restart points,
+// and then only the entries after the found restart point are read.
+func (it *blockIterator) Seek(key string) bool {
+	if it.prefixed && it.err == nil {
+		it.offset = it.findRestart(key)
+		it.key = it.key[:0]
+	}
+
+	for it.Next() {
+		if it.current.Key >= key {
+			return true
+		}
+	}
+	return false
+}
+
+// findRestart returns the offset of the last restart point with a key which is less than the given one,
+// or the offset of the first restart point if there is no such key.
+func (it *blockIterator) findRestart(key string) int {
+	left, right := 0, len(it.restarts)/4-1
+	for left < right {
+		middle := (left + right + 1) / 2
+		offset := it.restartOffset(middle)
+		it.key = it.key[:0]
+		e, _, err := it.decodeEntry(offset)
+		if err != nil || e.Key >= key {
+			right = middle - 1
+		} else {
+			left = middle
+		}
+	}
+	if right < 0 {
+		return 0
+	}
+	return it.restartOffset(left)
+}
+
+func (it *blockIterator) restartOffset(position int) int {
+	offset := int(binary.BigEndian.Uint32(it.restarts[position*4:]))
+	if offset > len(it.data) {
+		// it's reported as an incomplete entry when the iterator reads it
+		return len(it.data)
+	}
+	return offset
+}
+
+func (it *blockIterator) Entry() *entry.DBEntry {
+	return it.current
+}
+
+func (it *blockIterator) Err() error {
+	return it.err
+}
+
+func (it *blockIterator) Close() {}
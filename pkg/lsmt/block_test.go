@@ -0,0 +1,117 @@
+package lsmt
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/entry"
+	"github.com/alexander-akhmetov/mdb/pkg/utils"
+)
+
+func newTestBlockEntries(count int) []*entry.DBEntry {
+	entries := []*entry.DBEntry{}
+	for i := 0; i < count; i++ {
+		entries = append(entries, &entry.DBEntry{Key: fmt.Sprintf("user:%05d:name", i*2), Value: fmt.Sprintf("value-%v", i)})
+	}
+	return entries
+}
+
+func buildTestBlock(entries []*entry.DBEntry, restartInterval int) []byte {
+	b := newBlockBuilder(restartInterval)
+	for _, e := range entries {
+		b.add(e)
+	}
+	return b.finish()
+}
+
+func TestBlockBuilderPrefixCompression(t *testing.T) {
+	entries := newTestBlockEntries(100)
+	block := buildTestBlock(entries, 16)
+
+	rawSize := 0
+	for _, e := range entries {
+		rawSize += e.Length()
+	}
+	assert.True(t, len(block) < rawSize*2/3, "block=%v raw=%v", len(block), rawSize)
+
+	// 100 entries have 7 restart points
+	it := newBlockIterator(block, ssTableFormatVersion)
+	assert.Equal(t, 7*4, len(it.restarts))
+
+	result := []*entry.DBEntry{}
+	for it.Next() {
+		result = append(result, it.Entry())
+	}
+	assert.Nil(t, it.Err())
+	assert.Equal(t, entries, result)
+}
+
+func TestBlockIteratorSeek(t *testing.T) {
+	entries := newTestBlockEntries(100)
+
+	for _, restartInterval := range []int{1, 3, 16, 1000} {
+		block := buildTestBlock(entries, restartInterval)
+
+		for i, e := range entries {
+			it := newBlockIterator(block, ssTableFormatVersion)
+			assert.True(t, it.Seek(e.Key))
+			assert.Equal(t, e, it.Entry())
+
+			// a missing key between two keys finds the next one, and Next continues after it
+			it = newBlockIterator(block, ssTableFormatVersion)
+			found := it.Seek(fmt.Sprintf("user:%05d:name", i*2-1))
+			assert.True(t, found)
+			assert.Equal(t, e.Key, it.Entry().Key)
+			if i < len(entries)-1 {
+				assert.True(t, it.Next())
+				assert.Equal(t, entries[i+1], it.Entry())
+			}
+		}
+
+		it := newBlockIterator(block, ssTableFormatVersion)
+		assert.True(t, it.Seek(""))
+		assert.Equal(t, entries[0], it.Entry())
+		assert.False(t, it.Seek("user:99999"))
+		assert.Nil(t, it.Err())
+	}
+}
+
+func TestBlockIteratorOldFormat(t *testing.T) {
+	// blocks of the format versions 1 and 2 don't have restart points
+	entries := newTestBlockEntries(10)
+	block := []byte{}
+	for _, e := range entries {
+		block = append(block, e.Binary()...)
+	}
+
+	it := newBlockIterator(block, ssTableFormatVersionV2)
+	assert.True(t, it.Seek(entries[5].Key))
+	assert.Equal(t, entries[5], it.Entry())
+	assert.True(t, it.Next())
+	assert.Equal(t, entries[6], it.Entry())
+}
+
+func TestBlockIteratorCorrupted(t *testing.T) {
+	block := buildTestBlock(newTestBlockEntries(10), 4)
+
+	for _, broken := range [][]byte{
+		{1, 2},
+		// the last entry is cut
+		append(append([]byte{}, block[:20]...), block[len(block)-12:]...),
+		// too many restart points
+		{0, 0, 0, 100},
+	} {
+		it := newBlockIterator(broken, ssTableFormatVersion)
+		for it.Next() {
+		}
+		assert.True(t, errors.Is(it.Err(), utils.ErrCorrupted))
+	}
+
+	empty := newBlockBuilder(16).finish()
+	it := newBlockIterator(empty, ssTableFormatVersion)
+	assert.False(t, it.Seek("a"))
+	assert.Nil(t, it.Err())
+}
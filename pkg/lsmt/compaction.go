@@ -1,104 +1,278 @@
 package lsmt
 
 import (
+	"errors"
+	"fmt"
 	"log"
-	"os"
 	"path/filepath"
-	"sync"
+	"sort"
+	"time"
 
 	"github.com/alexander-akhmetov/mdb/pkg/utils"
 )
 
-var compactionMutex = &sync.Mutex{}
+// compactionTask describes one compaction: which tables are merged and where the result goes.
+type compactionTask struct {
+	inputs         []*ssTable // ordered from the newest to the oldest
+	level          int        // level of the result tables
+	dropTombstones bool       // there are no older tables which can hold deleted keys
+	maxFileSize    int64      // the result is split into tables of this size, 0 means one table
+	seq            int64      // sequence of the result tables: the sequence of the newest input
+	createdAt      time.Time  // creation time of the result tables: the time of the newest input
+}
 
-const ssTableReadBufferSize = 4096
+// isInput returns true if the table is one of the tables merged by the task.
+func (t *compactionTask) isInput(table *ssTable) bool {
+	for _, input := range t.inputs {
+		if input == table {
+			return true
+		}
+	}
+	return false
+}
 
-// compact finds N SSTables in the workDir
-// that can be merged together (they must be smaller than some limit)
-// and merges them into one bigger SSTable. Then it removes the old files.
-func compact(workDir string, tmpDir string, minimumFilesToCompact int, maxCompactFileSize int64) (string, string, string, bool) {
-	compactionMutex.Lock()
-	defer compactionMutex.Unlock()
+// newCompactionTask checks the compaction chosen by a strategy and returns the task to run it.
+func newCompactionTask(c *Compaction, tables []*ssTable, infos []TableInfo) (*compactionTask, error) {
+	if len(c.Inputs) == 0 {
+		return nil, errors.New("wrong compaction: no tables to merge")
+	}
+	if c.OutputLevel < 0 || c.OutputLevel >= maxLevels {
+		return nil, fmt.Errorf("wrong compaction: level=%v is out of range", c.OutputLevel)
+	}
 
-	fFile, sFile, needToCompact := getTwoFilesToCompact(workDir, minimumFilesToCompact, maxCompactFileSize)
+	positions := append([]int{}, c.Inputs...)
+	sort.Ints(positions)
+	for i, position := range positions {
+		if position < 0 || position >= len(tables) {
+			return nil, fmt.Errorf("wrong compaction: table=%v is out of range", position)
+		}
+		if i > 0 && position == positions[i-1] {
+			return nil, fmt.Errorf("wrong compaction: table=%v is merged twice", position)
+		}
+		if c.OutputLevel == 0 && (tables[position].level != 0 || position != positions[0]+i) {
+			return nil, errors.New("wrong compaction: level 0 compaction must merge neighbour level 0 tables")
+		}
+		if tables[position].level > c.OutputLevel {
+			return nil, fmt.Errorf("wrong compaction: table=%v can't be moved to a lower level", position)
+		}
+	}
 
-	if !needToCompact {
-		return "", "", "", false
+	smallest, largest, ok := keyRange(infos, positions)
+	for i := positions[0] + 1; ok && c.OutputLevel > 0 && i < len(tables); i++ {
+		if isPosition(positions, i) || !infos[i].overlaps(smallest, largest) {
+			continue
+		}
+		// An older table of an upper level is searched before the result,
+		// so its versions of the keys would hide the newer ones.
+		if tables[i].level < c.OutputLevel {
+			return nil, fmt.Errorf("wrong compaction: older table=%v with the same keys must be merged too", i)
+		}
+		if tables[i].level == c.OutputLevel {
+			return nil, fmt.Errorf("wrong compaction: table=%v overlaps the result in level=%v", i, c.OutputLevel)
+		}
 	}
-	log.Println("[DEBUG] Started compaction process")
 
-	tmpFilePath := filepath.Join(tmpDir, filepath.Base(sFile))
-	utils.CreateFileIfNotExists(tmpFilePath)
+	task := &compactionTask{level: c.OutputLevel}
+	for _, position := range positions {
+		t := tables[position]
+		task.inputs = append(task.inputs, t)
+		// the result of a level 0 compaction takes the place of the newest table
+		if t.seq > task.seq {
+			task.seq = t.seq
+		}
+		if t.createdAt.After(task.createdAt) {
+			task.createdAt = t.createdAt
+		}
+	}
+	if c.OutputLevel > 0 {
+		task.maxFileSize = c.MaxFileSize
+	}
 
-	merge(fFile, sFile, tmpFilePath)
+	// Tombstones can be removed only when there are no older SSTables with the same keys:
+	// otherwise, an older version of the deleted key would become visible again.
+	task.dropTombstones = true
+	for i := positions[0] + 1; ok && i < len(tables); i++ {
+		if !task.isInput(tables[i]) && infos[i].overlaps(smallest, largest) {
+			task.dropTombstones = false
+			break
+		}
+	}
+	return task, nil
+}
 
-	return fFile, sFile, tmpFilePath, true
+// isPosition returns true if the sorted positions have the given one.
+func isPosition(positions []int, position int) bool {
+	i := sort.SearchInts(positions, position)
+	return i < len(positions) && positions[i] == position
 }
 
-// merge merges files into one.
-func merge(fFile string, sFile string, mergeTo string) {
-	log.Printf("[DEBUG] Merging %s + %s => %s", fFile, sFile, mergeTo)
+// compact asks config.CompactionStrategy which tables must be merged
+// and merges them into new SSTables in the temporary directory.
+// Result tables get new file numbers from the manifest.
+// It returns the task and paths to the result tables, or a nil task if there is nothing to compact.
+// If config.ParanoidChecks is enabled, it reads the result files again to verify them.
+func compact(config *StorageConfig, m *manifest, tables []*ssTable) (*compactionTask, []string, error) {
+	infos := make([]TableInfo, len(tables))
+	for i, t := range tables {
+		infos[i] = t.info()
+	}
+	c := config.CompactionStrategy.PickCompaction(infos)
+	if c == nil {
+		return nil, nil, nil
+	}
+	task, err := newCompactionTask(c, tables, infos)
+	if err != nil {
+		return nil, nil, err
+	}
+	log.Printf("[DEBUG] Started compaction process: tables=%v level=%v", len(task.inputs), task.level)
 
-	firstFile, err := os.Open(fFile)
+	err = utils.CreateDir(config.tmpDir)
 	if err != nil {
-		log.Println("[ERROR] Can't open file to compact = ", fFile)
+		return nil, nil, err
 	}
-	defer firstFile.Close()
 
-	secondFile, err := os.Open(sFile)
+	results, counts, err := merge(config, m, task)
 	if err != nil {
-		log.Println("[ERROR] Can't open file to compact = ", sFile)
+		return nil, nil, err
 	}
-	defer secondFile.Close()
 
-	firstScanner := newBinFileScanner(firstFile, ssTableReadBufferSize)
-	secondScanner := newBinFileScanner(secondFile, ssTableReadBufferSize)
+	if config.ParanoidChecks {
+		for i, filename := range results {
+			err = verifySSTable(filename, counts[i])
+			if err != nil {
+				return nil, nil, fmt.Errorf("compaction result verification failed: %w", err)
+			}
+		}
+	}
 
-	fEntry, _ := firstScanner.ReadEntry()
-	sEntry, _ := secondScanner.ReadEntry()
+	return task, results, nil
+}
 
-	for true == true {
-		// Compare files line by line and add only the latest keys to the new file.
-		for (sEntry.Key > fEntry.Key && fEntry.Key != "") || (fEntry.Key != "" && sEntry.Key == "") {
-			appendBinaryToFile(mergeTo, fEntry)
-			fEntry, _ = firstScanner.ReadEntry()
+// merge merges the input tables of the task into new tables in the temporary directory.
+// If a key exists in many tables, the value from the newest one wins.
+// It returns paths to the result tables and the number of entries in every table.
+func merge(config *StorageConfig, m *manifest, task *compactionTask) ([]string, []int, error) {
+	sources := []entryIterator{}
+	defer func() {
+		for _, src := range sources {
+			src.Close()
 		}
+	}()
 
-		for (sEntry.Key <= fEntry.Key && sEntry.Key != "") || (fEntry.Key == "" && sEntry.Key != "") {
-			appendBinaryToFile(mergeTo, sEntry)
-			for sEntry.Key == fEntry.Key {
-				// If keys are equal, we need to read the next first key too,
-				// otherwise we will save it again in this loop.
-				fEntry, _ = firstScanner.ReadEntry()
-			}
-			sEntry, _ = secondScanner.ReadEntry()
+	for _, table := range task.inputs {
+		log.Printf("[DEBUG] Merging %s", table.config.filename)
+		it, err := newSSTableIterator(table, "", "")
+		if err != nil {
+			return nil, nil, fmt.Errorf("can't open file to compact=%s: %w", table.config.filename, err)
 		}
-		if fEntry.Key == "" && sEntry.Key == "" {
-			break
+		sources = append(sources, it)
+	}
+
+	results := []string{}
+	counts := []int{}
+	var w *ssTableWriter
+	defer func() {
+		if w != nil {
+			w.Close()
 		}
+	}()
+
+	newWriter := func() error {
+		path := filepath.Join(config.tmpDir, fmt.Sprintf("%v.sstable", m.newFileNumber()))
+		tableConfig := config.ssTableWriterConfig(task.level)
+		tableConfig.createdAt = task.createdAt
+		var err error
+		w, err = newSSTableWriter(path, tableConfig)
+		if err != nil {
+			return err
+		}
+		results = append(results, path)
+		counts = append(counts, 0)
+		return nil
 	}
-}
 
-// getTwoFilesToCompact returns paths to two files that we can merge
-// and a boolean indicating whether we can merge the files or not.
-func getTwoFilesToCompact(dir string, minimumFilesToCompact int, maxFileSize int64) (string, string, bool) {
-	allFiles := listSSTables(dir)
+	finishWriter := func() error {
+		err := w.Finish()
+		w = nil
+		return err
+	}
 
-	// filter big files
-	files := []utils.FileInfo{}
-	for _, f := range allFiles {
-		if f.Size < maxFileSize {
-			files = append(files, f)
+	merged := newMergingIterator(sources)
+	for merged.Next() {
+		if task.dropTombstones && merged.Entry().IsTombstone() {
+			continue
 		}
+		if w == nil {
+			err := newWriter()
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+		err := w.Add(merged.Entry())
+		if err != nil {
+			return nil, nil, err
+		}
+		counts[len(counts)-1]++
+
+		if task.maxFileSize > 0 && w.Size() >= task.maxFileSize {
+			err = finishWriter()
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+	}
+	if merged.Err() != nil {
+		return nil, nil, merged.Err()
 	}
-	filesCount := len(files)
 
-	if filesCount < minimumFilesToCompact {
-		return "", "", false
+	// a not split result is created even if it's empty: it replaces the input tables
+	if w == nil && task.maxFileSize == 0 {
+		err := newWriter()
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if w != nil {
+		err := finishWriter()
+		if err != nil {
+			return nil, nil, err
+		}
 	}
 
-	firstFileInfo := files[filesCount-1]
-	secondFileInfo := files[filesCount-2]
+	return results, counts, nil
+}
+
+// verifySSTable reads all blocks of the SSTable, so their checksums are verified,
+// and checks that the table has the expected number of sorted entries.
+func verifySSTable(filename string, expCount int) error {
+	table, err := newSSTable(&ssTableConfig{filename: filename})
+	if err != nil {
+		return err
+	}
+	it, err := newSSTableIterator(table, "", "")
+	if err != nil {
+		return err
+	}
+	defer it.Close()
 
-	return firstFileInfo.Name, secondFileInfo.Name, true
+	count := 0
+	lastKey := ""
+	for it.Next() {
+		if count > 0 && it.Entry().Key <= lastKey {
+			return &utils.CorruptionError{
+				Filename: filename,
+				Offset:   int64(table.blocks[it.position-1].offset),
+				Reason:   fmt.Sprintf("key=%s is not sorted", it.Entry().Key),
+			}
+		}
+		lastKey = it.Entry().Key
+		count++
+	}
+	if it.Err() != nil {
+		return it.Err()
+	}
+	if count != expCount {
+		return &utils.CorruptionError{Filename: filename, Reason: fmt.Sprintf("expected %v entries, found %v", expCount, count)}
+	}
+	return nil
 }
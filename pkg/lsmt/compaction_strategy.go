@@ -0,0 +1,307 @@
+package lsmt
+
+import (
+	"log"
+	"sort"
+	"time"
+)
+
+const defaultLevel0FilesToCompact = 4
+const defaultLevelBaseSize int64 = 1024 * 1024 * 10
+const defaultLevelSizeRatio = 10
+const defaultTargetFileSize int64 = 1024 * 1024 * 2
+const defaultTimeWindow = time.Hour
+
+// TableInfo describes an SSTable for compaction strategies.
+type TableInfo struct {
+	Filename string
+	Level    int
+	Size     int64
+	Empty    bool   // the table has no keys
+	Smallest string // the smallest key, empty if the table has no keys
+	Largest  string // the largest key, empty if the table has no keys
+	// CreatedAt is the creation time of the table.
+	// A table created by the compaction keeps the time of the newest merged table.
+	CreatedAt time.Time
+}
+
+// Compaction describes which tables must be merged and where the result goes.
+//
+// The result of a level 0 compaction is always one table which takes the place of the newest input,
+// so the inputs must be neighbours in the list: otherwise, the result would hide newer versions of keys
+// from the tables between them. The result of a level 1+ compaction is split into tables of MaxFileSize bytes,
+// and key ranges of tables in levels 1+ must not overlap: the inputs must include all tables of the output level
+// which overlap them. Tables can't be moved to a lower level, and older tables with the same keys
+// can't be left in the levels above the output: they would hide the result.
+//
+// Tombstones are removed automatically when no older table can hold the deleted keys.
+type Compaction struct {
+	Inputs      []int // positions of the tables to merge in the list given to the strategy
+	OutputLevel int
+	MaxFileSize int64 // only for levels 1+, 0 means one table
+}
+
+// CompactionStrategy chooses which SSTables must be compacted.
+// It's called by one background process, so it can keep a state between calls,
+// but one strategy instance must not be shared between storages.
+type CompactionStrategy interface {
+	// PickCompaction returns the next compaction or nil if there is nothing to compact.
+	// Tables are ordered the way keys are searched in them:
+	// level by level starting from level 0, and newer tables first inside of every level.
+	PickCompaction(tables []TableInfo) *Compaction
+}
+
+// Level0Limiter is implemented by strategies which keep the number of level 0 tables bounded:
+// when there are at least Level0Limit tables in level 0, they move them to deeper levels.
+// Level 0 write stall thresholds can be used only with such strategies,
+// otherwise writes could wait for a compaction which never comes.
+type Level0Limiter interface {
+	Level0Limit() int
+}
+
+// SizeTieredStrategy merges two oldest neighbour level 0 tables which are smaller than MaxFileSize,
+// if there are at least MinimumFilesToCompact such tables.
+// Once a table becomes bigger than the limit, it's never compacted again.
+type SizeTieredStrategy struct {
+	MinimumFilesToCompact int   // default is 2
+	MaxFileSize           int64 // default is 10MB
+}
+
+// PickCompaction implements CompactionStrategy.
+func (s *SizeTieredStrategy) PickCompaction(tables []TableInfo) *Compaction {
+	minimumFiles := s.MinimumFilesToCompact
+	if minimumFiles < 2 {
+		minimumFiles = 2
+	}
+
+	small := 0
+	for _, t := range tables {
+		if s.isSmall(t) {
+			small++
+		}
+	}
+	if small < minimumFiles {
+		return nil
+	}
+
+	// Tables are ordered from the newest to the oldest, so we start from the end.
+	for i := len(tables) - 1; i > 0; i-- {
+		if s.isSmall(tables[i]) && s.isSmall(tables[i-1]) {
+			return &Compaction{Inputs: []int{i - 1, i}, OutputLevel: 0}
+		}
+	}
+	return nil
+}
+
+func (s *SizeTieredStrategy) isSmall(t TableInfo) bool {
+	maxFileSize := s.MaxFileSize
+	if maxFileSize == 0 {
+		maxFileSize = defaultMaxCompactFileSize
+	}
+	return t.Level == 0 && t.Size < maxFileSize
+}
+
+// TimeWindowStrategy is for append-mostly data where keys are written in time order:
+// level 0 tables are grouped by windows of their creation time, and tables of different windows are never merged,
+// so old data is not rewritten again and again.
+//
+// Tables of the newest window are merged when there are at least MinimumFilesToCompact of them,
+// every older window is merged into one table.
+type TimeWindowStrategy struct {
+	Window                time.Duration // default is 1 hour
+	MinimumFilesToCompact int           // default is 2
+}
+
+// PickCompaction implements CompactionStrategy.
+func (s *TimeWindowStrategy) PickCompaction(tables []TableInfo) *Compaction {
+	window := s.Window
+	if window <= 0 {
+		window = defaultTimeWindow
+	}
+	minimumFiles := s.MinimumFilesToCompact
+	if minimumFiles < 2 {
+		minimumFiles = 2
+	}
+
+	// level 0 tables are at the beginning of the list, ordered from the newest to the oldest,
+	// so tables of one window are neighbours
+	level0 := 0
+	for level0 < len(tables) && tables[level0].Level == 0 {
+		level0++
+	}
+
+	// start from the oldest window
+	end := level0
+	for end > 0 {
+		windowStart := tables[end-1].CreatedAt.Truncate(window)
+		start := end - 1
+		for start > 0 && tables[start-1].CreatedAt.Truncate(window).Equal(windowStart) {
+			start--
+		}
+
+		isNewest := start == 0
+		count := end - start
+		if (isNewest && count >= minimumFiles) || (!isNewest && count >= 2) {
+			c := &Compaction{OutputLevel: 0}
+			for i := start; i < end; i++ {
+				c.Inputs = append(c.Inputs, i)
+			}
+			log.Printf("[DEBUG] Time window compaction: window=%v tables=%v", windowStart, count)
+			return c
+		}
+		end = start
+	}
+	return nil
+}
+
+// maxLevels is the number of levels of the leveled compaction.
+const maxLevels = 7
+
+// LeveledStrategy keeps flushed tables in level 0 and tables with non-overlapping key ranges in levels 1+.
+// Level 1 can hold LevelBaseSize bytes and every next level is LevelSizeRatio times bigger.
+//
+// It picks the level with the biggest score (how much the level exceeds its limit)
+// and merges its tables into the next level together with the overlapping tables of the next level.
+// All level 0 tables are compacted at once since their key ranges can overlap;
+// for other levels, it takes one table at a time, going around the key space.
+type LeveledStrategy struct {
+	Level0FilesToCompact int   // limit of level 0 tables, default is 4
+	LevelBaseSize        int64 // max size of level 1, default is 10MB
+	LevelSizeRatio       int   // default is 10
+	TargetFileSize       int64 // max size of new tables, default is 2MB
+
+	// the largest key of the last compacted table of every level:
+	// the next compaction of the level starts after it
+	compactPointers map[int]string
+}
+
+// PickCompaction implements CompactionStrategy.
+func (s *LeveledStrategy) PickCompaction(tables []TableInfo) *Compaction {
+	levels := make([][]int, maxLevels)
+	for i, t := range tables {
+		levels[t.Level] = append(levels[t.Level], i)
+	}
+
+	level := -1
+	bestScore := 1.0
+	// the last level can't be compacted: there is no next level
+	for i := 0; i < maxLevels-1; i++ {
+		score := s.score(i, tables, levels[i])
+		if score >= bestScore {
+			level, bestScore = i, score
+		}
+	}
+	if level < 0 {
+		return nil
+	}
+
+	targetFileSize := s.TargetFileSize
+	if targetFileSize == 0 {
+		targetFileSize = defaultTargetFileSize
+	}
+	c := &Compaction{OutputLevel: level + 1, MaxFileSize: targetFileSize}
+	if level == 0 {
+		c.Inputs = append(c.Inputs, levels[0]...)
+	} else {
+		c.Inputs = []int{s.pickTable(level, tables, levels[level])}
+	}
+
+	smallest, largest, ok := keyRange(tables, c.Inputs)
+	if ok {
+		for _, i := range levels[level+1] {
+			if tables[i].overlaps(smallest, largest) {
+				c.Inputs = append(c.Inputs, i)
+			}
+		}
+	}
+
+	log.Printf("[DEBUG] Leveled compaction: level=%v score=%.2f", level, bestScore)
+	return c
+}
+
+// Level0Limit implements Level0Limiter.
+func (s *LeveledStrategy) Level0Limit() int {
+	if s.Level0FilesToCompact <= 0 {
+		return defaultLevel0FilesToCompact
+	}
+	return s.Level0FilesToCompact
+}
+
+// score returns how much the level exceeds its limit, the level must be compacted if it's at least 1.
+// The limit of level 0 is the number of tables, other levels are limited by their size.
+func (s *LeveledStrategy) score(level int, tables []TableInfo, positions []int) float64 {
+	if level == 0 {
+		return float64(len(positions)) / float64(s.Level0Limit())
+	}
+
+	size := int64(0)
+	for _, i := range positions {
+		size += tables[i].Size
+	}
+	return float64(size) / float64(s.maxLevelSize(level))
+}
+
+// maxLevelSize returns the size limit of a level.
+func (s *LeveledStrategy) maxLevelSize(level int) int64 {
+	size := s.LevelBaseSize
+	if size == 0 {
+		size = defaultLevelBaseSize
+	}
+	ratio := s.LevelSizeRatio
+	if ratio == 0 {
+		ratio = defaultLevelSizeRatio
+	}
+	for i := 1; i < level; i++ {
+		size *= int64(ratio)
+	}
+	return size
+}
+
+// pickTable returns the first table of the level after the compaction pointer.
+func (s *LeveledStrategy) pickTable(level int, tables []TableInfo, positions []int) int {
+	sorted := append([]int{}, positions...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return tables[sorted[i]].Smallest < tables[sorted[j]].Smallest
+	})
+
+	if s.compactPointers == nil {
+		s.compactPointers = map[int]string{}
+	}
+
+	picked := sorted[0]
+	pointer, ok := s.compactPointers[level]
+	for _, i := range sorted {
+		if ok && tables[i].Smallest > pointer {
+			picked = i
+			break
+		}
+	}
+	s.compactPointers[level] = tables[picked].Largest
+	return picked
+}
+
+// overlaps returns true if the key range of the table intersects with [smallest, largest].
+func (t TableInfo) overlaps(smallest string, largest string) bool {
+	return !t.Empty && t.Smallest <= largest && t.Largest >= smallest
+}
+
+// keyRange returns the smallest and the largest keys of the tables at the given positions.
+// It returns false if all these tables are empty.
+func keyRange(tables []TableInfo, positions []int) (string, string, bool) {
+	smallest, largest := "", ""
+	found := false
+	for _, i := range positions {
+		t := tables[i]
+		if t.Empty {
+			continue
+		}
+		if !found || t.Smallest < smallest {
+			smallest = t.Smallest
+		}
+		if !found || t.Largest > largest {
+			largest = t.Largest
+		}
+		found = true
+	}
+	return smallest, largest, found
+}
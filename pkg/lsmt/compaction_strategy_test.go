@@ -0,0 +1,131 @@
+package lsmt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSizeTieredStrategy(t *testing.T) {
+	strategy := &SizeTieredStrategy{MinimumFilesToCompact: 2, MaxFileSize: 100}
+
+	// not enough small tables
+	tables := []TableInfo{{Size: 10}, {Size: 200}}
+	assert.Nil(t, strategy.PickCompaction(tables))
+
+	// two oldest neighbours
+	tables = []TableInfo{{Size: 10}, {Size: 10}, {Size: 10}}
+	assert.Equal(t, &Compaction{Inputs: []int{1, 2}}, strategy.PickCompaction(tables))
+
+	// a big table between small ones
+	tables = []TableInfo{{Size: 10}, {Size: 10}, {Size: 200}, {Size: 10}}
+	assert.Equal(t, &Compaction{Inputs: []int{0, 1}}, strategy.PickCompaction(tables))
+	tables = []TableInfo{{Size: 10}, {Size: 200}, {Size: 10}}
+	assert.Nil(t, strategy.PickCompaction(tables))
+
+	// tables of other levels are never compacted
+	tables = []TableInfo{{Size: 10}, {Size: 10, Level: 1}}
+	assert.Nil(t, strategy.PickCompaction(tables))
+}
+
+func TestTimeWindowStrategy(t *testing.T) {
+	strategy := &TimeWindowStrategy{Window: time.Hour, MinimumFilesToCompact: 3}
+	at := func(hours int, minutes int) time.Time {
+		return time.Unix(0, 0).Add(time.Duration(hours)*time.Hour + time.Duration(minutes)*time.Minute)
+	}
+
+	// the newest window doesn't have enough tables, older windows have one table
+	tables := []TableInfo{
+		{CreatedAt: at(3, 20)},
+		{CreatedAt: at(3, 10)},
+		{CreatedAt: at(2, 30)},
+		{CreatedAt: at(1, 30)},
+	}
+	assert.Nil(t, strategy.PickCompaction(tables))
+
+	// an old window is merged into one table, starting from the oldest one
+	tables = []TableInfo{
+		{CreatedAt: at(3, 20)},
+		{CreatedAt: at(3, 10)},
+		{CreatedAt: at(2, 30)},
+		{CreatedAt: at(2, 10)},
+		{CreatedAt: at(1, 30)},
+		{CreatedAt: at(1, 20)},
+		{CreatedAt: at(1, 10)},
+	}
+	assert.Equal(t, &Compaction{Inputs: []int{4, 5, 6}}, strategy.PickCompaction(tables))
+
+	// the newest window
+	tables = []TableInfo{
+		{CreatedAt: at(3, 30)},
+		{CreatedAt: at(3, 20)},
+		{CreatedAt: at(3, 10)},
+		{CreatedAt: at(2, 30)},
+		{CreatedAt: at(1, 30), Level: 1},
+		{CreatedAt: at(1, 20), Level: 1},
+	}
+	assert.Equal(t, &Compaction{Inputs: []int{0, 1, 2}}, strategy.PickCompaction(tables))
+}
+
+func TestLeveledStrategyLevel0(t *testing.T) {
+	strategy := &LeveledStrategy{Level0FilesToCompact: 2, TargetFileSize: 100}
+
+	tables := []TableInfo{
+		{Smallest: "c", Largest: "d"},
+		{Level: 1, Smallest: "a", Largest: "b"},
+	}
+	assert.Nil(t, strategy.PickCompaction(tables))
+
+	// all level 0 tables and overlapping level 1 tables
+	tables = []TableInfo{
+		{Smallest: "c", Largest: "d"},
+		{Smallest: "e", Largest: "f"},
+		{Level: 1, Smallest: "a", Largest: "b"},
+		{Level: 1, Smallest: "b", Largest: "c"},
+		{Level: 1, Smallest: "f", Largest: "g"},
+		{Level: 1, Smallest: "x", Largest: "y"},
+		{Level: 2, Smallest: "a", Largest: "z"},
+	}
+	expCompaction := &Compaction{Inputs: []int{0, 1, 3, 4}, OutputLevel: 1, MaxFileSize: 100}
+	assert.Equal(t, expCompaction, strategy.PickCompaction(tables))
+}
+
+func TestLeveledStrategyBySize(t *testing.T) {
+	// a level bigger than its limit is compacted into the next level one table at a time
+	strategy := &LeveledStrategy{LevelBaseSize: 10}
+
+	tables := []TableInfo{
+		{Level: 1, Smallest: "x", Largest: "y", Size: 10},
+		{Level: 1, Smallest: "a", Largest: "b", Size: 10},
+		{Level: 2, Smallest: "b", Largest: "c", Size: 10},
+		{Level: 2, Smallest: "m", Largest: "m", Size: 10},
+	}
+	c := strategy.PickCompaction(tables)
+	assert.NotNil(t, c)
+	assert.Equal(t, 2, c.OutputLevel)
+	assert.Equal(t, []int{1, 2}, c.Inputs)
+
+	// the next compaction of the level continues after the last compacted key
+	c = strategy.PickCompaction(tables)
+	assert.NotNil(t, c)
+	assert.Equal(t, []int{0}, c.Inputs)
+
+	// and starts from the beginning when it reaches the end of the level
+	c = strategy.PickCompaction(tables)
+	assert.NotNil(t, c)
+	assert.Equal(t, []int{1, 2}, c.Inputs)
+}
+
+func TestLeveledStrategyScore(t *testing.T) {
+	strategy := &LeveledStrategy{Level0FilesToCompact: 4, LevelBaseSize: 100, LevelSizeRatio: 10}
+
+	assert.Equal(t, int64(100), strategy.maxLevelSize(1))
+	assert.Equal(t, int64(1000), strategy.maxLevelSize(2))
+	assert.Equal(t, int64(10000), strategy.maxLevelSize(3))
+
+	tables := []TableInfo{{}, {}, {Level: 1, Size: 50}, {Level: 1, Size: 100}}
+	assert.Equal(t, 0.5, strategy.score(0, tables, []int{0, 1}))
+	assert.Equal(t, 1.5, strategy.score(1, tables, []int{2, 3}))
+	assert.Equal(t, 0.15, strategy.score(2, tables, []int{2, 3}))
+}
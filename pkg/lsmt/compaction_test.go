@@ -1,13 +1,63 @@
 package lsmt
 
 import (
+	"errors"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/entry"
 	"github.com/alexander-akhmetov/mdb/pkg/test_utils"
+	"github.com/alexander-akhmetov/mdb/pkg/utils"
 )
 
+// newTestCompactionConfig returns the default compaction configuration for the test directory.
+func newTestCompactionConfig() *StorageConfig {
+	return &StorageConfig{
+		MinimumFilesToCompact: 2,
+		MaxCompactFileSize:    defaultMaxCompactFileSize,
+		SSTableReadBufferSize: defaultReadBufferSize,
+		BloomFilterBitsPerKey: defaultBloomFilterBitsPerKey,
+		ssTablesDir:           ".test/lsmt_data/sstables/",
+		tmpDir:                ".test/lsmt_data/sstables/tmp/",
+	}
+}
+
+// loadTestSSTables returns tables from the test directory ordered the way the storage keeps them.
+func loadTestSSTables(t *testing.T) []*ssTable {
+	files, err := listSSTables(".test/lsmt_data/sstables/")
+	assert.Nil(t, err)
+
+	tables := []*ssTable{}
+	for _, f := range files {
+		table, err := newSSTable(&ssTableConfig{filename: f.Name})
+		assert.Nil(t, err)
+		tables = append(tables, table)
+	}
+	sortSSTables(tables)
+	return tables
+}
+
+// newTestManifest returns a new manifest in the test directory,
+// new files get numbers starting from 100.
+func newTestManifest(t *testing.T) *manifest {
+	m, err := newManifest(".test/lsmt_data/MANIFEST", map[string]tableMeta{}, 100)
+	assert.Nil(t, err)
+	t.Cleanup(func() { m.close() })
+	return m
+}
+
+// compactTestSSTables runs the size-tiered compaction of tables from the test directory.
+func compactTestSSTables(t *testing.T, config *StorageConfig) (*compactionTask, []string, error) {
+	config.CompactionStrategy = &SizeTieredStrategy{
+		MinimumFilesToCompact: config.MinimumFilesToCompact,
+		MaxFileSize:           config.MaxCompactFileSize,
+	}
+	return compact(config, newTestManifest(t), loadTestSSTables(t))
+}
+
 func TestCompactionWithoutFiles(t *testing.T) {
 	// test compact() with only one file
 	// it should not do anything
@@ -15,19 +65,13 @@ func TestCompactionWithoutFiles(t *testing.T) {
 	defer testutils.Teardown()
 
 	// since we have only one file - there is nothing to merge
-	testutils.CreateFile(".test/lsmt_data/sstables/0.sstable", "")
+	createSSTable(".test/lsmt_data/sstables/0.sstable", [][2]string{})
 
-	f, s, c, isMerged := compact(
-		".test/lsmt_data/sstables/",
-		".test/lsmt_data/sstables/tmp/",
-		2,
-		defaultMaxCompactFileSize,
-	)
+	task, results, err := compactTestSSTables(t, newTestCompactionConfig())
+	assert.Nil(t, err)
 
-	assert.False(t, isMerged)
-	assert.Equal(t, "", f)
-	assert.Equal(t, "", s)
-	assert.Equal(t, "", c)
+	assert.Nil(t, task)
+	assert.Empty(t, results)
 }
 
 func TestSimpleCompaction(t *testing.T) {
@@ -36,38 +80,35 @@ func TestSimpleCompaction(t *testing.T) {
 	testutils.SetUp()
 	defer testutils.Teardown()
 
-	testutils.CreateFileWithKeyValues(
+	createSSTable(
 		".test/lsmt_data/sstables/0.sstable",
 		[][2]string{
 			{"k1", "v1"},
 			{"k2", "v2"},
 		},
 	)
-	testutils.CreateFileWithKeyValues(
+	createSSTable(
 		".test/lsmt_data/sstables/1.sstable",
 		[][2]string{
 			{"k1", "v11"},
 		},
 	)
-	testutils.CreateFileWithKeyValues(".test/lsmt_data/sstables/2.sstable", [][2]string{})
+	createSSTable(".test/lsmt_data/sstables/2.sstable", [][2]string{})
 
-	f, s, c, isMerged := compact(
-		".test/lsmt_data/sstables/",
-		".test/lsmt_data/sstables/tmp/",
-		2,
-		defaultMaxCompactFileSize,
-	)
+	task, results, err := compactTestSSTables(t, newTestCompactionConfig())
+	assert.Nil(t, err)
 
-	assert.True(t, isMerged)
-	assert.Equal(t, ".test/lsmt_data/sstables/0.sstable", f)
-	assert.Equal(t, ".test/lsmt_data/sstables/1.sstable", s)
-	assert.Equal(t, ".test/lsmt_data/sstables/tmp/1.sstable", c)
+	assert.NotNil(t, task)
+	assert.Equal(t, 2, len(task.inputs))
+	assert.Equal(t, ".test/lsmt_data/sstables/1.sstable", task.inputs[0].config.filename)
+	assert.Equal(t, ".test/lsmt_data/sstables/0.sstable", task.inputs[1].config.filename)
+	assert.Equal(t, []string{".test/lsmt_data/sstables/tmp/100.sstable"}, results)
 
 	expData := [][2]string{
 		{"k1", "v11"},
 		{"k2", "v2"},
 	}
-	testutils.AssertKeysInFile(t, ".test/lsmt_data/sstables/tmp/1.sstable", expData)
+	assertKeysInSSTable(t, ".test/lsmt_data/sstables/tmp/100.sstable", expData)
 }
 
 func TestSimpleCompactionWithSameKeys(t *testing.T) {
@@ -76,14 +117,14 @@ func TestSimpleCompactionWithSameKeys(t *testing.T) {
 	testutils.SetUp()
 	defer testutils.Teardown()
 
-	testutils.CreateFileWithKeyValues(
+	createSSTable(
 		".test/lsmt_data/sstables/0.sstable",
 		[][2]string{
 			{"k1", "01"},
 			{"k2", "02"},
 		},
 	)
-	testutils.CreateFileWithKeyValues(
+	createSSTable(
 		".test/lsmt_data/sstables/1.sstable",
 		[][2]string{
 			{"k1", "11"},
@@ -91,23 +132,20 @@ func TestSimpleCompactionWithSameKeys(t *testing.T) {
 		},
 	)
 
-	f, s, c, isMerged := compact(
-		".test/lsmt_data/sstables/",
-		".test/lsmt_data/sstables/tmp/",
-		2,
-		defaultMaxCompactFileSize,
-	)
+	task, results, err := compactTestSSTables(t, newTestCompactionConfig())
+	assert.Nil(t, err)
 
-	assert.True(t, isMerged)
-	assert.Equal(t, ".test/lsmt_data/sstables/0.sstable", f)
-	assert.Equal(t, ".test/lsmt_data/sstables/1.sstable", s)
-	assert.Equal(t, ".test/lsmt_data/sstables/tmp/1.sstable", c)
+	assert.NotNil(t, task)
+	assert.Equal(t, 2, len(task.inputs))
+	assert.Equal(t, ".test/lsmt_data/sstables/1.sstable", task.inputs[0].config.filename)
+	assert.Equal(t, ".test/lsmt_data/sstables/0.sstable", task.inputs[1].config.filename)
+	assert.Equal(t, []string{".test/lsmt_data/sstables/tmp/100.sstable"}, results)
 
 	expData := [][2]string{
 		{"k1", "11"},
 		{"k2", "22"},
 	}
-	testutils.AssertKeysInFile(t, ".test/lsmt_data/sstables/tmp/1.sstable", expData)
+	assertKeysInSSTable(t, ".test/lsmt_data/sstables/tmp/100.sstable", expData)
 }
 
 func TestComplexCompaction(t *testing.T) {
@@ -116,16 +154,15 @@ func TestComplexCompaction(t *testing.T) {
 	testutils.SetUp()
 	defer testutils.Teardown()
 
-	testutils.CreateFileWithKeyValues(
+	createSSTable(
 		".test/lsmt_data/sstables/0.sstable",
 		[][2]string{
 			{"k1", "1"},
 			{"k2", "2"},
 			{"k3", "3"},
-			{"k3", "33"},
 		},
 	)
-	testutils.CreateFileWithKeyValues(
+	createSSTable(
 		".test/lsmt_data/sstables/1.sstable",
 		[][2]string{
 			{"k1", "11"},
@@ -134,9 +171,10 @@ func TestComplexCompaction(t *testing.T) {
 			{"k6", "6"},
 		},
 	)
-	testutils.CreateFileWithKeyValues(".test/lsmt_data/sstables/2.sstable", [][2]string{})
+	createSSTable(".test/lsmt_data/sstables/2.sstable", [][2]string{})
 
-	compact(".test/lsmt_data/sstables/", ".test/lsmt_data/sstables/tmp/", 2, defaultMaxCompactFileSize)
+	_, _, err := compactTestSSTables(t, newTestCompactionConfig())
+	assert.Nil(t, err)
 
 	expData := [][2]string{
 		{"k1", "11"},
@@ -145,7 +183,7 @@ func TestComplexCompaction(t *testing.T) {
 		{"k5", "5"},
 		{"k6", "6"},
 	}
-	testutils.AssertKeysInFile(t, ".test/lsmt_data/sstables/tmp/1.sstable", expData)
+	assertKeysInSSTable(t, ".test/lsmt_data/sstables/tmp/100.sstable", expData)
 }
 
 func TestCompactionWithOneEmptyFile(t *testing.T) {
@@ -153,7 +191,7 @@ func TestCompactionWithOneEmptyFile(t *testing.T) {
 	testutils.SetUp()
 	defer testutils.Teardown()
 
-	testutils.CreateFileWithKeyValues(".test/lsmt_data/sstables/0.sstable", [][2]string{})
+	createSSTable(".test/lsmt_data/sstables/0.sstable", [][2]string{})
 	assert.True(t, testutils.IsFileExists(".test/lsmt_data/sstables/0.sstable"))
 
 	secondFileKeys := [][2]string{
@@ -162,15 +200,16 @@ func TestCompactionWithOneEmptyFile(t *testing.T) {
 		{"k5", "5"},
 		{"k6", "6"},
 	}
-	testutils.CreateFileWithKeyValues(".test/lsmt_data/sstables/1.sstable", secondFileKeys)
-	testutils.CreateFileWithKeyValues(".test/lsmt_data/sstables/2.sstable", [][2]string{})
+	createSSTable(".test/lsmt_data/sstables/1.sstable", secondFileKeys)
+	createSSTable(".test/lsmt_data/sstables/2.sstable", [][2]string{})
 	assert.True(t, testutils.IsFileExists(".test/lsmt_data/sstables/2.sstable"))
 
-	compact(".test/lsmt_data/sstables/", ".test/lsmt_data/sstables/tmp/", 2, defaultMaxCompactFileSize)
+	_, _, err := compactTestSSTables(t, newTestCompactionConfig())
+	assert.Nil(t, err)
 
-	testutils.AssertKeysInFile(t, ".test/lsmt_data/sstables/tmp/0.sstable", [][2]string{})
-	testutils.AssertKeysInFile(t, ".test/lsmt_data/sstables/tmp/1.sstable", secondFileKeys)
-	testutils.AssertKeysInFile(t, ".test/lsmt_data/sstables/tmp/2.sstable", [][2]string{})
+	assert.False(t, testutils.IsFileExists(".test/lsmt_data/sstables/tmp/0.sstable"))
+	assertKeysInSSTable(t, ".test/lsmt_data/sstables/tmp/100.sstable", secondFileKeys)
+	assert.False(t, testutils.IsFileExists(".test/lsmt_data/sstables/tmp/2.sstable"))
 }
 
 func TestCompactionWithEmptySecondFile(t *testing.T) {
@@ -181,13 +220,14 @@ func TestCompactionWithEmptySecondFile(t *testing.T) {
 		{"k1", "1"},
 		{"k3", "3"},
 	}
-	testutils.CreateFileWithKeyValues(".test/lsmt_data/sstables/0.sstable", firstFileKeys)
-	testutils.CreateFileWithKeyValues(".test/lsmt_data/sstables/1.sstable", [][2]string{})
-	testutils.CreateFileWithKeyValues(".test/lsmt_data/sstables/2.sstable", [][2]string{})
+	createSSTable(".test/lsmt_data/sstables/0.sstable", firstFileKeys)
+	createSSTable(".test/lsmt_data/sstables/1.sstable", [][2]string{})
+	createSSTable(".test/lsmt_data/sstables/2.sstable", [][2]string{})
 
-	compact(".test/lsmt_data/sstables/", ".test/lsmt_data/sstables/tmp/", 2, defaultMaxCompactFileSize)
+	_, _, err := compactTestSSTables(t, newTestCompactionConfig())
+	assert.Nil(t, err)
 
-	testutils.AssertKeysInFile(t, ".test/lsmt_data/sstables/tmp/1.sstable", firstFileKeys)
+	assertKeysInSSTable(t, ".test/lsmt_data/sstables/tmp/100.sstable", firstFileKeys)
 }
 
 func TestCompactionWithEmptyFiles(t *testing.T) {
@@ -195,11 +235,342 @@ func TestCompactionWithEmptyFiles(t *testing.T) {
 	testutils.SetUp()
 	defer testutils.Teardown()
 
-	testutils.CreateFileWithKeyValues(".test/lsmt_data/sstables/0.sstable", [][2]string{})
-	testutils.CreateFileWithKeyValues(".test/lsmt_data/sstables/1.sstable", [][2]string{})
-	testutils.CreateFileWithKeyValues(".test/lsmt_data/sstables/2.sstable", [][2]string{})
+	createSSTable(".test/lsmt_data/sstables/0.sstable", [][2]string{})
+	createSSTable(".test/lsmt_data/sstables/1.sstable", [][2]string{})
+	createSSTable(".test/lsmt_data/sstables/2.sstable", [][2]string{})
+
+	_, _, err := compactTestSSTables(t, newTestCompactionConfig())
+	assert.Nil(t, err)
+
+	assertKeysInSSTable(t, ".test/lsmt_data/sstables/tmp/100.sstable", [][2]string{})
+}
+
+func TestCompactionDropsTombstonesInOldestFiles(t *testing.T) {
+	// there are no older files, so tombstones must be removed
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	createSSTable(
+		".test/lsmt_data/sstables/0.sstable",
+		[][2]string{
+			{"k1", "1"},
+			{"k2", "2"},
+		},
+	)
+	createSSTableWithEntries(".test/lsmt_data/sstables/1.sstable", []*entry.DBEntry{
+		{Type: entry.TypeTombstone, Key: "k1"},
+	})
+
+	_, _, err := compactTestSSTables(t, newTestCompactionConfig())
+	assert.Nil(t, err)
+
+	assertKeysInSSTable(t, ".test/lsmt_data/sstables/tmp/100.sstable", [][2]string{{"k2", "2"}})
+}
+
+func TestCompactionKeepsTombstonesIfOlderFilesExist(t *testing.T) {
+	// the oldest file is too big to be compacted, so it can still hold
+	// the deleted key: the tombstone must be kept
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	createSSTable(
+		".test/lsmt_data/sstables/0.sstable",
+		[][2]string{
+			{"k1", "a very long value which makes this file too big for compaction"},
+		},
+	)
+	createSSTable(".test/lsmt_data/sstables/1.sstable", [][2]string{{"k2", "2"}})
+	createSSTableWithEntries(".test/lsmt_data/sstables/2.sstable", []*entry.DBEntry{
+		{Type: entry.TypeTombstone, Key: "k1"},
+	})
+
+	// only files smaller than the oldest one can be compacted
+	maxSize, err := utils.GetFileSize(".test/lsmt_data/sstables/0.sstable")
+	assert.Nil(t, err)
+
+	config := newTestCompactionConfig()
+	config.MaxCompactFileSize = maxSize
+	task, results, err := compactTestSSTables(t, config)
+	assert.Nil(t, err)
+	assert.NotNil(t, task)
+	c := results[0]
+
+	expEntries := []*entry.DBEntry{
+		{Type: entry.TypeTombstone, Key: "k1"},
+		{Type: entry.TypeValue, Key: "k2", Value: "2"},
+	}
+	assert.Equal(t, expEntries, readSSTable(t, c))
+}
+
+func TestCompactionBuildsBloomFilter(t *testing.T) {
+	// the merged file must have a bloom filter with keys from both files
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	createSSTable(".test/lsmt_data/sstables/0.sstable", [][2]string{{"k1", "1"}})
+	createSSTable(".test/lsmt_data/sstables/1.sstable", [][2]string{{"k2", "2"}})
+
+	task, results, err := compactTestSSTables(t, newTestCompactionConfig())
+	assert.Nil(t, err)
+	assert.NotNil(t, task)
+	c := results[0]
+
+	table, err := newSSTable(&ssTableConfig{filename: c})
+	assert.Nil(t, err)
+	assert.True(t, table.filter.MayContain("k1"))
+	assert.True(t, table.filter.MayContain("k2"))
+}
+
+func TestParanoidCompaction(t *testing.T) {
+	// the result of the compaction must be verified
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	createSSTable(".test/lsmt_data/sstables/0.sstable", [][2]string{{"k1", "1"}, {"k2", "2"}})
+	createSSTable(".test/lsmt_data/sstables/1.sstable", [][2]string{{"k2", "22"}, {"k3", "3"}})
+
+	config := newTestCompactionConfig()
+	config.ParanoidChecks = true
+	task, results, err := compactTestSSTables(t, config)
+	assert.Nil(t, err)
+	assert.NotNil(t, task)
+	c := results[0]
+
+	assert.Nil(t, verifySSTable(c, 3))
+	err = verifySSTable(c, 4)
+	assert.True(t, errors.Is(err, utils.ErrCorrupted))
+}
+
+func TestCompactionWithCorruptedFile(t *testing.T) {
+	// compaction must stop if one of the files is corrupted
+	testutils.SetUp()
+	defer testutils.Teardown()
 
-	compact(".test/lsmt_data/sstables/", ".test/lsmt_data/sstables/tmp/", 2, defaultMaxCompactFileSize)
+	createSSTable(".test/lsmt_data/sstables/0.sstable", [][2]string{{"k1", "1"}, {"k2", "2"}})
+	createSSTable(".test/lsmt_data/sstables/1.sstable", [][2]string{{"k2", "22"}, {"k3", "3"}})
 
-	testutils.AssertKeysInFile(t, ".test/lsmt_data/sstables/tmp/2.sstable", [][2]string{})
+	// flip a bit in the first data block
+	data := testutils.ReadFileBinary(".test/lsmt_data/sstables/0.sstable")
+	data[entry.HeaderSize] ^= 1
+	testutils.CreateFile(".test/lsmt_data/sstables/0.sstable", string(data))
+
+	task, _, err := compactTestSSTables(t, newTestCompactionConfig())
+	assert.Nil(t, task)
+
+	var corruptionErr *utils.CorruptionError
+	assert.True(t, errors.As(err, &corruptionErr))
+	assert.Equal(t, ".test/lsmt_data/sstables/0.sstable", corruptionErr.Filename)
+	assert.Equal(t, int64(0), corruptionErr.Offset)
+}
+
+// newTestLeveledCompactionConfig returns the leveled compaction configuration for the test directory.
+func newTestLeveledCompactionConfig() *StorageConfig {
+	config := newTestCompactionConfig()
+	config.CompactionStrategy = &LeveledStrategy{Level0FilesToCompact: 2}
+	return config
+}
+
+// inputFilenames returns filenames of the tables merged by the task.
+func inputFilenames(task *compactionTask) []string {
+	filenames := []string{}
+	for _, table := range task.inputs {
+		filenames = append(filenames, table.config.filename)
+	}
+	return filenames
+}
+
+func TestLeveledCompactionNothingToCompact(t *testing.T) {
+	// one level 0 table and a small level 1 don't need compaction
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	createSSTable(".test/lsmt_data/sstables/2.sstable", [][2]string{{"k1", "1"}})
+	createLevelSSTable(".test/lsmt_data/sstables/1.sstable", 1, [][2]string{{"k2", "2"}})
+
+	task, results, err := compact(newTestLeveledCompactionConfig(), newTestManifest(t), loadTestSSTables(t))
+	assert.Nil(t, err)
+	assert.Nil(t, task)
+	assert.Empty(t, results)
+}
+
+func TestLeveledCompactionLevel0(t *testing.T) {
+	// all level 0 tables are merged with overlapping level 1 tables into level 1
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	createLevelSSTable(".test/lsmt_data/sstables/1.sstable", 1, [][2]string{{"a", "1"}, {"b", "1"}})
+	createLevelSSTable(".test/lsmt_data/sstables/2.sstable", 1, [][2]string{{"x", "2"}, {"y", "2"}})
+	createSSTable(".test/lsmt_data/sstables/3.sstable", [][2]string{{"b", "3"}, {"c", "3"}})
+	createSSTableWithEntries(".test/lsmt_data/sstables/4.sstable", []*entry.DBEntry{
+		{Type: entry.TypeValue, Key: "c", Value: "4"},
+		{Type: entry.TypeTombstone, Key: "d"},
+	})
+
+	task, results, err := compact(newTestLeveledCompactionConfig(), newTestManifest(t), loadTestSSTables(t))
+	assert.Nil(t, err)
+	assert.NotNil(t, task)
+
+	expInputs := []string{
+		".test/lsmt_data/sstables/4.sstable",
+		".test/lsmt_data/sstables/3.sstable",
+		".test/lsmt_data/sstables/1.sstable",
+	}
+	assert.Equal(t, expInputs, inputFilenames(task))
+	assert.Equal(t, 1, task.level)
+	assert.True(t, task.dropTombstones)
+
+	assert.Equal(t, 1, len(results))
+	assertKeysInSSTable(t, results[0], [][2]string{{"a", "1"}, {"b", "3"}, {"c", "4"}})
+
+	table, err := newSSTable(&ssTableConfig{filename: results[0]})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, table.level)
+	assert.Equal(t, "a", table.smallest)
+	assert.Equal(t, "c", table.largest)
+}
+
+func TestLeveledCompactionKeepsTombstones(t *testing.T) {
+	// a deeper level can hold the deleted key: the tombstone must be kept
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	createLevelSSTable(".test/lsmt_data/sstables/1.sstable", 2, [][2]string{{"k1", "1"}})
+	createSSTable(".test/lsmt_data/sstables/2.sstable", [][2]string{{"k2", "2"}})
+	createSSTableWithEntries(".test/lsmt_data/sstables/3.sstable", []*entry.DBEntry{
+		{Type: entry.TypeTombstone, Key: "k1"},
+	})
+
+	task, results, err := compact(newTestLeveledCompactionConfig(), newTestManifest(t), loadTestSSTables(t))
+	assert.Nil(t, err)
+	assert.NotNil(t, task)
+	assert.False(t, task.dropTombstones)
+
+	expEntries := []*entry.DBEntry{
+		{Type: entry.TypeTombstone, Key: "k1"},
+		{Type: entry.TypeValue, Key: "k2", Value: "2"},
+	}
+	assert.Equal(t, expEntries, readSSTable(t, results[0]))
+}
+
+func TestLeveledCompactionSplitsResult(t *testing.T) {
+	// the result must be split into tables of the target size
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	first := [][2]string{}
+	second := [][2]string{}
+	for i := 0; i < 100; i++ {
+		first = append(first, [2]string{fmt.Sprintf("k%03d", 2*i), "value"})
+		second = append(second, [2]string{fmt.Sprintf("k%03d", 2*i+1), "value"})
+	}
+	createSSTable(".test/lsmt_data/sstables/1.sstable", first)
+	createSSTable(".test/lsmt_data/sstables/2.sstable", second)
+
+	config := newTestCompactionConfig()
+	config.CompactionStrategy = &LeveledStrategy{Level0FilesToCompact: 2, TargetFileSize: 1024}
+	config.ParanoidChecks = true
+	task, results, err := compact(config, newTestManifest(t), loadTestSSTables(t))
+	assert.Nil(t, err)
+	assert.NotNil(t, task)
+	assert.True(t, len(results) > 1)
+
+	count := 0
+	lastKey := ""
+	for _, filename := range results {
+		table, err := newSSTable(&ssTableConfig{filename: filename})
+		assert.Nil(t, err)
+		assert.Equal(t, 1, table.level)
+		// key ranges of the tables don't overlap
+		assert.True(t, table.smallest > lastKey)
+		lastKey = table.largest
+		count += len(readSSTable(t, filename))
+	}
+	assert.Equal(t, 200, count)
+}
+
+// testStrategy returns the given compaction.
+type testStrategy struct {
+	compaction *Compaction
+}
+
+func (s *testStrategy) PickCompaction(tables []TableInfo) *Compaction {
+	return s.compaction
+}
+
+func TestCompactionWrongStrategyResult(t *testing.T) {
+	// a compaction which can break the order of tables must be rejected
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	createSSTable(".test/lsmt_data/sstables/1.sstable", [][2]string{{"k1", "1"}})
+	createSSTable(".test/lsmt_data/sstables/2.sstable", [][2]string{{"k1", "2"}})
+	createSSTable(".test/lsmt_data/sstables/3.sstable", [][2]string{{"k1", "3"}})
+	createLevelSSTable(".test/lsmt_data/sstables/4.sstable", 1, [][2]string{{"k1", "4"}})
+	createLevelSSTable(".test/lsmt_data/sstables/5.sstable", 2, [][2]string{{"k1", "5"}})
+
+	compactions := []*Compaction{
+		{},
+		{Inputs: []int{0, 5}},
+		{Inputs: []int{0, 0}},
+		{Inputs: []int{0, 1}, OutputLevel: maxLevels},
+		// not neighbours
+		{Inputs: []int{0, 2}, OutputLevel: 0},
+		// level 1 table can't be merged into level 0
+		{Inputs: []int{2, 3}, OutputLevel: 0},
+		// level 2 table can't be moved to level 1
+		{Inputs: []int{4}, OutputLevel: 1},
+		// the oldest level 0 table would hide the result
+		{Inputs: []int{0, 1, 3}, OutputLevel: 1},
+		// the level 2 table would hide the result
+		{Inputs: []int{3}, OutputLevel: 3},
+		// the result would overlap the level 1 table
+		{Inputs: []int{0, 1, 2}, OutputLevel: 1},
+	}
+	for _, c := range compactions {
+		config := newTestCompactionConfig()
+		config.CompactionStrategy = &testStrategy{compaction: c}
+		task, _, err := compact(config, newTestManifest(t), loadTestSSTables(t))
+		assert.Nil(t, task)
+		assert.NotNil(t, err)
+	}
+}
+
+func TestTimeWindowCompaction(t *testing.T) {
+	// tables of one time window are merged together, windows are never mixed
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	createWindowSSTable := func(filename string, createdAt time.Time, keyValues [][2]string) {
+		entries := []*entry.DBEntry{}
+		for _, kv := range keyValues {
+			entries = append(entries, &entry.DBEntry{Type: entry.TypeValue, Key: kv[0], Value: kv[1]})
+		}
+		config := ssTableWriterConfig{blockSize: defaultReadBufferSize, createdAt: createdAt}
+		createSSTableWithConfig(filename, config, entries)
+	}
+
+	start := time.Now().Truncate(time.Hour)
+	createWindowSSTable(".test/lsmt_data/sstables/1.sstable", start.Add(-50*time.Minute), [][2]string{{"k1", "1"}, {"k2", "1"}})
+	createWindowSSTable(".test/lsmt_data/sstables/2.sstable", start.Add(-40*time.Minute), [][2]string{{"k1", "2"}})
+	createWindowSSTable(".test/lsmt_data/sstables/3.sstable", start.Add(10*time.Minute), [][2]string{{"k3", "3"}})
+
+	config := newTestCompactionConfig()
+	config.CompactionStrategy = &TimeWindowStrategy{Window: time.Hour}
+	task, results, err := compact(config, newTestManifest(t), loadTestSSTables(t))
+	assert.Nil(t, err)
+	assert.NotNil(t, task)
+
+	expInputs := []string{
+		".test/lsmt_data/sstables/2.sstable",
+		".test/lsmt_data/sstables/1.sstable",
+	}
+	assert.Equal(t, expInputs, inputFilenames(task))
+	assert.True(t, task.dropTombstones)
+	assert.Equal(t, []string{".test/lsmt_data/sstables/tmp/100.sstable"}, results)
+	assertKeysInSSTable(t, results[0], [][2]string{{"k1", "2"}, {"k2", "1"}})
+
+	// the result keeps the time of the newest merged table
+	table, err := newSSTable(&ssTableConfig{filename: results[0]})
+	assert.Nil(t, err)
+	assert.Equal(t, start.Add(-40*time.Minute).UnixNano(), table.createdAt.UnixNano())
 }
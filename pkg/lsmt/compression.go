@@ -0,0 +1,117 @@
+package lsmt
+
+import (
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io/ioutil"
+	"sync"
+)
+
+// Compression defines how SSTable blocks are compressed.
+// The compression of every block is saved in the file,
+// so tables written with different settings can be read together.
+type Compression byte
+
+const (
+	// NoCompression stores blocks as is.
+	NoCompression Compression = iota
+	// DeflateCompression compresses blocks with DEFLATE from the standard library.
+	DeflateCompression
+)
+
+// blockCodec compresses and decompresses SSTable blocks.
+type blockCodec interface {
+	compress(data []byte) ([]byte, error)
+	decompress(data []byte) ([]byte, error)
+}
+
+// codecs holds all supported compressions except NoCompression.
+// A new codec needs a new Compression value and an entry here.
+var codecs = map[Compression]blockCodec{
+	DeflateCompression: &deflateCodec{},
+}
+
+// String returns the name of the compression.
+func (c Compression) String() string {
+	switch c {
+	case NoCompression:
+		return "none"
+	case DeflateCompression:
+		return "deflate"
+	}
+	return fmt.Sprintf("unknown(%d)", byte(c))
+}
+
+// isSupported returns true if blocks can be written and read with the compression.
+func (c Compression) isSupported() bool {
+	_, found := codecs[c]
+	return c == NoCompression || found
+}
+
+// compressBlock returns the compressed block and the compression which has been used.
+// The block is stored as is if the compression saves less than 1/8 of its size:
+// such blocks are not worth the time of decompression.
+func compressBlock(data []byte, c Compression) ([]byte, Compression, error) {
+	codec, found := codecs[c]
+	if !found || len(data) == 0 {
+		return data, NoCompression, nil
+	}
+
+	compressed, err := codec.compress(data)
+	if err != nil {
+		return nil, NoCompression, err
+	}
+	if len(compressed) > len(data)-len(data)/8 {
+		return data, NoCompression, nil
+	}
+	return compressed, c, nil
+}
+
+// decompressBlock returns the original data of the block.
+func decompressBlock(data []byte, c Compression) ([]byte, error) {
+	if c == NoCompression {
+		return data, nil
+	}
+	codec, found := codecs[c]
+	if !found {
+		return nil, fmt.Errorf("unsupported compression=%v", c)
+	}
+	return codec.decompress(data)
+}
+
+// deflateCodec reuses DEFLATE writers: every writer allocates a lot of memory for its state.
+type deflateCodec struct {
+	writers sync.Pool
+}
+
+func (d *deflateCodec) compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, ok := d.writers.Get().(*flate.Writer)
+	if ok {
+		w.Reset(&buf)
+	} else {
+		var err error
+		w, err = flate.NewWriter(&buf, flate.DefaultCompression)
+		if err != nil {
+			return nil, err
+		}
+	}
+	defer d.writers.Put(w)
+
+	_, err := w.Write(data)
+	if err != nil {
+		return nil, err
+	}
+	err = w.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (d *deflateCodec) decompress(data []byte) ([]byte, error) {
+	r := flate.NewReader(bytes.NewReader(data))
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
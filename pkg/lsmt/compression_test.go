@@ -0,0 +1,182 @@
+package lsmt
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/entry"
+	"github.com/alexander-akhmetov/mdb/pkg/test_utils"
+	"github.com/alexander-akhmetov/mdb/pkg/utils"
+)
+
+// jsonValue returns a value which compresses well, like real JSON documents.
+func jsonValue(i int) string {
+	return fmt.Sprintf(`{"id": %d, "name": "user-%d", "tags": ["a", "b", "c"], "description": "%s"}`, i, i, strings.Repeat("x", 100))
+}
+
+func TestCompressBlock(t *testing.T) {
+	data := []byte(strings.Repeat(jsonValue(1), 10))
+
+	compressed, compression, err := compressBlock(data, DeflateCompression)
+	assert.Nil(t, err)
+	assert.Equal(t, DeflateCompression, compression)
+	assert.True(t, len(compressed) < len(data)/5)
+
+	decompressed, err := decompressBlock(compressed, compression)
+	assert.Nil(t, err)
+	assert.Equal(t, data, decompressed)
+
+	// random data doesn't compress, so it's stored as is
+	random := make([]byte, 1024)
+	rand.Read(random)
+	compressed, compression, err = compressBlock(random, DeflateCompression)
+	assert.Nil(t, err)
+	assert.Equal(t, NoCompression, compression)
+	assert.Equal(t, random, compressed)
+
+	_, err = decompressBlock(data, Compression(100))
+	assert.NotNil(t, err)
+}
+
+func TestSSTableCompression(t *testing.T) {
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	entries := []*entry.DBEntry{}
+	for i := 0; i < 100; i++ {
+		entries = append(entries, &entry.DBEntry{Key: fmt.Sprintf("key-%03d", i), Value: jsonValue(i)})
+	}
+
+	sizes := map[Compression]int64{}
+	for _, compression := range []Compression{NoCompression, DeflateCompression} {
+		filePath := fmt.Sprintf(".test/sstables-test/%v.sstable", compression)
+		createSSTableWithConfig(filePath, ssTableWriterConfig{blockSize: 1024, compression: compression}, entries)
+
+		table, err := newSSTable(&ssTableConfig{filename: filePath})
+		assert.Nil(t, err)
+		sizes[compression] = table.size
+
+		for _, expected := range entries {
+			e, found, err := table.Get(expected.Key)
+			assert.Nil(t, err)
+			assert.True(t, found)
+			assert.Equal(t, expected.Value, e.Value)
+		}
+
+		it, err := newSSTableIterator(table, "", "")
+		assert.Nil(t, err)
+		count := 0
+		for it.Next() {
+			count++
+		}
+		assert.Nil(t, it.Err())
+		it.Close()
+		assert.Equal(t, len(entries), count)
+	}
+	assert.True(t, sizes[DeflateCompression] < sizes[NoCompression]/3)
+
+	_, err := newSSTableWriter(".test/sstables-test/wrong.sstable", ssTableWriterConfig{compression: Compression(100)})
+	assert.NotNil(t, err)
+}
+
+// createSSTableV1 writes a table in the format version 1: blocks are not compressed
+// and have only the checksum after them.
+func createSSTableV1(filename string, keyValues [][2]string) {
+	os.MkdirAll(filepath.Dir(filename), os.ModePerm)
+
+	file := []byte{}
+	writeBlock := func(data []byte) blockHandle {
+		h := blockHandle{offset: uint64(len(file)), size: uint64(len(data))}
+		crc := make([]byte, checksumSize)
+		binary.BigEndian.PutUint32(crc, checksum(data))
+		file = append(file, data...)
+		file = append(file, crc...)
+		return h
+	}
+
+	index := []byte{}
+	for _, kv := range keyValues {
+		h := writeBlock((&entry.DBEntry{Key: kv[0], Value: kv[1]}).Binary())
+		index = append(index, (&entry.DBEntry{Key: kv[0], Value: string(h.Binary())}).Binary()...)
+	}
+	f := &footer{version: ssTableFormatVersionV1}
+	f.meta = writeBlock((&entry.DBEntry{Key: metaLevelKey, Value: "0"}).Binary())
+	f.index = writeBlock(index)
+	file = append(file, f.Binary()...)
+
+	testutils.CreateFile(filename, string(file))
+}
+
+func TestStorageMixedCompression(t *testing.T) {
+	// tables of the old format, and tables with and without compression are read together
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	createSSTableV1(".test/lsmt_data/sstables/0.sstable", [][2]string{{"k1", "v1"}, {"k2", "v2"}})
+	createSSTableWithConfig(
+		".test/lsmt_data/sstables/1.sstable",
+		ssTableWriterConfig{compression: DeflateCompression},
+		[]*entry.DBEntry{{Key: "k3", Value: jsonValue(3)}},
+	)
+
+	storage := &Storage{
+		Config: StorageConfig{
+			WorkDir:         ".test/lsmt_data/",
+			MaxMemtableSize: 100,
+			Compression:     NoCompression,
+		},
+	}
+	assert.Nil(t, storage.Start())
+	assert.Nil(t, storage.Set("k4", jsonValue(4)))
+	assert.Nil(t, storage.Set("k5", "v5"))
+	assert.Nil(t, storage.Stop())
+
+	// the next tables are compressed
+	storage.Config.Compression = DeflateCompression
+	storage.Config.FlushOnStop = true
+	assert.Nil(t, storage.Start())
+	defer storage.Stop()
+	assert.Nil(t, storage.Set("k6", jsonValue(6)))
+	assert.Nil(t, storage.Set("k7", "v7"))
+	assert.Nil(t, storage.Set("k8", "v8"))
+
+	expected := map[string]string{
+		"k1": "v1", "k2": "v2", "k3": jsonValue(3), "k4": jsonValue(4),
+		"k5": "v5", "k6": jsonValue(6), "k7": "v7", "k8": "v8",
+	}
+	check := func() {
+		for key, expectedValue := range expected {
+			value, exists, err := storage.Get(key)
+			assert.Nil(t, err)
+			assert.True(t, exists, key)
+			assert.Equal(t, expectedValue, value)
+		}
+	}
+	check()
+
+	// the compaction merges tables of all formats into a compressed one
+	task, err := storage.compactOnce()
+	assert.Nil(t, err)
+	assert.NotNil(t, task)
+	check()
+}
+
+func TestStorageUnsupportedCompression(t *testing.T) {
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	storage := &Storage{
+		Config: StorageConfig{WorkDir: ".test/lsmt_data/", Compression: Compression(100)},
+	}
+	assert.NotNil(t, storage.Start())
+	assert.False(t, testutils.IsFileExists(".test/lsmt_data/mdb.pid"))
+	_, _, err := storage.Get("k")
+	assert.Equal(t, utils.ErrClosed, err)
+}
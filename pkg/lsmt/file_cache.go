@@ -0,0 +1,158 @@
+package lsmt
+
+import (
+	"container/list"
+	"fmt"
+	"log"
+	"os"
+	"sync"
+	"sync/atomic"
+
+	"github.com/alexander-akhmetov/mdb/pkg/utils"
+)
+
+const defaultMaxOpenFiles = 500
+
+// tableFile is an open or a memory-mapped SSTable file. Many readers can use it at the same time:
+// all reads are positional (ReadAt), so they don't share the file offset.
+//
+// The file is closed or unmapped when the last reference is released. The cache or the table holds one reference
+// while the file is in it, and every reader holds one until it's done with the file.
+type tableFile struct {
+	file *os.File // nil if the file is mapped
+	data []byte   // the mapped file, nil if the file isn't mapped
+	name string
+	refs int32 // accessed atomically
+}
+
+// acquire adds a reference to the file. It returns false if the file has already been closed.
+func (f *tableFile) acquire() bool {
+	for {
+		refs := atomic.LoadInt32(&f.refs)
+		if refs <= 0 {
+			return false
+		}
+		if atomic.CompareAndSwapInt32(&f.refs, refs, refs+1) {
+			return true
+		}
+	}
+}
+
+// release drops a reference to the file and closes it if it was the last one.
+func (f *tableFile) release() {
+	if atomic.AddInt32(&f.refs, -1) > 0 {
+		return
+	}
+
+	var err error
+	if f.data != nil {
+		err = munmapFile(f.data)
+	} else {
+		err = f.file.Close()
+	}
+	if err != nil {
+		log.Printf("[ERROR] Can't close sstable file=%s: %v", f.name, err)
+	}
+}
+
+// readBlock returns the block of the file, see readBlock and readMappedBlock.
+// If mapped is true, the block points to the mapped file and can be used only until the file is released.
+func (f *tableFile) readBlock(h blockHandle, dataSize int64, version uint32) (block []byte, mapped bool, err error) {
+	if f.data != nil {
+		return readMappedBlock(f.data, f.name, h, dataSize, version)
+	}
+	block, err = readBlock(f.file, h, dataSize, version)
+	return block, false, err
+}
+
+// fileCache keeps a bounded number of SSTable files open, so reads don't open files every time.
+// When the cache is full, the least recently used file is removed from it:
+// it's closed as soon as readers which still use it release it.
+type fileCache struct {
+	mutex    sync.Mutex
+	capacity int
+	lru      *list.List // the most recently used table is at the front
+	items    map[*ssTable]*list.Element
+	closed   bool // files can't be opened after the cache is closed
+}
+
+type fileCacheItem struct {
+	table *ssTable
+	file  *tableFile
+}
+
+func newFileCache(capacity int) *fileCache {
+	return &fileCache{
+		capacity: capacity,
+		lru:      list.New(),
+		items:    map[*ssTable]*list.Element{},
+	}
+}
+
+// acquire returns the open file of the table, the caller must release it after use.
+// It returns utils.ErrClosed if the cache is closed: a file opened after that would never be closed.
+func (c *fileCache) acquire(t *ssTable) (*tableFile, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if c.closed {
+		return nil, fmt.Errorf("can't open sstable file=%s: %w", t.config.filename, utils.ErrClosed)
+	}
+
+	if element, found := c.items[t]; found {
+		c.lru.MoveToFront(element)
+		f := element.Value.(*fileCacheItem).file
+		atomic.AddInt32(&f.refs, 1)
+		return f, nil
+	}
+
+	file, err := os.OpenFile(t.config.filename, os.O_RDONLY, filePermissions)
+	if err != nil {
+		return nil, err
+	}
+	// one reference for the cache and one for the caller
+	f := &tableFile{file: file, name: file.Name(), refs: 2}
+	c.items[t] = c.lru.PushFront(&fileCacheItem{table: t, file: f})
+
+	for c.lru.Len() > c.capacity {
+		c.remove(c.lru.Back())
+	}
+	return f, nil
+}
+
+// evict removes the file of the table from the cache, it's called when the table is removed.
+// Readers which still use the file can finish, the file is closed after them.
+func (c *fileCache) evict(t *ssTable) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, found := c.items[t]; found {
+		c.remove(element)
+	}
+}
+
+// close removes all files from the cache, new files can't be opened after that.
+func (c *fileCache) close() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	c.closed = true
+
+	for c.lru.Len() > 0 {
+		c.remove(c.lru.Back())
+	}
+}
+
+// len returns the number of files in the cache.
+func (c *fileCache) len() int {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.lru.Len()
+}
+
+func (c *fileCache) remove(element *list.Element) {
+	item := c.lru.Remove(element).(*fileCacheItem)
+	delete(c.items, item.table)
+	item.file.release()
+}
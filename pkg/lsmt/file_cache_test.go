@@ -0,0 +1,108 @@
+package lsmt
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alexander-akhmetov/mdb/pkg/test_utils"
+	"github.com/alexander-akhmetov/mdb/pkg/utils"
+)
+
+// isFileClosed returns true if the file can't be read because it has been closed.
+func isFileClosed(f *tableFile) bool {
+	_, err := f.file.ReadAt(make([]byte, 1), 0)
+	return errors.Is(err, os.ErrClosed)
+}
+
+func newTestTables(t *testing.T, files *fileCache, count int) []*ssTable {
+	tables := []*ssTable{}
+	for i := 0; i < count; i++ {
+		filename := fmt.Sprintf(".test/sstables-test/%v.sstable", i)
+		createSSTable(filename, [][2]string{{"k", "v"}})
+		table, err := newSSTable(&ssTableConfig{filename: filename, files: files})
+		assert.Nil(t, err)
+		tables = append(tables, table)
+	}
+	return tables
+}
+
+func TestFileCacheReusesFiles(t *testing.T) {
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	files := newFileCache(10)
+	table := newTestTables(t, files, 1)[0]
+
+	first, err := files.acquire(table)
+	assert.Nil(t, err)
+	second, err := files.acquire(table)
+	assert.Nil(t, err)
+	assert.True(t, first == second)
+	assert.Equal(t, 1, files.len())
+
+	// the cache keeps the file open when readers are done
+	first.release()
+	second.release()
+	assert.False(t, isFileClosed(first))
+
+	files.close()
+	assert.Equal(t, 0, files.len())
+	assert.True(t, isFileClosed(first))
+
+	// a reader which comes after the storage is stopped can't open the file again
+	_, err = files.acquire(table)
+	assert.True(t, errors.Is(err, utils.ErrClosed))
+	assert.Equal(t, 0, files.len())
+}
+
+func TestFileCacheCapacity(t *testing.T) {
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	files := newFileCache(2)
+	tables := newTestTables(t, files, 3)
+
+	opened := []*tableFile{}
+	for _, table := range tables {
+		f, err := files.acquire(table)
+		assert.Nil(t, err)
+		f.release()
+		opened = append(opened, f)
+	}
+
+	// the least recently used file is closed
+	assert.Equal(t, 2, files.len())
+	assert.True(t, isFileClosed(opened[0]))
+	assert.False(t, isFileClosed(opened[1]))
+	assert.False(t, isFileClosed(opened[2]))
+
+	// reads still work, the file is opened again
+	e, found, err := tables[0].Get("k")
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "v", e.Value)
+	assert.True(t, isFileClosed(opened[1]))
+}
+
+func TestFileCacheEvictWithReaders(t *testing.T) {
+	// a retired table's file is closed only when the last reader releases it
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	files := newFileCache(10)
+	table := newTestTables(t, files, 1)[0]
+
+	f, err := files.acquire(table)
+	assert.Nil(t, err)
+
+	table.retire()
+	assert.Equal(t, 0, files.len())
+	assert.False(t, isFileClosed(f))
+
+	f.release()
+	assert.True(t, isFileClosed(f))
+}
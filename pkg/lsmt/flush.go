@@ -6,7 +6,7 @@ import (
 	"os"
 	"path/filepath"
 
-	"github.com/alexander-akhmetov/mdb/pkg/utils"
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/entry"
 )
 
 // flusher is a struct that holds information about
@@ -14,36 +14,80 @@ import (
 type flusher struct {
 	sstablesDir string
 	memtable    *memtable
+	tableConfig ssTableWriterConfig
+
+	values         *valueLog // big values are moved to the value log if it's set
+	valueThreshold int       // values of this size or bigger are moved to the value log
 }
 
 // flush dumps data from flusher.memtable to a new SSTable on disk.
-// The SSTable's name is defined as "{flusher.timestamp}.sstable".
-func (f *flusher) flush() string {
+// Entries are streamed from the memtable in the sorted order, they are not copied.
+// The SSTable's name is defined as "{memtable.fileNumber}.sstable".
+// The AOLog of the memtable is not removed: the table must be added to the manifest first.
+func (f *flusher) flush() (string, error) {
 	log.Printf("[DEBUG] Starting memtable flushing process for aolog=%s", f.memtable.logFilename)
-	file, err := os.OpenFile(f.filename(), os.O_APPEND|os.O_WRONLY, filePermissions)
+	w, err := newSSTableWriter(f.filename(), f.tableConfig)
 	if err != nil {
-		log.Panic(err)
+		return "", err
+	}
+	defer w.Close()
+
+	it := newMemtableIterator(f.memtable, "", "")
+	for it.Next() {
+		e, err := f.separateValue(it.Entry())
+		if err != nil {
+			return "", err
+		}
+		err = w.Add(e)
+		if err != nil {
+			return "", err
+		}
 	}
-	defer file.Close()
 
-	_, err = f.memtable.Write(file)
+	// the table can't point to values which can be lost
+	if f.values != nil {
+		err = f.values.sync()
+		if err != nil {
+			return "", err
+		}
+	}
+	err = w.Finish()
 	if err != nil {
-		log.Panic(err)
+		return "", err
 	}
-	err = file.Sync()
+
+	log.Printf("[DEBUG] memtable saved as SSTable to the file=%s", f.filename())
+
+	return f.filename(), nil
+}
+
+// separateValue moves a big value to the value log and returns an entry with the pointer to it.
+// Other entries are returned as is.
+func (f *flusher) separateValue(e *entry.DBEntry) (*entry.DBEntry, error) {
+	if f.values == nil || e.Type != entry.TypeValue || len(e.Value) < f.valueThreshold {
+		return e, nil
+	}
+
+	p, err := f.values.append(e.Key, e.Value)
 	if err != nil {
-		log.Panic(err)
+		return nil, fmt.Errorf("can't write value to the value log: %w", err)
 	}
+	return &entry.DBEntry{Type: entry.TypeValuePointer, Key: e.Key, Value: string(p.Binary())}, nil
+}
 
+// removeLog removes the AOLog of the flushed memtable.
+func (f *flusher) removeLog() {
 	log.Printf("[DEBUG] Removing old append only log file at path=%s", f.memtable.logFilename)
+	err := f.memtable.closeLog()
+	if err != nil {
+		log.Printf("[ERROR] Can't close old log file at=%s, err=%v", f.memtable.logFilename, err)
+	}
 	err = os.Remove(f.memtable.logFilename)
 	if err != nil {
-		log.Panicf("[ERROR] Can't remove old log file at=%s, err=%v", f.memtable.logFilename, err)
+		// The SSTable is already saved, so we can use it.
+		// The log is removed after restart: the manifest has the table already.
+		log.Printf("[ERROR] Can't remove old log file at=%s, err=%v", f.memtable.logFilename, err)
 	}
-
-	log.Printf("[DEBUG] memtable saved as SSTable to the file=%s", file.Name())
-
-	return file.Name()
 }
 
 // filename returns the full path to an SSTable file
@@ -51,16 +95,15 @@ func (f *flusher) flush() string {
 func (f *flusher) filename() string {
 	return filepath.Join(
 		f.sstablesDir,
-		fmt.Sprintf("%v.sstable", f.memtable.timestamp),
+		fmt.Sprintf("%v.sstable", f.memtable.fileNumber),
 	)
 }
 
 // newFlusher returns a new flusher instance
-func newFlusher(memtable *memtable, workDir string) *flusher {
-	f := flusher{
+func newFlusher(memtable *memtable, workDir string, tableConfig ssTableWriterConfig) *flusher {
+	return &flusher{
 		memtable:    memtable,
 		sstablesDir: workDir,
+		tableConfig: tableConfig,
 	}
-	utils.RecreateFile(f.filename())
-	return &f
 }
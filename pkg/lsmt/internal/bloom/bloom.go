@@ -0,0 +1,137 @@
+// Package bloom implements a Bloom filter: a probabilistic data structure
+// which can tell that a key definitely does not exist in a set.
+package bloom
+
+import (
+	"hash/fnv"
+)
+
+const minBits = 64
+const maxHashes = 30
+
+// Filter is a Bloom filter.
+// Binary format: [bits][hashes count: 1byte]
+type Filter struct {
+	bits   []byte
+	hashes uint8
+}
+
+// IncorrectFilterError is an Error which indicates that
+// binary data does not contain a filter
+type IncorrectFilterError struct{}
+
+func (e *IncorrectFilterError) Error() string {
+	return "Incorrect bloom filter"
+}
+
+// New returns an empty filter for the given number of keys.
+// The more bits per key we use, the fewer false positives the filter returns.
+func New(keysCount int, bitsPerKey int) *Filter {
+	bitsCount := keysCount * bitsPerKey
+	if bitsCount < minBits {
+		bitsCount = minBits
+	}
+
+	// the optimal number of hash functions is ln(2) * bits per key
+	hashes := int(float64(bitsPerKey) * 0.69)
+	if hashes < 1 {
+		hashes = 1
+	}
+	if hashes > maxHashes {
+		hashes = maxHashes
+	}
+
+	return &Filter{
+		bits:   make([]byte, (bitsCount+7)/8),
+		hashes: uint8(hashes),
+	}
+}
+
+// NewFromBinary restores a filter from its binary representation.
+func NewFromBinary(data []byte) (*Filter, error) {
+	if len(data) < 2 || data[len(data)-1] == 0 {
+		return nil, &IncorrectFilterError{}
+	}
+
+	bits := make([]byte, len(data)-1)
+	copy(bits, data)
+	return &Filter{
+		bits:   bits,
+		hashes: data[len(data)-1],
+	}, nil
+}
+
+// Add adds the key to the filter.
+func (f *Filter) Add(key string) {
+	f.addHash(hash(key))
+}
+
+// MayContain returns false if the key is definitely not in the filter.
+// If it returns true, the key may be in the filter.
+func (f *Filter) MayContain(key string) bool {
+	h1, h2 := split(hash(key))
+	bitsCount := uint32(len(f.bits) * 8)
+
+	for i := uint32(0); i < uint32(f.hashes); i++ {
+		position := (h1 + i*h2) % bitsCount
+		if f.bits[position/8]&(1<<(position%8)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Binary returns byte array with all data of the filter.
+func (f *Filter) Binary() []byte {
+	data := make([]byte, len(f.bits), len(f.bits)+1)
+	copy(data, f.bits)
+	return append(data, f.hashes)
+}
+
+func (f *Filter) addHash(h uint64) {
+	h1, h2 := split(h)
+	bitsCount := uint32(len(f.bits) * 8)
+
+	// double hashing: we need only one hash function to emulate many of them
+	for i := uint32(0); i < uint32(f.hashes); i++ {
+		position := (h1 + i*h2) % bitsCount
+		f.bits[position/8] |= 1 << (position % 8)
+	}
+}
+
+// Builder collects keys when their number is not known in advance
+// and builds a filter of the right size.
+type Builder struct {
+	bitsPerKey int
+	hashes     []uint64
+}
+
+// NewBuilder returns a new filter builder.
+func NewBuilder(bitsPerKey int) *Builder {
+	return &Builder{bitsPerKey: bitsPerKey}
+}
+
+// Add adds the key to the future filter.
+func (b *Builder) Add(key string) {
+	b.hashes = append(b.hashes, hash(key))
+}
+
+// Build returns a filter with all added keys.
+func (b *Builder) Build() *Filter {
+	f := New(len(b.hashes), b.bitsPerKey)
+	for _, h := range b.hashes {
+		f.addHash(h)
+	}
+	return f
+}
+
+func hash(key string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(key))
+	return h.Sum64()
+}
+
+// split returns two hashes from one 64 bit hash
+func split(h uint64) (uint32, uint32) {
+	return uint32(h), uint32(h>>32) | 1
+}
@@ -0,0 +1,67 @@
+package bloom
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFilterHasNoFalseNegatives(t *testing.T) {
+	// all added keys must be found
+	f := New(1000, 10)
+	for i := 0; i < 1000; i++ {
+		f.Add(fmt.Sprintf("key_%v", i))
+	}
+
+	for i := 0; i < 1000; i++ {
+		assert.True(t, f.MayContain(fmt.Sprintf("key_%v", i)))
+	}
+}
+
+func TestFilterFalsePositiveRate(t *testing.T) {
+	// with 10 bits per key the filter should return
+	// false positives for ~1% of unknown keys
+	f := New(1000, 10)
+	for i := 0; i < 1000; i++ {
+		f.Add(fmt.Sprintf("key_%v", i))
+	}
+
+	falsePositives := 0
+	for i := 0; i < 10000; i++ {
+		if f.MayContain(fmt.Sprintf("unknown_%v", i)) {
+			falsePositives++
+		}
+	}
+	assert.True(t, falsePositives < 300, "too many false positives: %v", falsePositives)
+}
+
+func TestEmptyFilter(t *testing.T) {
+	f := New(0, 10)
+	assert.False(t, f.MayContain("key"))
+}
+
+func TestBuilder(t *testing.T) {
+	b := NewBuilder(10)
+	b.Add("k1")
+	b.Add("k2")
+
+	f := b.Build()
+	assert.True(t, f.MayContain("k1"))
+	assert.True(t, f.MayContain("k2"))
+	assert.Equal(t, New(2, 10).hashes, f.hashes)
+}
+
+func TestFilterBinary(t *testing.T) {
+	// filter restored from the binary representation must be the same
+	f := New(10, 10)
+	f.Add("key")
+
+	restored, err := NewFromBinary(f.Binary())
+	assert.Nil(t, err)
+	assert.Equal(t, f, restored)
+	assert.True(t, restored.MayContain("key"))
+
+	_, err = NewFromBinary([]byte{})
+	assert.IsType(t, &IncorrectFilterError{}, err)
+}
@@ -0,0 +1,124 @@
+// Package cache implements an LRU cache of SSTable blocks bounded by the total size of the blocks.
+// It's safe for concurrent use.
+package cache
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// Key identifies a block: the ID of the table and the offset of the block in the file.
+type Key struct {
+	Table  uint64
+	Offset uint64
+}
+
+type item struct {
+	key   Key
+	value []byte
+}
+
+// Cache keeps the most recently used blocks.
+// Blocks must not be changed after they are added to the cache.
+type Cache struct {
+	// accessed atomically, they are the first fields to be aligned on 32-bit platforms
+	hits   int64
+	misses int64
+	lastID uint64
+
+	mutex    sync.Mutex // protects all fields below
+	capacity int64
+	size     int64
+	lru      *list.List // the most recently used item is at the front
+	items    map[Key]*list.Element
+}
+
+// New returns an empty cache which holds up to capacity bytes of blocks.
+func New(capacity int64) *Cache {
+	return &Cache{
+		capacity: capacity,
+		lru:      list.New(),
+		items:    map[Key]*list.Element{},
+	}
+}
+
+// NewID returns a unique ID for a table which uses the cache.
+// Tables must not reuse IDs even if they have the same file:
+// a new ID makes all blocks of the old file unreachable.
+func (c *Cache) NewID() uint64 {
+	return atomic.AddUint64(&c.lastID, 1)
+}
+
+// Get returns the block and marks it as the most recently used one.
+func (c *Cache) Get(key Key) ([]byte, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	element, found := c.items[key]
+	if !found {
+		atomic.AddInt64(&c.misses, 1)
+		return nil, false
+	}
+	atomic.AddInt64(&c.hits, 1)
+	c.lru.MoveToFront(element)
+	return element.Value.(*item).value, true
+}
+
+// Put adds the block to the cache and evicts the least recently used blocks if the cache is full.
+// Blocks bigger than the capacity are not cached.
+func (c *Cache) Put(key Key, value []byte) {
+	size := int64(len(value))
+	if size > c.capacity {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if element, found := c.items[key]; found {
+		c.remove(element)
+	}
+	c.items[key] = c.lru.PushFront(&item{key: key, value: value})
+	c.size += size
+
+	for c.size > c.capacity {
+		c.remove(c.lru.Back())
+	}
+}
+
+// EvictTable removes all blocks of the table.
+func (c *Cache) EvictTable(table uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	for key, element := range c.items {
+		if key.Table == table {
+			c.remove(element)
+		}
+	}
+}
+
+// Size returns the total size of the cached blocks in bytes.
+func (c *Cache) Size() int64 {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	return c.size
+}
+
+// Hits returns the number of Get calls which found the block.
+func (c *Cache) Hits() int64 {
+	return atomic.LoadInt64(&c.hits)
+}
+
+// Misses returns the number of Get calls which didn't find the block.
+func (c *Cache) Misses() int64 {
+	return atomic.LoadInt64(&c.misses)
+}
+
+func (c *Cache) remove(element *list.Element) {
+	it := c.lru.Remove(element).(*item)
+	delete(c.items, it.key)
+	c.size -= int64(len(it.value))
+}
@@ -0,0 +1,82 @@
+package cache
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetPut(t *testing.T) {
+	c := New(100)
+
+	_, found := c.Get(Key{Table: 1, Offset: 0})
+	assert.False(t, found)
+
+	c.Put(Key{Table: 1, Offset: 0}, []byte("block-1"))
+	c.Put(Key{Table: 2, Offset: 0}, []byte("block-2"))
+
+	value, found := c.Get(Key{Table: 1, Offset: 0})
+	assert.True(t, found)
+	assert.Equal(t, []byte("block-1"), value)
+
+	value, found = c.Get(Key{Table: 2, Offset: 0})
+	assert.True(t, found)
+	assert.Equal(t, []byte("block-2"), value)
+
+	assert.Equal(t, int64(2), c.Hits())
+	assert.Equal(t, int64(1), c.Misses())
+	assert.Equal(t, int64(14), c.Size())
+
+	// a new value replaces the old one
+	c.Put(Key{Table: 1, Offset: 0}, []byte("new"))
+	value, _ = c.Get(Key{Table: 1, Offset: 0})
+	assert.Equal(t, []byte("new"), value)
+	assert.Equal(t, int64(10), c.Size())
+}
+
+func TestEviction(t *testing.T) {
+	c := New(30)
+
+	c.Put(Key{Table: 1, Offset: 0}, make([]byte, 10))
+	c.Put(Key{Table: 1, Offset: 10}, make([]byte, 10))
+	c.Put(Key{Table: 1, Offset: 20}, make([]byte, 10))
+
+	// the first block becomes the most recently used one, so the second one is evicted
+	_, found := c.Get(Key{Table: 1, Offset: 0})
+	assert.True(t, found)
+	c.Put(Key{Table: 1, Offset: 30}, make([]byte, 10))
+
+	_, found = c.Get(Key{Table: 1, Offset: 10})
+	assert.False(t, found)
+	for _, offset := range []uint64{0, 20, 30} {
+		_, found = c.Get(Key{Table: 1, Offset: offset})
+		assert.True(t, found)
+	}
+	assert.Equal(t, int64(30), c.Size())
+
+	// blocks bigger than the cache are not cached
+	c.Put(Key{Table: 1, Offset: 40}, make([]byte, 31))
+	_, found = c.Get(Key{Table: 1, Offset: 40})
+	assert.False(t, found)
+	assert.Equal(t, int64(30), c.Size())
+}
+
+func TestEvictTable(t *testing.T) {
+	c := New(100)
+	first := c.NewID()
+	second := c.NewID()
+	assert.NotEqual(t, first, second)
+
+	c.Put(Key{Table: first, Offset: 0}, []byte("1"))
+	c.Put(Key{Table: first, Offset: 1}, []byte("2"))
+	c.Put(Key{Table: second, Offset: 0}, []byte("3"))
+
+	c.EvictTable(first)
+	_, found := c.Get(Key{Table: first, Offset: 0})
+	assert.False(t, found)
+	_, found = c.Get(Key{Table: first, Offset: 1})
+	assert.False(t, found)
+	_, found = c.Get(Key{Table: second, Offset: 0})
+	assert.True(t, found)
+	assert.Equal(t, int64(1), c.Size())
+}
@@ -5,9 +5,22 @@ import (
 	"io"
 )
 
+// Entry types
+const (
+	// TypeValue is a simple key-value entry
+	TypeValue uint8 = 0
+	// TypeTombstone marks a key as deleted
+	TypeTombstone uint8 = 1
+	// TypeBatch holds a group of entries which must be applied together
+	TypeBatch uint8 = 2
+	// TypeValuePointer is a key-value entry whose value is stored in the value log,
+	// the value of the entry is the position of the real value there
+	TypeValuePointer uint8 = 3
+)
+
 // DBEntry represents a one database entry
 type DBEntry struct {
-	Type  uint8 // 0: simple value
+	Type  uint8 // 0: simple value, 1: tombstone, 2: batch, 3: value pointer
 	Key   string
 	Value string
 }
@@ -20,24 +33,41 @@ func (e *IncompleteEntryError) Error() string {
 	return "Incomplete entry"
 }
 
+// HeaderSize is the size of the entry header: [type][key length][value length]
+const HeaderSize = 9
+
+const maxInt = int(^uint(0) >> 1)
+
+// BinaryLength returns the full length of the entry in binary format using only its header.
+// It returns IncompleteEntryError if data doesn't have the full header.
+func BinaryLength(data []byte) (int, error) {
+	if len(data) < HeaderSize {
+		return 0, &IncompleteEntryError{}
+	}
+
+	keyLength := binary.BigEndian.Uint32(data[1:5])
+	valueLength := binary.BigEndian.Uint32(data[5:9])
+	length := uint64(HeaderSize) + uint64(keyLength) + uint64(valueLength)
+	if length > uint64(maxInt) {
+		// a broken header on a 32-bit platform, the length must not become negative
+		return maxInt, nil
+	}
+	return int(length), nil
+}
+
 // NewDBEntry returns a new DBEntry structure
 // it parses incoming data and builds key and value from it
 func NewDBEntry(data []byte) (*DBEntry, error) {
-	if len(data) < 9 {
+	expDataLength, err := BinaryLength(data)
+	if err != nil || len(data) < expDataLength {
 		return &DBEntry{}, &IncompleteEntryError{}
 	}
 
 	keyLength := binary.BigEndian.Uint32(data[1:5])
 	valueLength := binary.BigEndian.Uint32(data[5:9])
 
-	dataLength := uint32(len(data))
-	expDataLength := 9 + keyLength + valueLength
-	if dataLength < expDataLength {
-		return &DBEntry{}, &IncompleteEntryError{}
-	}
-
 	entry := DBEntry{
-		Type:  0,
+		Type:  data[0],
 		Key:   string(data[9 : 9+keyLength]),
 		Value: string(data[9+keyLength : 9+keyLength+valueLength]),
 	}
@@ -45,6 +75,40 @@ func NewDBEntry(data []byte) (*DBEntry, error) {
 	return &entry, nil
 }
 
+// NewBatchEntry packs entries into one entry, so they can be written as a single record.
+// The value of the batch entry is the concatenation of binary representations of the entries.
+func NewBatchEntry(entries []*DBEntry) *DBEntry {
+	data := []byte{}
+	for _, e := range entries {
+		data = append(data, e.Binary()...)
+	}
+	return &DBEntry{
+		Type:  TypeBatch,
+		Value: string(data),
+	}
+}
+
+// BatchEntries unpacks entries of a batch entry.
+// It returns IncompleteEntryError if the batch has some unexpected data at the end.
+func (e *DBEntry) BatchEntries() ([]*DBEntry, error) {
+	data := []byte(e.Value)
+	entries := []*DBEntry{}
+	for len(data) > 0 {
+		inner, err := NewDBEntry(data)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, inner)
+		data = data[inner.Length():]
+	}
+	return entries, nil
+}
+
+// IsTombstone returns true if the entry marks a deleted key
+func (e *DBEntry) IsTombstone() bool {
+	return e.Type == TypeTombstone
+}
+
 // Length returns full length of the entry in binary format
 func (e *DBEntry) Length() int {
 	return len(e.Binary())
@@ -67,7 +131,7 @@ func (e *DBEntry) Binary() []byte {
 		uint32(len(bvalue)),
 	)
 
-	data := []byte{0}
+	data := []byte{e.Type}
 	for _, b := range [][]byte{keyLength, valueLength, bkey, bvalue} {
 		data = append(data, b...)
 	}
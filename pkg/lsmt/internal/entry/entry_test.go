@@ -93,3 +93,51 @@ func TestNewDBEntryFromBinaryWithIncompleteEntry(t *testing.T) {
 	assert.Equal(t, &expEntry, readedEntry)
 	assert.IsType(t, &IncompleteEntryError{}, err)
 }
+
+func TestBinaryLengthOfBrokenHeader(t *testing.T) {
+	// the length from a broken header must not overflow int on 32-bit platforms
+	length, err := BinaryLength([]byte{0, 255, 255, 255, 255, 255, 255, 255, 255})
+	assert.Nil(t, err)
+	assert.True(t, length > 1<<30)
+}
+
+func TestTombstoneBinary(t *testing.T) {
+	// tombstone must keep its type in the binary representation
+	e := &DBEntry{
+		Type: TypeTombstone,
+		Key:  "key",
+	}
+
+	expBinary := []byte{1, 0, 0, 0, 3, 0, 0, 0, 0}
+	expBinary = append(expBinary, []byte(e.Key)...)
+	assert.Equal(t, expBinary, e.Binary())
+
+	readedEntry, err := NewDBEntry(e.Binary())
+	assert.Nil(t, err)
+	assert.Equal(t, e, readedEntry)
+	assert.True(t, readedEntry.IsTombstone())
+}
+
+func TestBatchEntry(t *testing.T) {
+	// test that a batch entry keeps all entries in the original order
+	entries := []*DBEntry{
+		{Type: TypeValue, Key: "k2", Value: "v2"},
+		{Type: TypeTombstone, Key: "k1"},
+		{Type: TypeValue, Key: "k2", Value: "v3"},
+	}
+	batch := NewBatchEntry(entries)
+	assert.Equal(t, TypeBatch, batch.Type)
+	assert.Equal(t, "", batch.Key)
+
+	restored, err := NewDBEntry(batch.Binary())
+	assert.Nil(t, err)
+
+	batchEntries, err := restored.BatchEntries()
+	assert.Nil(t, err)
+	assert.Equal(t, entries, batchEntries)
+
+	// broken data inside the batch
+	restored.Value = restored.Value[:len(restored.Value)-1]
+	_, err = restored.BatchEntries()
+	assert.IsType(t, &IncompleteEntryError{}, err)
+}
@@ -0,0 +1,56 @@
+// Package index implements a compact sorted index of string keys with binary search.
+//
+// All keys are stored one after another in a single byte slice and the index keeps only
+// the end offset of every key, so the index of a table has two allocations however many keys it has
+// and the garbage collector doesn't need to scan it.
+// The position of a key in the index is its value: SSTables use it as the number of the data block.
+package index
+
+import (
+	"sort"
+)
+
+// Index is a sorted list of keys. It's built once and must not be changed
+// while it's being read, after that it's safe for concurrent use.
+type Index struct {
+	data []byte   // all keys in sorted order
+	ends []uint32 // ends[i] is the end offset of the key i in data
+}
+
+// New returns an empty index with the space for n keys.
+func New(n int) *Index {
+	return &Index{ends: make([]uint32, 0, n)}
+}
+
+// Add appends the key to the index. Keys must be added in ascending order.
+func (i *Index) Add(key string) {
+	i.data = append(i.data, key...)
+	i.ends = append(i.ends, uint32(len(i.data)))
+}
+
+// Len returns the number of keys.
+func (i *Index) Len() int {
+	return len(i.ends)
+}
+
+// Key returns the key at the position.
+func (i *Index) Key(position int) string {
+	return string(i.key(position))
+}
+
+// Ceiling returns the position of the smallest key which is not less than the key.
+func (i *Index) Ceiling(key string) (int, bool) {
+	position := sort.Search(len(i.ends), func(n int) bool {
+		// the conversion in a comparison doesn't allocate memory
+		return string(i.key(n)) >= key
+	})
+	return position, position < len(i.ends)
+}
+
+func (i *Index) key(position int) []byte {
+	var start uint32
+	if position > 0 {
+		start = i.ends[position-1]
+	}
+	return i.data[start:i.ends[position]]
+}
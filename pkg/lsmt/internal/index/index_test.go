@@ -0,0 +1,123 @@
+package index
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/rbt"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIndexCeiling(t *testing.T) {
+	index := New(3)
+	index.Add("key_b")
+	index.Add("key_g")
+	index.Add("key_p")
+
+	for key, expected := range map[string]int{
+		"key_a": 0,
+		"key_b": 0,
+		"key_c": 1,
+		"key_g": 1,
+		"key_h": 2,
+		"key_p": 2,
+	} {
+		position, found := index.Ceiling(key)
+		assert.True(t, found, key)
+		assert.Equal(t, expected, position, key)
+	}
+
+	_, found := index.Ceiling("key_q")
+	assert.False(t, found)
+}
+
+func TestIndexKeys(t *testing.T) {
+	index := New(0)
+	assert.Equal(t, 0, index.Len())
+	_, found := index.Ceiling("key")
+	assert.False(t, found)
+
+	// an empty key is a valid key too
+	for _, key := range []string{"", "a", "ab", "b"} {
+		index.Add(key)
+	}
+	assert.Equal(t, 4, index.Len())
+	assert.Equal(t, "", index.Key(0))
+	assert.Equal(t, "ab", index.Key(2))
+	assert.Equal(t, "b", index.Key(3))
+
+	position, found := index.Ceiling("aa")
+	assert.True(t, found)
+	assert.Equal(t, 2, position)
+}
+
+// benchmarkKeys returns sorted keys which look like the last keys of data blocks
+func benchmarkKeys(n int) []string {
+	keys := make([]string, n)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("user:%010d:profile", i*10)
+	}
+	return keys
+}
+
+func benchmarkLookups(keys []string) []string {
+	random := rand.New(rand.NewSource(1))
+	lookups := make([]string, 1024)
+	for i := range lookups {
+		lookups[i] = fmt.Sprintf("user:%010d:profile", random.Intn(len(keys)*10))
+	}
+	return lookups
+}
+
+func BenchmarkIndexBuild(b *testing.B) {
+	keys := benchmarkKeys(10000)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		index := New(len(keys))
+		for _, key := range keys {
+			index.Add(key)
+		}
+	}
+}
+
+func BenchmarkRBTBuild(b *testing.B) {
+	keys := benchmarkKeys(10000)
+	b.ReportAllocs()
+	for n := 0; n < b.N; n++ {
+		tree := rbt.NewRBTree()
+		for i, key := range keys {
+			tree.Put(key, i)
+		}
+	}
+}
+
+func BenchmarkIndexCeiling(b *testing.B) {
+	keys := benchmarkKeys(10000)
+	lookups := benchmarkLookups(keys)
+	index := New(len(keys))
+	for _, key := range keys {
+		index.Add(key)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		index.Ceiling(lookups[n%len(lookups)])
+	}
+}
+
+func BenchmarkRBTCeiling(b *testing.B) {
+	keys := benchmarkKeys(10000)
+	lookups := benchmarkLookups(keys)
+	tree := rbt.NewRBTree()
+	for i, key := range keys {
+		tree.Put(key, i)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		tree.Ceiling(lookups[n%len(lookups)])
+	}
+}
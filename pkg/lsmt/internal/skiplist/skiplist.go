@@ -0,0 +1,175 @@
+// Package skiplist implements a sorted skip list with string keys
+// which supports one writer and any number of lock-free readers at the same time.
+//
+// Nodes are never removed, and all links between nodes are published with atomic operations:
+// a new node is fully initialized before it becomes visible, so readers never see a partially
+// inserted node. Writers must be serialized by the caller.
+package skiplist
+
+import (
+	"math/rand"
+	"sync/atomic"
+	"time"
+	"unsafe"
+)
+
+const maxHeight = 12
+
+// every next level has 1/branching nodes of the previous one
+const branching = 4
+
+type node struct {
+	key   string
+	value unsafe.Pointer   // *interface{}
+	next  []unsafe.Pointer // *node for every level of the node
+}
+
+func newNode(key string, value interface{}, height int) *node {
+	return &node{
+		key:   key,
+		value: unsafe.Pointer(&value),
+		next:  make([]unsafe.Pointer, height),
+	}
+}
+
+func (n *node) loadNext(level int) *node {
+	return (*node)(atomic.LoadPointer(&n.next[level]))
+}
+
+func (n *node) storeNext(level int, next *node) {
+	atomic.StorePointer(&n.next[level], unsafe.Pointer(next))
+}
+
+func (n *node) loadValue() interface{} {
+	return *(*interface{})(atomic.LoadPointer(&n.value))
+}
+
+func (n *node) storeValue(value interface{}) {
+	atomic.StorePointer(&n.value, unsafe.Pointer(&value))
+}
+
+// SkipList is a sorted map from strings to values.
+type SkipList struct {
+	head   *node
+	height int32 // the current height of the list, accessed atomically
+	length int64 // accessed atomically
+	random *rand.Rand
+}
+
+// New returns an empty skip list.
+func New() *SkipList {
+	return &SkipList{
+		head:   newNode("", nil, maxHeight),
+		height: 1,
+		random: rand.New(rand.NewSource(time.Now().UnixNano())),
+	}
+}
+
+// Put sets the value of the key. Only one goroutine can call it at a time.
+func (l *SkipList) Put(key string, value interface{}) {
+	var prev [maxHeight]*node
+	n := l.findGreaterOrEqual(key, &prev)
+	if n != nil && n.key == key {
+		n.storeValue(value)
+		return
+	}
+
+	height := l.randomHeight()
+	listHeight := int(atomic.LoadInt32(&l.height))
+	if height > listHeight {
+		for i := listHeight; i < height; i++ {
+			prev[i] = l.head
+		}
+		// readers which see the new height before the node is linked
+		// just go down from the empty levels of the head
+		atomic.StoreInt32(&l.height, int32(height))
+	}
+
+	n = newNode(key, value, height)
+	for i := 0; i < height; i++ {
+		// the node is not visible yet, so its links can be set in any order
+		n.storeNext(i, prev[i].loadNext(i))
+		prev[i].storeNext(i, n)
+	}
+	atomic.AddInt64(&l.length, 1)
+}
+
+// Get returns the value of the key.
+func (l *SkipList) Get(key string) (interface{}, bool) {
+	n := l.findGreaterOrEqual(key, nil)
+	if n != nil && n.key == key {
+		return n.loadValue(), true
+	}
+	return nil, false
+}
+
+// Len returns the number of keys in the list.
+func (l *SkipList) Len() int {
+	return int(atomic.LoadInt64(&l.length))
+}
+
+// Iterator returns an iterator over keys which are not less than the start key.
+// Keys added after the iterator has been created can be returned too.
+func (l *SkipList) Iterator(start string) *Iterator {
+	var prev [maxHeight]*node
+	l.findGreaterOrEqual(start, &prev)
+	return &Iterator{node: prev[0]}
+}
+
+// findGreaterOrEqual returns the first node with a key which is not less than the given one,
+// or nil if there is no such node. If prev is not nil, it's filled with
+// the last node before the key on every level.
+func (l *SkipList) findGreaterOrEqual(key string, prev *[maxHeight]*node) *node {
+	x := l.head
+	for level := int(atomic.LoadInt32(&l.height)) - 1; level >= 0; level-- {
+		next := x.loadNext(level)
+		for next != nil && next.key < key {
+			x = next
+			next = x.loadNext(level)
+		}
+		if prev != nil {
+			prev[level] = x
+		}
+		if level == 0 {
+			return next
+		}
+	}
+	return nil
+}
+
+func (l *SkipList) randomHeight() int {
+	height := 1
+	for height < maxHeight && l.random.Intn(branching) == 0 {
+		height++
+	}
+	return height
+}
+
+// Iterator iterates over keys of the list in the sorted order.
+//
+//	it := list.Iterator("")
+//	for it.Next() {
+//		fmt.Println(it.Key(), it.Value())
+//	}
+type Iterator struct {
+	node *node
+}
+
+// Next moves the iterator to the next key and returns false if there are no keys left.
+func (it *Iterator) Next() bool {
+	if it.node == nil {
+		return false
+	}
+	it.node = it.node.loadNext(0)
+	return it.node != nil
+}
+
+// Key returns the current key.
+func (it *Iterator) Key() string {
+	return it.node.key
+}
+
+// Value returns the value of the current key.
+func (it *Iterator) Value() interface{} {
+	return it.node.loadValue()
+}
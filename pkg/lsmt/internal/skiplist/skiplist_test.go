@@ -0,0 +1,100 @@
+package skiplist
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPutGet(t *testing.T) {
+	l := New()
+
+	_, found := l.Get("k1")
+	assert.False(t, found)
+
+	l.Put("k2", 2)
+	l.Put("k1", 1)
+	l.Put("k3", 3)
+
+	value, found := l.Get("k1")
+	assert.True(t, found)
+	assert.Equal(t, 1, value)
+
+	// a new value replaces the old one
+	l.Put("k1", 10)
+	value, found = l.Get("k1")
+	assert.True(t, found)
+	assert.Equal(t, 10, value)
+	assert.Equal(t, 3, l.Len())
+
+	_, found = l.Get("k0")
+	assert.False(t, found)
+	_, found = l.Get("k4")
+	assert.False(t, found)
+}
+
+func TestIterator(t *testing.T) {
+	l := New()
+	keys := []string{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%v", (i*7919)%1000)
+		keys = append(keys, key)
+		l.Put(key, i)
+	}
+	sort.Strings(keys)
+
+	result := []string{}
+	it := l.Iterator("")
+	for it.Next() {
+		result = append(result, it.Key())
+	}
+	assert.Equal(t, keys, result)
+	assert.False(t, it.Next())
+
+	// the iterator starts from the first key which is not less than the start key
+	it = l.Iterator("key-500")
+	assert.True(t, it.Next())
+	assert.Equal(t, "key-500", it.Key())
+	it = l.Iterator("key-5000")
+	assert.True(t, it.Next())
+	assert.Equal(t, "key-501", it.Key())
+	it = l.Iterator("z")
+	assert.False(t, it.Next())
+}
+
+func TestConcurrentReaders(t *testing.T) {
+	// readers don't need locks while one writer adds keys
+	l := New()
+	count := 2000
+
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				previous := ""
+				it := l.Iterator("")
+				for it.Next() {
+					assert.True(t, previous < it.Key())
+					previous = it.Key()
+				}
+				l.Get(fmt.Sprintf("key-%05d", i))
+			}
+		}()
+	}
+
+	for i := 0; i < count; i++ {
+		l.Put(fmt.Sprintf("key-%05d", (i*7919)%count), i)
+	}
+	wg.Wait()
+
+	assert.Equal(t, count, l.Len())
+	for i := 0; i < count; i++ {
+		_, found := l.Get(fmt.Sprintf("key-%05d", i))
+		assert.True(t, found)
+	}
+}
@@ -0,0 +1,315 @@
+package lsmt
+
+import (
+	"fmt"
+
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/entry"
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/skiplist"
+)
+
+// entryIterator iterates over sorted entries of one source: a memtable or an SSTable.
+type entryIterator interface {
+	// Next moves the iterator to the next entry and returns false if there are no entries left.
+	Next() bool
+	// Entry returns the current entry.
+	Entry() *entry.DBEntry
+	// Err returns the error which stopped the iterator, if any.
+	Err() error
+	// Close releases all resources of the iterator.
+	Close()
+}
+
+// Iterator returns key-value pairs from a range in the sorted order.
+// Deleted keys are skipped, and only the latest version of each key is returned.
+//
+//	it, err := storage.Scan("a", "b")
+//	if err != nil {
+//		return err
+//	}
+//	defer it.Close()
+//	for it.Next() {
+//		fmt.Println(it.Key(), it.Value())
+//	}
+//	return it.Err()
+type Iterator struct {
+	merged *mergingIterator
+	values *valueLogSnapshot // values of pointers from SSTables are read from it
+	value  string
+	err    error
+}
+
+// Next moves the iterator to the next key and returns false when the range is over.
+func (it *Iterator) Next() bool {
+	if it.err != nil {
+		return false
+	}
+	for it.merged.Next() {
+		e := it.merged.Entry()
+		if e.IsTombstone() {
+			continue
+		}
+		if e.Type != entry.TypeValuePointer {
+			it.value = e.Value
+			return true
+		}
+
+		p, err := pointerOf(e)
+		if err == nil {
+			it.value, err = it.values.read(e.Key, p)
+		}
+		if err != nil {
+			it.err = err
+			return false
+		}
+		return true
+	}
+	return false
+}
+
+// Key returns the current key.
+func (it *Iterator) Key() string {
+	return it.merged.Entry().Key
+}
+
+// Value returns the value of the current key.
+func (it *Iterator) Value() string {
+	return it.value
+}
+
+// Err returns the error which stopped the iterator, if any.
+// It must be checked after Next returns false.
+func (it *Iterator) Err() error {
+	if it.err != nil {
+		return it.err
+	}
+	return it.merged.Err()
+}
+
+// Close releases all files opened by the iterator.
+func (it *Iterator) Close() {
+	it.merged.Close()
+	it.values.release()
+}
+
+// mergingIterator merges many sorted sources into one sorted stream.
+// Sources must be ordered from the newest to the oldest one:
+// if the same key exists in many sources, the entry from the newest source wins.
+type mergingIterator struct {
+	sources []entryIterator
+	valid   []bool
+	current *entry.DBEntry
+}
+
+func newMergingIterator(sources []entryIterator) *mergingIterator {
+	m := &mergingIterator{
+		sources: sources,
+		valid:   make([]bool, len(sources)),
+	}
+	for i, src := range sources {
+		m.valid[i] = src.Next()
+	}
+	return m
+}
+
+// Next finds the smallest key among all sources and skips
+// its older versions in all other sources.
+func (m *mergingIterator) Next() bool {
+	position := -1
+	for i, src := range m.sources {
+		if !m.valid[i] {
+			continue
+		}
+		// strict comparison: sources are ordered by age, so the first one is the newest
+		if position == -1 || src.Entry().Key < m.sources[position].Entry().Key {
+			position = i
+		}
+	}
+
+	if position == -1 {
+		m.current = nil
+		return false
+	}
+
+	m.current = m.sources[position].Entry()
+	for i, src := range m.sources {
+		for m.valid[i] && src.Entry().Key == m.current.Key {
+			m.valid[i] = src.Next()
+		}
+	}
+
+	return true
+}
+
+// Entry returns the current entry.
+func (m *mergingIterator) Entry() *entry.DBEntry {
+	return m.current
+}
+
+// Err returns the first error of the sources.
+func (m *mergingIterator) Err() error {
+	for _, src := range m.sources {
+		if err := src.Err(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Close closes all sources.
+func (m *mergingIterator) Close() {
+	for _, src := range m.sources {
+		src.Close()
+	}
+}
+
+// memtableIterator iterates over memtable entries in the sorted order.
+// It doesn't copy entries: keys written after the iterator has been created can be returned too.
+type memtableIterator struct {
+	it      *skiplist.Iterator
+	end     string
+	current *entry.DBEntry
+}
+
+// newMemtableIterator returns an iterator over entries from the range [start, end).
+// An empty end means that the range has no upper bound.
+func newMemtableIterator(m *memtable, start string, end string) *memtableIterator {
+	return &memtableIterator{it: m.data.Iterator(start), end: end}
+}
+
+func (it *memtableIterator) Next() bool {
+	if !it.it.Next() || (it.end != "" && it.it.Key() >= it.end) {
+		it.current = nil
+		return false
+	}
+	it.current = it.it.Value().(*entry.DBEntry)
+	return true
+}
+
+func (it *memtableIterator) Entry() *entry.DBEntry {
+	return it.current
+}
+
+func (it *memtableIterator) Err() error {
+	return nil
+}
+
+func (it *memtableIterator) Close() {}
+
+// ssTableIterator reads entries from an SSTable file block by block.
+type ssTableIterator struct {
+	table    *ssTable
+	file     *tableFile
+	position int // position of the next block to read
+	block    *blockIterator
+	start    string
+	end      string
+	current  *entry.DBEntry
+	err      error
+}
+
+// newSSTableIterator opens the SSTable file and finds the first block which can contain the start key.
+// The iterator holds the file until it's closed, so it can be used even after the table has been removed.
+func newSSTableIterator(s *ssTable, start string, end string) (*ssTableIterator, error) {
+	file, err := s.openFile()
+	if err != nil {
+		return nil, err
+	}
+
+	position, found := s.findBlock(start)
+	if !found {
+		// all keys of the table are less than the start key
+		position = len(s.blocks)
+	}
+
+	return &ssTableIterator{
+		table:    s,
+		file:     file,
+		position: position,
+		start:    start,
+		end:      end,
+	}, nil
+}
+
+func (it *ssTableIterator) Next() bool {
+	for {
+		if it.block != nil && it.block.Next() {
+			e := it.block.Entry()
+			if e.Key < it.start {
+				continue
+			}
+			if it.end != "" && e.Key >= it.end {
+				return false
+			}
+			it.current = e
+			return true
+		}
+
+		if it.block != nil && it.block.Err() != nil {
+			it.err = fmt.Errorf("can't read block of sstable file=%s: %w", it.table.config.filename, it.block.Err())
+			return false
+		}
+		if it.position >= len(it.table.blocks) {
+			return false
+		}
+
+		// mapped blocks stay valid until the iterator is closed and releases the file
+		data, _, err := it.file.readBlock(it.table.blocks[it.position], it.table.dataSize, it.table.version)
+		if err != nil {
+			it.err = fmt.Errorf("can't read block of sstable file=%s: %w", it.table.config.filename, err)
+			return false
+		}
+		it.position++
+		it.block = newBlockIterator(data, it.table.version)
+	}
+}
+
+func (it *ssTableIterator) Entry() *entry.DBEntry {
+	return it.current
+}
+
+func (it *ssTableIterator) Err() error {
+	return it.err
+}
+
+func (it *ssTableIterator) Close() {
+	if it.file != nil {
+		it.file.release()
+		it.file = nil
+	}
+}
+
+// Scan returns an iterator over keys from the range [start, end) in the sorted order.
+// An empty end means that the range has no upper bound.
+// The iterator must be closed after use.
+func (s *Storage) Scan(start string, end string) (*Iterator, error) {
+	// the order is important: memtables are moved to the flush queue and then to SSTables,
+	// so we must take them in the same order to not miss anything.
+	memtables, err := s.readSnapshot()
+	if err != nil {
+		return nil, err
+	}
+
+	sources := []entryIterator{}
+	for _, m := range memtables {
+		sources = append(sources, newMemtableIterator(m, start, end))
+	}
+
+	// compaction can't replace files while we are holding this mutex,
+	// and once a file is opened, we can read it even after it has been replaced.
+	s.ssTablesAccessMutex.RLock()
+	defer s.ssTablesAccessMutex.RUnlock()
+	for _, t := range s.ssTables {
+		it, err := newSSTableIterator(t, start, end)
+		if err != nil {
+			for _, src := range sources {
+				src.Close()
+			}
+			return nil, fmt.Errorf("can't open sstable file=%s: %w", t.config.filename, err)
+		}
+		sources = append(sources, it)
+	}
+
+	// the garbage collection removes value log files while holding the mutex
+	values := s.values.snapshot()
+	return &Iterator{merged: newMergingIterator(sources), values: values}, nil
+}
@@ -0,0 +1,171 @@
+package lsmt
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/entry"
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/skiplist"
+	"github.com/alexander-akhmetov/mdb/pkg/test_utils"
+)
+
+// assertScan checks that Scan returns expected key-value pairs
+func assertScan(t *testing.T, storage *Storage, start string, end string, expData [][2]string) {
+	it, err := storage.Scan(start, end)
+	assert.Nil(t, err)
+	defer it.Close()
+
+	result := [][2]string{}
+	for it.Next() {
+		result = append(result, [2]string{it.Key(), it.Value()})
+	}
+	assert.Nil(t, it.Err())
+	assert.Equal(t, expData, result)
+}
+
+func TestStorageScan(t *testing.T) {
+	// keys are spread between the memtable, the flush queue and SSTables:
+	// scan must return them sorted and only the latest versions
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	createSSTable(
+		".test/lsmt_data/sstables/0.sstable",
+		[][2]string{
+			{"k1", "old"},
+			{"k2", "old"},
+			{"k5", "old"},
+			{"k7", "old"},
+		},
+	)
+	createSSTable(
+		".test/lsmt_data/sstables/1.sstable",
+		[][2]string{
+			{"k2", "sstable"},
+			{"k4", "sstable"},
+		},
+	)
+	testutils.CreateFileWithKeyValues(
+		".test/lsmt_data/aolog_tf/2.aolog",
+		[][2]string{
+			{"k3", "flush queue"},
+			{"k4", "flush queue"},
+		},
+	)
+
+	storage := &Storage{
+		Config: StorageConfig{
+			WorkDir: ".test/lsmt_data/",
+		},
+	}
+	// lock flush process to keep the flush queue
+	storage.flushMutex.Lock()
+	assert.Nil(t, storage.Start())
+	defer storage.Stop()
+	defer storage.flushMutex.Unlock()
+
+	storage.Set("k5", "memtable")
+	storage.Delete("k7")
+
+	expData := [][2]string{
+		{"k1", "old"},
+		{"k2", "sstable"},
+		{"k3", "flush queue"},
+		{"k4", "flush queue"},
+		{"k5", "memtable"},
+	}
+	assertScan(t, storage, "", "", expData)
+
+	// the end of the range is not included
+	expData = [][2]string{
+		{"k2", "sstable"},
+		{"k3", "flush queue"},
+		{"k4", "flush queue"},
+	}
+	assertScan(t, storage, "k2", "k5", expData)
+
+	assertScan(t, storage, "k8", "", [][2]string{})
+}
+
+func TestStorageScanWithSparseIndex(t *testing.T) {
+	// scan must find the start of the range in a big SSTable with a sparse index
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	data := [][2]string{
+		{"key_1", "value_1"},
+		{"key_2", "value_2"},
+		{"key_3", "value_3"},
+		{"key_4", "value_4"},
+		{"key_5", "value_5"},
+	}
+	createSSTable(".test/lsmt_data/sstables/0.sstable", data)
+
+	storage := &Storage{
+		Config: StorageConfig{
+			WorkDir:               ".test/lsmt_data/",
+			SSTableReadBufferSize: 40,
+		},
+	}
+	assert.Nil(t, storage.Start())
+	defer storage.Stop()
+
+	assertScan(t, storage, "key_22", "key_5", data[2:4])
+	assertScan(t, storage, "key_1", "", data)
+}
+
+func TestMergingIterator(t *testing.T) {
+	newer := newTestMemtableIterator([]*entry.DBEntry{
+		{Key: "a", Value: "new"},
+		{Key: "c", Type: entry.TypeTombstone},
+	})
+	older := newTestMemtableIterator([]*entry.DBEntry{
+		{Key: "a", Value: "old"},
+		{Key: "b", Value: "old"},
+		{Key: "c", Value: "old"},
+	})
+
+	it := newMergingIterator([]entryIterator{newer, older})
+
+	expEntries := []*entry.DBEntry{
+		{Key: "a", Value: "new"},
+		{Key: "b", Value: "old"},
+		{Key: "c", Type: entry.TypeTombstone},
+	}
+	for _, exp := range expEntries {
+		assert.True(t, it.Next())
+		assert.Equal(t, exp, it.Entry())
+	}
+	assert.False(t, it.Next())
+}
+
+func TestMemtableIteratorRange(t *testing.T) {
+	m := newTestMemtable([]*entry.DBEntry{
+		{Key: "d", Value: "4"},
+		{Key: "a", Value: "1"},
+		{Key: "c", Value: "3"},
+		{Key: "b", Value: "2"},
+	})
+	it := newMemtableIterator(m, "b", "d")
+
+	assert.True(t, it.Next())
+	assert.Equal(t, "b", it.Entry().Key)
+	assert.True(t, it.Next())
+	assert.Equal(t, "c", it.Entry().Key)
+	assert.False(t, it.Next())
+}
+
+// newTestMemtable returns a memtable with the given entries without AOLog.
+func newTestMemtable(entries []*entry.DBEntry) *memtable {
+	m := &memtable{data: skiplist.New()}
+	for _, e := range entries {
+		m.add(e)
+	}
+	return m
+}
+
+// newTestMemtableIterator returns an iterator over all entries of a new memtable.
+func newTestMemtableIterator(entries []*entry.DBEntry) *memtableIterator {
+	return newMemtableIterator(newTestMemtable(entries), "", "")
+}
@@ -0,0 +1,248 @@
+package lsmt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/entry"
+	"github.com/alexander-akhmetov/mdb/pkg/utils"
+)
+
+// The first version of the storage, which had no manifest, saved files without checksums:
+// its SSTables are sorted entries in the entry.DBEntry binary format one after another,
+// without blocks, an index and a footer, and its AOLog records are entries without the CRC32 prefix.
+// These files are converted to the current format once, when the storage starts in a directory without a manifest.
+
+// migrateLegacySSTables converts SSTables of the first version in the directory to the current format.
+// Tables of the current format are not changed.
+func (s *Storage) migrateLegacySSTables() error {
+	files, err := listSSTables(s.Config.ssTablesDir)
+	if err != nil {
+		return err
+	}
+
+	for _, f := range files {
+		legacy, err := isLegacySSTable(f.Name)
+		if err != nil {
+			return err
+		}
+		if !legacy {
+			continue
+		}
+
+		log.Printf("[INFO] Converting sstable=%s of the first version to the current format", f.Name)
+		err = s.convertLegacySSTable(f.Name)
+		if err != nil {
+			return fmt.Errorf("can't convert sstable=%s of the first version: %w", f.Name, err)
+		}
+	}
+	return nil
+}
+
+// isLegacySSTable returns true if the file doesn't end with the footer of the current format.
+func isLegacySSTable(filename string) (bool, error) {
+	file, err := os.OpenFile(filename, os.O_RDONLY, filePermissions)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return false, err
+	}
+	if stat.Size() < footerSize {
+		return true, nil
+	}
+
+	magic := make([]byte, 8)
+	_, err = file.ReadAt(magic, stat.Size()-int64(len(magic)))
+	if err != nil {
+		return false, err
+	}
+	return binary.BigEndian.Uint64(magic) != ssTableMagic, nil
+}
+
+// convertLegacySSTable writes entries of the table to a new level 0 table in the temporary directory
+// and replaces the old file with it. The table keeps its name, so its place in the list doesn't change.
+func (s *Storage) convertLegacySSTable(filename string) error {
+	stat, err := os.Stat(filename)
+	if err != nil {
+		return err
+	}
+
+	err = utils.CreateDir(s.Config.tmpDir)
+	if err != nil {
+		return err
+	}
+	config := s.Config.ssTableWriterConfig(0)
+	config.createdAt = stat.ModTime()
+	tmpFilename := filepath.Join(s.Config.tmpDir, filepath.Base(filename))
+	w, err := newSSTableWriter(tmpFilename, config)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+
+	end, err := scanLegacyEntries(filename, w.Add)
+	if err != nil {
+		return err
+	}
+	if end != stat.Size() {
+		return &utils.CorruptionError{Filename: filename, Offset: end, Reason: "incomplete entry"}
+	}
+
+	err = w.Finish()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, filename)
+}
+
+// migrateLegacyLogs converts AOLog files of the memtable and the flush queue
+// of the first version to the current format. Logs of the current format are not changed.
+func (s *Storage) migrateLegacyLogs() error {
+	files, err := utils.ListFilesOrdered(s.Config.memtablesFlushTmpDir, "")
+	if err != nil {
+		return err
+	}
+	filenames := []string{}
+	if _, err := os.Stat(s.Config.aoLogPath); err == nil {
+		filenames = append(filenames, s.Config.aoLogPath)
+	}
+	for _, f := range files {
+		filenames = append(filenames, f.Name)
+	}
+
+	for _, filename := range filenames {
+		legacy, err := isLegacyLog(filename)
+		if err != nil {
+			return err
+		}
+		if !legacy {
+			continue
+		}
+
+		log.Printf("[INFO] Converting AOLog=%s of the first version to the current format", filename)
+		err = s.convertLegacyLog(filename)
+		if err != nil {
+			return fmt.Errorf("can't convert AOLog=%s of the first version: %w", filename, err)
+		}
+	}
+	return nil
+}
+
+// isLegacyLog returns true if the first record of the file is not a record of the current format
+// with a correct checksum, but a complete entry of the first version.
+func isLegacyLog(filename string) (bool, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return false, err
+	}
+
+	if len(data) > checksumSize {
+		length, err := entry.BinaryLength(data[checksumSize:])
+		if err == nil && length <= len(data)-checksumSize &&
+			binary.BigEndian.Uint32(data) == checksum(data[checksumSize:checksumSize+length]) {
+			return false, nil
+		}
+	}
+
+	length, err := entry.BinaryLength(data)
+	return err == nil && data[0] == entry.TypeValue && length <= len(data), nil
+}
+
+// convertLegacyLog writes entries of the log as records of the current format to a new file
+// and replaces the old file with it. An incomplete entry at the end of the log is dropped,
+// it was being written when the process crashed.
+func (s *Storage) convertLegacyLog(filename string) error {
+	err := utils.CreateDir(s.Config.tmpDir)
+	if err != nil {
+		return err
+	}
+	tmpFilename := filepath.Join(s.Config.tmpDir, filepath.Base(filename))
+	file, err := os.OpenFile(tmpFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, filePermissions)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	writer := bufio.NewWriter(file)
+	_, err = scanLegacyEntries(filename, func(e *entry.DBEntry) error {
+		_, err := writer.Write(encodeRecord(e))
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	err = writer.Flush()
+	if err != nil {
+		return err
+	}
+	err = file.Sync()
+	if err != nil {
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpFilename, filename)
+}
+
+// scanLegacyEntries calls fn for every entry of a file of the first version
+// and returns the offset of the end of the last complete entry.
+func scanLegacyEntries(filename string, fn func(e *entry.DBEntry) error) (int64, error) {
+	file, err := os.OpenFile(filename, os.O_RDONLY, filePermissions)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReaderSize(file, defaultReadBufferSize)
+	offset := int64(0)
+	header := make([]byte, entry.HeaderSize)
+	for {
+		_, err = io.ReadFull(reader, header)
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+
+		length, err := entry.BinaryLength(header)
+		if err != nil {
+			return offset, err
+		}
+		if length > maxEntrySize {
+			return offset, &utils.CorruptionError{Filename: filename, Offset: offset, Reason: "entry is too big"}
+		}
+		data := make([]byte, length)
+		copy(data, header)
+		_, err = io.ReadFull(reader, data[len(header):])
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			return offset, nil
+		}
+		if err != nil {
+			return offset, err
+		}
+
+		e, err := entry.NewDBEntry(data)
+		if err != nil {
+			return offset, err
+		}
+		err = fn(e)
+		if err != nil {
+			return offset, err
+		}
+		offset += int64(length)
+	}
+}
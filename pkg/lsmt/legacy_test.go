@@ -0,0 +1,84 @@
+package lsmt
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/entry"
+	"github.com/alexander-akhmetov/mdb/pkg/test_utils"
+	"github.com/alexander-akhmetov/mdb/pkg/utils"
+)
+
+// createLegacyFile writes key-value pairs in the format of the first version: entries without checksums.
+func createLegacyFile(filename string, keyValues [][2]string) []byte {
+	data := []byte{}
+	for _, kv := range keyValues {
+		data = append(data, (&entry.DBEntry{Type: entry.TypeValue, Key: kv[0], Value: kv[1]}).Binary()...)
+	}
+	testutils.CreateFile(filename, string(data))
+	return data
+}
+
+func TestStorageMigratesLegacySSTables(t *testing.T) {
+	// SSTables of the first version are converted when the storage starts without a manifest
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	createLegacyFile(".test/lsmt_data/sstables/1544288836377002.sstable", [][2]string{{"k1", "old"}, {"k2", "v2"}})
+	createLegacyFile(".test/lsmt_data/sstables/1544288836377003.sstable", [][2]string{{"k1", "v1"}, {"k3", "v3"}})
+	createLegacyFile(".test/lsmt_data/sstables/1544288836377004.sstable", [][2]string{})
+
+	config := StorageConfig{WorkDir: ".test/lsmt_data/"}
+	for i := 0; i < 2; i++ {
+		storage := &Storage{Config: config}
+		assert.Nil(t, storage.Start())
+		assertValues(t, storage, map[string]string{"k1": "v1", "k2": "v2", "k3": "v3", "k4": ""})
+		assert.Equal(t, 3, len(storage.ssTables))
+		assert.Nil(t, storage.Stop())
+	}
+
+	legacy, err := isLegacySSTable(".test/lsmt_data/sstables/1544288836377002.sstable")
+	assert.Nil(t, err)
+	assert.False(t, legacy)
+}
+
+func TestStorageMigratesBrokenLegacySSTable(t *testing.T) {
+	// a table of the first version with an incomplete entry can't be converted
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	filename := ".test/lsmt_data/sstables/1.sstable"
+	data := createLegacyFile(filename, [][2]string{{"k1", "v1"}, {"k2", "v2"}})
+	testutils.CreateFile(filename, string(data[:len(data)-1]))
+
+	storage := &Storage{Config: StorageConfig{WorkDir: ".test/lsmt_data/"}}
+	err := storage.Start()
+	var corruptionErr *utils.CorruptionError
+	assert.True(t, errors.As(err, &corruptionErr))
+	assert.Equal(t, filename, corruptionErr.Filename)
+	assert.Equal(t, data[:len(data)-1], testutils.ReadFileBinary(filename))
+}
+
+func TestStorageMigratesLegacyLogs(t *testing.T) {
+	// unflushed writes of the first version are restored from AOLog files without checksums
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	createLegacyFile(".test/lsmt_data/sstables/1544288836377002.sstable", [][2]string{{"k1", "old"}, {"k2", "old"}, {"k3", "v3"}})
+	createLegacyFile(".test/lsmt_data/aolog_tf/1544288836377003.aolog", [][2]string{{"k2", "old2"}, {"k1", "v1"}})
+	data := createLegacyFile(".test/lsmt_data/log.aolog", [][2]string{{"k2", "v2"}, {"k4", "v4"}})
+	// the last entry was being written when the process crashed
+	testutils.CreateFile(".test/lsmt_data/log.aolog", string(data[:len(data)-1]))
+
+	config := StorageConfig{WorkDir: ".test/lsmt_data/"}
+	for i := 0; i < 2; i++ {
+		storage := &Storage{Config: config}
+		assert.Nil(t, storage.Start())
+		assertValues(t, storage, map[string]string{"k1": "v1", "k2": "v2", "k3": "v3", "k4": ""})
+		assert.Nil(t, storage.Stop())
+	}
+
+	assert.Equal(t, encodeRecord(&entry.DBEntry{Key: "k2", Value: "v2"}), testutils.ReadFileBinary(".test/lsmt_data/log.aolog"))
+}
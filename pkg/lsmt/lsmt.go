@@ -1,6 +1,7 @@
 package lsmt
 
 import (
+	"context"
 	"fmt"
 	"log"
 	"os"
@@ -8,22 +9,19 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/cache"
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/entry"
 	"github.com/alexander-akhmetov/mdb/pkg/utils"
 )
 
-const defaultMaxMemtableSize int64 = 256
+const defaultMaxMemtableSize int64 = 1024 * 1024 * 4
 const defaultMaxCompactFileSize int64 = 1024 * 1024 * 10
-
-// Prevents changing the memtablesFlushQueue
-var flushMutex = &sync.Mutex{}
-
-// Prevents changing the ssTables list
-var ssTablesListMutex = &sync.Mutex{}
-
-// Locks access to the ssTables list
-var ssTablesAccessMutex = &sync.Mutex{}
+const defaultBloomFilterBitsPerKey = 10
+const defaultBlockCacheSize int64 = 1024 * 1024 * 8
+const defaultWriteSlowdownDelay = time.Millisecond
 
 // StorageConfig holds all configuration of the storage
 type StorageConfig struct {
@@ -31,152 +29,376 @@ type StorageConfig struct {
 
 	CompactionEnabled     bool
 	MinimumFilesToCompact int
-	MaxMemtableSize       int64
+	MaxMemtableSize       int64 // size of the memtable in bytes which triggers the flush
 	MaxCompactFileSize    int64
-	SSTableReadBufferSize int
+	SSTableReadBufferSize int         // size of SSTable data blocks
+	BlockRestartInterval  int         // number of keys between restart points in SSTable data blocks, default is 16
+	BloomFilterBitsPerKey int         // 0 means default, negative value disables Bloom filters
+	BlockCacheSize        int64       // capacity of the SSTable block cache in bytes, 0 means default (8MB), negative value disables it
+	MaxOpenFiles          int         // number of SSTable files kept open for reads, default is 500
+	UseMmap               bool        // map SSTable files into memory instead of reading them, MaxOpenFiles isn't used then
+	Compression           Compression // compression of new SSTable blocks, the default is NoCompression
+	ParanoidChecks        bool        // verify checksums of the compaction result before using it
+
+	// SyncMode defines when AOLog is synced to disk, the default is SyncNone.
+	SyncMode     SyncMode
+	SyncInterval time.Duration // how often AOLog is synced in the SyncPeriodic mode, default is 100ms
+
+	// MaxMemtablesMemory limits the memory used by the memtable and the flush queue together, 0 means no limit.
+	// Writes wait for the flusher process while the limit is exceeded.
+	MaxMemtablesMemory int64
+
+	// Write stalls: when the flusher or the compaction fall behind, every write is delayed by WriteSlowdownDelay
+	// after a slowdown threshold and blocked after a stop threshold until the background processes catch up.
+	// 0 disables a threshold. Level 0 thresholds are used only if the compaction is enabled,
+	// the compaction strategy must implement Level0Limiter, like LeveledStrategy does,
+	// and the thresholds can't be less than its limit: Start returns an error otherwise.
+	SlowdownImmutableMemtables int
+	MaxImmutableMemtables      int
+	SlowdownLevel0Files        int
+	MaxLevel0Files             int
+	WriteSlowdownDelay         time.Duration // default is 1ms
+
+	// FlushOnStop makes Stop flush the memtable and the flush queue to SSTables,
+	// so the next start doesn't need to restore them from AOLog.
+	FlushOnStop bool
+
+	// CompactionStrategy chooses which SSTables are compacted.
+	// The default is SizeTieredStrategy with MinimumFilesToCompact and MaxCompactFileSize.
+	CompactionStrategy CompactionStrategy
+
+	// Key-value separation: values of ValueThreshold bytes or bigger are moved to the value log when the memtable
+	// is flushed, and SSTables keep only pointers to them, so the compaction doesn't rewrite big values.
+	// 0 disables the separation. The garbage collection removes value log files with ValueLogGCRatio
+	// of overwritten and deleted values or more, it's run every ValueLogGCInterval or by CollectValueLogGarbage.
+	ValueThreshold     int
+	ValueLogFileSize   int64         // a new value log file is started when the current one reaches the size, default is 64MB
+	ValueLogGCRatio    float64       // default is 0.5
+	ValueLogGCInterval time.Duration // default is 10 minutes, negative value disables the background garbage collection
 
 	pidFilePath          string
 	memtablesFlushTmpDir string
 	aoLogPath            string
+	manifestPath         string
 	ssTablesDir          string
 	tmpDir               string
+	valueLogDir          string
 }
 
-// Storage holds data in ss tables
+// Storage holds data in ss tables.
+//
+// All methods are safe for concurrent use: any number of goroutines can read and write at the same time.
+// Reads see the latest successful writes, and a write never blocks reads.
 type Storage struct {
+	// counters for write stalls, they are accessed atomically
+	// and they are the first fields to be aligned on 32-bit platforms
+	flushQueueSize   int64 // memory used by memtables of the flush queue
+	flushQueueLength int64 // number of memtables in the flush queue, including the ones which are being added
+	level0Files      int64 // number of level 0 SSTables
+	writeStallTime   int64 // total time of delayed and blocked writes in nanoseconds
+	writeSlowdowns   int64
+	writeStops       int64
+
 	Config StorageConfig
 
 	running             bool
 	memtable            *memtable
 	ssTables            []*ssTable
 	memtablesFlushQueue []*memtable
+	manifest            *manifest
+	blockCache          *cache.Cache // recently read SSTable blocks, nil if the cache is disabled
+	files               *fileCache   // open SSTable files
+	values              *valueLog    // big values, they are read even if the separation is disabled now
+
+	// All synchronization is per instance, so many storages can work in one process independently.
+	// The lock order is: valueLogGCMutex, flushMutex, stallMutex, mutex, flushQueueMutex, ssTablesListMutex,
+	// ssTablesAccessMutex.
+	mutex               sync.RWMutex // protects running and the memtable pointer, writes to the memtable hold it for reading
+	flushMutex          sync.Mutex   // only one process can flush the memtablesFlushQueue at a time
+	flushQueueMutex     sync.RWMutex // protects the memtablesFlushQueue list
+	ssTablesListMutex   sync.Mutex   // prevents changing the ssTables list
+	ssTablesAccessMutex sync.RWMutex // protects the ssTables list and its files, readers hold it for reading
+	compactionMutex     sync.Mutex   // only one compaction can run at a time
+	valueLogGCMutex     sync.Mutex   // only one value log garbage collection can run at a time
+
+	stop    chan struct{}  // is closed when the storage is stopped
+	workers sync.WaitGroup // background processes and running garbage collections of the value log
+
+	stallMutex     sync.Mutex // protects backgroundDone
+	backgroundDone *sync.Cond // signals that a flush or a compaction is done, or the storage has been stopped
+}
+
+// ssTableWriterConfig returns parameters of new SSTables of the given level.
+func (c *StorageConfig) ssTableWriterConfig(level int) ssTableWriterConfig {
+	return ssTableWriterConfig{
+		blockSize:       c.SSTableReadBufferSize,
+		restartInterval: c.BlockRestartInterval,
+		compression:     c.Compression,
+		bloomBitsPerKey: c.BloomFilterBitsPerKey,
+		level:           level,
+	}
+}
+
+// aoLogConfig returns parameters of AOLog writers.
+func (c *StorageConfig) aoLogConfig() aoLogConfig {
+	return aoLogConfig{
+		syncMode:     c.SyncMode,
+		syncInterval: c.SyncInterval,
+	}
 }
 
 // Set saves the given key and value.
-func (s *Storage) Set(key string, value string) {
-	s.flushmemtableIfNeeded()
-	s.memtable.Set(key, value)
+func (s *Storage) Set(key string, value string) error {
+	return s.write(func(m *memtable) error {
+		return m.Set(key, value)
+	})
+}
+
+// write prepares the storage for a write and applies it to the current memtable.
+//
+// The memtable can't be replaced while the write holds the mutex for reading,
+// so the change never goes to a memtable which is already in the flush queue.
+// Concurrent writes hold the mutex together and share AOLog writes and syncs.
+func (s *Storage) write(apply func(m *memtable) error) error {
+	err := s.flushmemtableIfNeeded()
+	if err != nil {
+		return err
+	}
+	err = s.makeRoomForWrite()
+	if err != nil {
+		return err
+	}
+
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if !s.running {
+		return utils.ErrClosed
+	}
+	return apply(s.memtable)
 }
 
 // flushmemtableIfNeeded checks if the memtable is bigger than the limit size and puts it into the flush queue if yes.
-func (s *Storage) flushmemtableIfNeeded() {
-	if s.memtable.Size() > s.Config.MaxMemtableSize {
-		log.Println("[DEBUG] memtable is too big: putting it to flush queue")
-
-		memtable := s.memtable
-		memtable.timestamp = time.Now().UnixNano()
-		newLogPath := filepath.Join(
-			s.Config.memtablesFlushTmpDir,
-			fmt.Sprintf("%v.aolog", memtable.timestamp),
-		)
-		log.Println("[DEBUG] Moving AOLog to a new path=", newLogPath)
-		os.Rename(memtable.logFilename, newLogPath)
+func (s *Storage) flushmemtableIfNeeded() error {
+	m, err := s.currentMemtable()
+	if err != nil {
+		return err
+	}
+	if m.Size() <= s.Config.MaxMemtableSize {
+		return nil
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.running {
+		return utils.ErrClosed
+	}
+	// another write could rotate the memtable while we were waiting for the mutex
+	if s.memtable != m {
+		return nil
+	}
+
+	log.Println("[DEBUG] memtable is too big: putting it to flush queue")
+
+	return s.rotateMemtable()
+}
+
+// currentMemtable returns the memtable which receives writes now.
+func (s *Storage) currentMemtable() (*memtable, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if !s.running {
+		return nil, utils.ErrClosed
+	}
+	return s.memtable, nil
+}
+
+// isRunning returns true if the storage is started and not stopped yet.
+func (s *Storage) isRunning() bool {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	return s.running
+}
 
-		s.initNewMemtable()
+// readSnapshot returns the memtable and the flush queue, newest first.
+// They are taken together, so a memtable which is being moved to the flush queue is never missed.
+func (s *Storage) readSnapshot() ([]*memtable, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if !s.running {
+		return nil, utils.ErrClosed
+	}
+	return append([]*memtable{s.memtable}, s.flushQueueSnapshot()...), nil
+}
 
-		memtable.logFilename = newLogPath
-		go s.appendToFlushQueue(memtable)
+// rotateMemtable moves the memtable with its AOLog to the flush queue and initializes a new memtable.
+// The mutex must be locked by the caller.
+func (s *Storage) rotateMemtable() error {
+	memtable := s.memtable
+	fileNumber := s.manifest.newFileNumber()
+	newLogPath := filepath.Join(
+		s.Config.memtablesFlushTmpDir,
+		fmt.Sprintf("%v.aolog", fileNumber),
+	)
+	log.Println("[DEBUG] Moving AOLog to a new path=", newLogPath)
+	err := os.Rename(memtable.logFilename, newLogPath)
+	if err != nil {
+		return err
 	}
+	memtable.fileNumber = fileNumber
+	memtable.logFilename = newLogPath
+
+	// If we can't create a new memtable, the old one keeps working with the moved log:
+	// it will be restored to the flush queue after restart.
+	m, err := newMemtable(s.Config.aoLogPath, s.Config.aoLogConfig())
+	if err != nil {
+		return err
+	}
+
+	atomic.AddInt64(&s.flushQueueSize, memtable.Size())
+	atomic.AddInt64(&s.flushQueueLength, 1)
+	s.prependToFlushQueue(memtable)
+	s.memtable = m
+	return nil
 }
 
-// appendToFlushQueue inserts wmemtable into the memtablesFlushQueue at the first place (prepend).
+// prependToFlushQueue inserts the memtable into the memtablesFlushQueue at the first place.
 // We need to keep the memtablesFlushQueue ordered by memtable age (descending order: newest first),
 // so we will check memtables from the beginning if we want to find some key.
-func (s *Storage) appendToFlushQueue(m *memtable) {
-	// we must lock this mutex to obtain exclusive access to the flush queue
-	flushMutex.Lock()
-	defer flushMutex.Unlock()
+func (s *Storage) prependToFlushQueue(m *memtable) {
+	s.flushQueueMutex.Lock()
+	defer s.flushQueueMutex.Unlock()
 
 	// this memtable is newer than other in the memtablesFlushQueue
 	// so put it to the beginning of the queue
 	s.memtablesFlushQueue = append([]*memtable{m}, s.memtablesFlushQueue...)
 }
 
+// flushQueueSnapshot returns the current list of memtables in the flush queue.
+// The list is never changed in place, so it's safe to use it without locks.
+func (s *Storage) flushQueueSnapshot() []*memtable {
+	s.flushQueueMutex.RLock()
+	defer s.flushQueueMutex.RUnlock()
+
+	return s.memtablesFlushQueue
+}
+
+// Delete removes the given key.
+// It writes a tombstone which hides all older versions of the key,
+// the compaction process removes them later.
+func (s *Storage) Delete(key string) error {
+	return s.write(func(m *memtable) error {
+		return m.Delete(key)
+	})
+}
+
+// Write applies all changes from the batch atomically.
+func (s *Storage) Write(batch *WriteBatch) error {
+	if batch.Len() == 0 {
+		if !s.isRunning() {
+			return utils.ErrClosed
+		}
+		return nil
+	}
+
+	return s.write(func(m *memtable) error {
+		return m.applyBatch(batch.entries)
+	})
+}
+
 // Get returns a value for the given key and a boolean indicator of whether the key exists.
-func (s *Storage) Get(key string) (value string, exists bool) {
-	value, exists = s.memtable.Get(key)
+func (s *Storage) Get(key string) (value string, exists bool, err error) {
+	// the memtables are taken before the SSTables: a flushed memtable is removed
+	// from the flush queue only after its SSTable is added to the list, so no key is missed.
+	memtables, err := s.readSnapshot()
+	if err != nil {
+		return "", false, err
+	}
+
+	e, found := getFromMemtables(memtables, key)
 
-	if !exists {
-		log.Printf("[DEBUG] key=%s has NOT been found in the memtable, searching in the FlushQueue...", key)
-		value, exists = s.getFromFlushQueue(key)
+	if !found {
+		log.Printf("[DEBUG] key=%s has NOT been found in the memtables, searching in the SSTables...", key)
+		e, found, err = s.getFromSSTables(key)
 	}
 
-	if !exists {
-		log.Printf("[DEBUG] key=%s has NOT been found in the FlushQueue, searching in the SSTables...", key)
-		value, exists = s.getFromSSTables(key)
+	// the latest version of the key is a tombstone: the key has been deleted
+	if err != nil || !found || e.IsTombstone() {
+		return "", false, err
 	}
 
-	return value, exists
+	return e.Value, true, nil
 }
 
-// getFromFlushQueue tries to find the given key in the flush queue memtables.
-func (s *Storage) getFromFlushQueue(key string) (string, bool) {
-	value := ""
-	found := false
-
-	for _, fq := range s.memtablesFlushQueue {
-		value, found = fq.Get(key)
+// getFromMemtables tries to find the given key in the memtables, they must be ordered newest first.
+func getFromMemtables(memtables []*memtable, key string) (*entry.DBEntry, bool) {
+	for i, m := range memtables {
+		e, found := m.Get(key)
 		if found {
-			log.Printf("[DEBUG] key=%s has been found in the flush queue=%v", key, fq.timestamp)
-			return value, found
+			// the file number of the memtable is changed when it's moved to the flush queue, it can't be read here
+			log.Printf("[DEBUG] key=%s has been found in the memtable=%v of the snapshot", key, i)
+			return e, found
 		}
 	}
 
-	log.Printf("[DEBUG] key=%s has NOT been found in the flush queue", key)
+	log.Printf("[DEBUG] key=%s has NOT been found in the memtables", key)
 
-	return value, found
+	return nil, false
 }
 
 // getFromSSTables tries to find the given key in the SSTables.
-// It searches for keys in parallel in all SSTables.
-func (s *Storage) getFromSSTables(key string) (string, bool) {
-	value := ""
-	found := false
-
-	ssTablesAccessMutex.Lock()
-	defer ssTablesAccessMutex.Unlock()
-
-	type result struct {
-		position int
-		value    string
+// If the value of the key is in the value log, it's read from there.
+func (s *Storage) getFromSSTables(key string) (*entry.DBEntry, bool, error) {
+	// the compaction can't remove files while we are reading them,
+	// and the garbage collection can't remove value log files
+	s.ssTablesAccessMutex.RLock()
+	defer s.ssTablesAccessMutex.RUnlock()
+
+	e, found, err := s.findInSSTables(key)
+	if err != nil || !found || e.Type != entry.TypeValuePointer {
+		return e, found, err
 	}
-
-	queue := make(chan result, len(s.ssTables))
-
-	var wg sync.WaitGroup
-	wg.Add(len(s.ssTables))
-
-	for i, st := range s.ssTables {
-		go func(i int, st *ssTable) {
-			defer wg.Done()
-			value, found = st.Get(key)
-			if found {
-				queue <- result{position: i, value: value}
-			}
-		}(i, st)
+	p, err := pointerOf(e)
+	if err != nil {
+		return nil, false, err
+	}
+	value, err := s.values.read(key, p)
+	if err != nil {
+		return nil, false, err
 	}
+	return &entry.DBEntry{Type: entry.TypeValue, Key: key, Value: value}, true, nil
+}
 
-	wg.Wait()
-	close(queue)
-
-	foundAt := len(s.ssTables)
-	for elem := range queue {
-		if elem.position <= foundAt {
-			value = elem.value
-			found = true
-			foundAt = elem.position
+// findInSSTables returns the latest version of the key from the SSTables as it's stored there.
+// Tables are checked one by one in the search order, newest first, and the search stops at the first table
+// which has the key. Tables whose key range doesn't cover the key are skipped without reading them,
+// so usually only a few tables are read: at most one per level starting from level 1.
+// ssTablesAccessMutex must be locked for reading by the caller.
+func (s *Storage) findInSSTables(key string) (*entry.DBEntry, bool, error) {
+	for _, t := range s.ssTables {
+		if !t.mayContain(key) {
+			continue
 		}
-	}
 
-	if !found {
-		log.Printf("[DEBUG] key=%s has NOT been found in the sstables", key)
+		// if a table can't be read, we can't be sure that older tables have the latest version of the key
+		e, found, err := t.Get(key)
+		if err != nil {
+			return nil, false, err
+		}
+		if found {
+			log.Printf("[DEBUG] key=%s has been found in the sstable=%s", key, t.config.filename)
+			return e, true, nil
+		}
 	}
 
-	return value, found
+	log.Printf("[DEBUG] key=%s has NOT been found in the sstables", key)
+	return nil, false, nil
 }
 
 // Start initializes Storage
-func (s *Storage) Start() {
+func (s *Storage) Start() error {
 	log.Println("[INFO] Starting lsmt storage")
 
 	if s.Config.MaxMemtableSize == 0 {
@@ -190,229 +412,623 @@ func (s *Storage) Start() {
 		s.Config.MinimumFilesToCompact = 2
 	}
 
+	if s.Config.SSTableReadBufferSize == 0 {
+		s.Config.SSTableReadBufferSize = defaultReadBufferSize
+	}
+
+	if s.Config.BloomFilterBitsPerKey == 0 {
+		s.Config.BloomFilterBitsPerKey = defaultBloomFilterBitsPerKey
+	}
+
+	if !s.Config.Compression.isSupported() {
+		return fmt.Errorf("unsupported compression=%v", s.Config.Compression)
+	}
+	if s.Config.UseMmap && !mmapSupported {
+		return fmt.Errorf("mmap is not supported on this platform")
+	}
+
+	if s.Config.BlockCacheSize == 0 {
+		s.Config.BlockCacheSize = defaultBlockCacheSize
+	}
+	if s.Config.BlockCacheSize > 0 {
+		s.blockCache = cache.New(s.Config.BlockCacheSize)
+	}
+
+	if s.Config.MaxOpenFiles <= 0 {
+		s.Config.MaxOpenFiles = defaultMaxOpenFiles
+	}
+	s.files = newFileCache(s.Config.MaxOpenFiles)
+
+	if s.Config.WriteSlowdownDelay == 0 {
+		s.Config.WriteSlowdownDelay = defaultWriteSlowdownDelay
+	}
+
+	if s.Config.ValueLogFileSize == 0 {
+		s.Config.ValueLogFileSize = defaultValueLogFileSize
+	}
+	if s.Config.ValueLogGCRatio == 0 {
+		s.Config.ValueLogGCRatio = defaultValueLogGCRatio
+	}
+	if s.Config.ValueLogGCInterval == 0 {
+		s.Config.ValueLogGCInterval = defaultValueLogGCInterval
+	}
+
+	if s.Config.CompactionStrategy == nil {
+		s.Config.CompactionStrategy = &SizeTieredStrategy{
+			MinimumFilesToCompact: s.Config.MinimumFilesToCompact,
+			MaxFileSize:           s.Config.MaxCompactFileSize,
+		}
+	}
+	err := s.Config.checkLevel0Thresholds()
+	if err != nil {
+		return err
+	}
+
 	s.Config.memtablesFlushTmpDir = filepath.Join(s.Config.WorkDir, "aolog_tf")
 	s.Config.aoLogPath = filepath.Join(s.Config.WorkDir, "log.aolog")
 	s.Config.ssTablesDir = filepath.Join(s.Config.WorkDir, "sstables")
 	s.Config.tmpDir = filepath.Join(s.Config.WorkDir, "tmp")
 	s.Config.pidFilePath = filepath.Join(s.Config.WorkDir, "mdb.pid")
+	s.Config.manifestPath = filepath.Join(s.Config.WorkDir, "MANIFEST")
+	s.Config.valueLogDir = filepath.Join(s.Config.WorkDir, "vlog")
+	s.backgroundDone = sync.NewCond(&s.stallMutex)
 
-	s.createWorkDirs()
-	utils.CheckAndCreatePIDFile(s.Config.pidFilePath)
+	err = s.createWorkDirs()
+	if err != nil {
+		return err
+	}
 
-	os.RemoveAll(s.Config.tmpDir) // clean tmp dir
+	err = utils.CheckAndCreatePIDFile(s.Config.pidFilePath)
+	if err != nil {
+		return err
+	}
 
-	s.restoreSSTables()
-	s.restoreFlushQueue()
-	s.initNewMemtable()
+	err = s.restore()
+	if err != nil {
+		utils.RemovePIDFile(s.Config.pidFilePath)
+		return err
+	}
 
+	s.mutex.Lock()
 	s.running = true
+	s.mutex.Unlock()
+	s.stop = make(chan struct{})
+	s.workers.Add(1)
 	go s.startFlusherProcess()
 
 	if s.Config.CompactionEnabled {
+		s.workers.Add(1)
 		go s.startCompactionProcess()
 	} else {
 		log.Println("[DEBUG] Compaction disabled")
 	}
 
+	if s.Config.ValueLogGCInterval > 0 {
+		s.workers.Add(1)
+		go s.startValueLogGCProcess()
+	}
+
 	log.Println("[INFO] Storage ready")
+	return nil
+}
+
+// restore cleans the temporary directory and restores SSTables, the flush queue and the memtable from disk.
+func (s *Storage) restore() error {
+	err := os.RemoveAll(s.Config.tmpDir) // clean tmp dir
+	if err != nil {
+		return err
+	}
+
+	s.values, err = openValueLog(s.Config.valueLogDir, s.Config.ValueLogFileSize)
+	if err != nil {
+		return fmt.Errorf("can't open value log: %w", err)
+	}
+
+	err = s.restoreSSTables()
+	if err != nil {
+		return err
+	}
+
+	err = s.restoreFlushQueue()
+	if err != nil {
+		return err
+	}
+
+	return s.initNewMemtable()
 }
 
 // restoreFlushQueue reads the flush queue directory and restores memtables
 // from files (aolog) in this directory to the memtablesFlushQueue.
-func (s *Storage) restoreFlushQueue() {
+func (s *Storage) restoreFlushQueue() error {
 	log.Println("[DEBUG] Restoring flush queue...")
-	files := utils.ListFilesOrdered(s.Config.memtablesFlushTmpDir, "")
+	files, err := utils.ListFilesOrdered(s.Config.memtablesFlushTmpDir, "")
+	if err != nil {
+		return err
+	}
+
 	for _, f := range files {
 		log.Println("[DEBUG] Found flush queue alog = ", f.Name)
 
-		wb := newMemtable(f.Name)
-		timestamp, err := strconv.ParseInt(strings.Split(filepath.Base(f.Name), ".")[0], 10, 64)
+		fileNumber, err := strconv.ParseInt(strings.Split(filepath.Base(f.Name), ".")[0], 10, 64)
 		if err != nil {
-			log.Panic("[ERROR] Can not read flush queue file = ", f.Name, err)
+			return fmt.Errorf("can not read flush queue file=%s: %v: %w", f.Name, err, utils.ErrCorrupted)
+		}
+		s.manifest.markFileNumberUsed(fileNumber)
+
+		// The process crashed after the memtable had been flushed, but before its log was removed.
+		// Flushing it again would replace the live table and add it to the list twice.
+		if s.manifest.isLive(fmt.Sprintf("%v.sstable", fileNumber)) {
+			log.Printf("[WARN] Memtable of AOLog=%s has been flushed already, removing the log", f.Name)
+			err = os.Remove(f.Name)
+			if err != nil {
+				return err
+			}
+			continue
 		}
-		wb.timestamp = timestamp
+
+		wb, err := newMemtable(f.Name, s.Config.aoLogConfig())
+		if err != nil {
+			return err
+		}
+		wb.fileNumber = fileNumber
+		s.flushQueueSize += wb.Size()
+		s.flushQueueLength++
 		// files are already ordered by name in descending order, put this file to the end of the list
 		s.memtablesFlushQueue = append(s.memtablesFlushQueue, wb)
 	}
 	log.Println("[DEBUG] Flush queue has been restored with size=", len(s.memtablesFlushQueue))
+	return nil
 }
 
 // initNewMemtable initializes a new memtable for the storage.
-func (s *Storage) initNewMemtable() {
-	s.memtable = newMemtable(s.Config.aoLogPath)
+func (s *Storage) initNewMemtable() error {
+	m, err := newMemtable(s.Config.aoLogPath, s.Config.aoLogConfig())
+	if err != nil {
+		return err
+	}
+	s.memtable = m
+	return nil
 }
 
 // createWorkDirs creates the necessary directories.
-func (s *Storage) createWorkDirs() {
+func (s *Storage) createWorkDirs() error {
 	dirs := []string{s.Config.ssTablesDir, s.Config.memtablesFlushTmpDir, s.Config.tmpDir}
 	for _, dir := range dirs {
 		log.Println("[DEBUG] Creating dir", dir)
-		utils.CreateDir(dir)
+		err := utils.CreateDir(dir)
+		if err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-// restoreSSTables reads the directory with SSTables and restores them to the `ssTables` attribute.
-func (s *Storage) restoreSSTables() {
-
-	type result struct {
-		position int
-		table    *ssTable
+// restoreSSTables reads the manifest and restores live SSTables to the `ssTables` attribute.
+// Files which are not in the manifest are left after a crash, they are removed.
+// If there is no manifest, the storage is new or has been created by the first version:
+// SSTables and AOLog files of the first version are converted to the current format,
+// all SSTables from the directory are used and the manifest is created.
+func (s *Storage) restoreSSTables() error {
+	metas, nextFileNumber, err := readManifest(s.Config.manifestPath)
+	fromManifest := err == nil
+	if os.IsNotExist(err) {
+		log.Println("[INFO] Manifest does not exist, creating it from the SSTables directory")
+		err = s.migrateLegacySSTables()
+		if err != nil {
+			return err
+		}
+		err = s.migrateLegacyLogs()
+		if err != nil {
+			return err
+		}
+		metas, nextFileNumber, err = listSSTablesMeta(s.Config.ssTablesDir)
+	}
+	if err != nil {
+		return fmt.Errorf("can't read manifest: %w", err)
 	}
 
-	tablesToRestore := listSSTables(s.Config.ssTablesDir)
+	filenames := []string{}
+	for name := range metas {
+		filename := filepath.Join(s.Config.ssTablesDir, name)
+		if _, err := os.Stat(filename); os.IsNotExist(err) {
+			return &utils.CorruptionError{
+				Filename: s.Config.manifestPath,
+				Reason:   fmt.Sprintf("sstable=%s does not exist", filename),
+			}
+		}
+		filenames = append(filenames, filename)
+	}
 
 	// since ssTables is nil before here
-	s.ssTables = make([]*ssTable, len(tablesToRestore))
+	s.ssTables = make([]*ssTable, len(filenames))
+	errs := make([]error, len(filenames))
 
 	var wg sync.WaitGroup
-	wg.Add(len(tablesToRestore))
+	wg.Add(len(filenames))
 
 	// initialize ssTables in parallel
-	for i, file := range tablesToRestore {
-		// Files are already ordered by name in descending order.
-		// Later, we will put this file at the end of the list.
+	for i, filename := range filenames {
 		go func(position int, filename string) {
 			defer wg.Done()
-			s.ssTables[position] = newSSTable(
+			s.ssTables[position], errs[position] = newSSTable(
 				&ssTableConfig{
-					filename:       filename,
-					readBufferSize: s.Config.SSTableReadBufferSize,
+					filename:   filename,
+					blockCache: s.blockCache,
+					files:      s.files,
+					mmap:       s.Config.UseMmap,
 				},
 			)
-		}(i, file.Name)
+		}(i, filename)
 	}
 
 	wg.Wait()
 
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+
+	for _, t := range s.ssTables {
+		name := filepath.Base(t.config.filename)
+		if fromManifest {
+			t.level = metas[name].level
+			t.seq = metas[name].seq
+		} else {
+			metas[name] = tableMeta{level: t.level, seq: t.seq}
+		}
+	}
+	sortSSTables(s.ssTables)
+	s.level0Files = countLevel0Files(s.ssTables)
+
+	s.manifest, err = newManifest(s.Config.manifestPath, metas, nextFileNumber)
+	if err != nil {
+		return err
+	}
+
+	err = s.manifest.removeOrphans(s.Config.ssTablesDir)
+	if err != nil {
+		return err
+	}
+
 	log.Println("[DEBUG] initialized sstables:", len(s.ssTables))
+	return nil
+}
+
+// listSSTablesMeta returns all SSTables from the directory for a new manifest
+// and the next file number. The levels of the tables are read later from the files.
+func listSSTablesMeta(dir string) (map[string]tableMeta, int64, error) {
+	files, err := listSSTables(dir)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	metas := map[string]tableMeta{}
+	nextFileNumber := int64(1)
+	for _, f := range files {
+		name := filepath.Base(f.Name)
+		number, _ := strconv.ParseInt(strings.Split(name, ".")[0], 10, 64)
+		metas[name] = tableMeta{seq: number}
+		if number >= nextFileNumber {
+			nextFileNumber = number + 1
+		}
+	}
+	return metas, nextFileNumber, nil
 }
 
 // startFlusherProcess starts the flusher process, which checks
 // if we need to flush some memtable and flushes it if needed.
+// It exits when the storage is stopped.
 func (s *Storage) startFlusherProcess() {
+	defer s.workers.Done()
+
 	log.Println("[DEBUG] Started flusher process")
-	for s.running == true {
-		// Lock the mutex so that no new memtables are added
+	for {
+		// Lock the mutex so that nobody else flushes the queue
 		// while we are dumping memtables to disk.
-		// This ensures that we can flush the entire queue and clean it.
-		flushMutex.Lock()
-
-		// FIFO: We iterate in reverse order to dump the oldest memtables to disk first.
-		// This allows us to serve read requests correctly: we search in the main memtable first,
-		// then in the "memtables to flush" queue from top to bottom (newest first),
-		// and finally in SSTables.
-		for i := len(s.memtablesFlushQueue) - 1; i >= 0; i-- {
-			f := newFlusher(s.memtablesFlushQueue[i], s.Config.ssTablesDir)
-			filename := f.flush()
-			// It is the newest SSTable, so put it at the beginning of the list.
-			ssTablesListMutex.Lock()
-			newt := newSSTable(
-				&ssTableConfig{
-					filename:       filename,
-					readBufferSize: s.Config.SSTableReadBufferSize,
-				},
-			)
-			s.ssTables = append([]*ssTable{newt}, s.ssTables...)
-			ssTablesListMutex.Unlock()
-		}
+		s.flushMutex.Lock()
 
-		// Clean the flush queue since we flushed all memtables and
-		// the mutex prevents other goroutines from adding new items to this queue.
-		s.memtablesFlushQueue = []*memtable{}
+		err := s.flushQueue()
+		if err != nil {
+			log.Printf("[ERROR] Can't flush memtable, will try again later: %v", err)
+		}
 
 		// Unlock the mutex and sleep for some time.
-		flushMutex.Unlock()
-		time.Sleep(time.Millisecond * 100)
+		s.flushMutex.Unlock()
+		select {
+		case <-s.stop:
+			log.Println("[DEBUG] Stopped flusher process")
+			return
+		case <-time.After(time.Millisecond * 100):
+		}
 	}
 }
 
-func (s *Storage) startCompactionProcess() {
-	log.Println("[DEBUG] Started compaction process")
+// flushQueue dumps all memtables from the flush queue to disk.
+// flushMutex must be locked by the caller.
+func (s *Storage) flushQueue() error {
+	// FIFO: We dump the oldest memtables (from the end of the queue) to disk first.
+	// This allows us to serve read requests correctly: we search in the main memtable first,
+	// then in the "memtables to flush" queue from top to bottom (newest first),
+	// and finally in SSTables.
+	// New memtables are added to the beginning of the queue while we are flushing it,
+	// they are flushed the next time.
+	for n := len(s.flushQueueSnapshot()); n > 0; n-- {
+		queue := s.flushQueueSnapshot()
+		m := queue[len(queue)-1]
+		f := newFlusher(m, s.Config.ssTablesDir, s.Config.ssTableWriterConfig(0))
+		if s.Config.ValueThreshold > 0 {
+			f.values = s.values
+			f.valueThreshold = s.Config.ValueThreshold
+		}
+		filename, err := f.flush()
+		if err != nil {
+			return err
+		}
 
-	// We need to merge two files together and place the result file in the temporary directory.
-	// Then we lock ssTables to ensure exclusive access to change it,
-	// and move the result file to the location of the second merged one.
-	// We do this because the second file is newer,
-	// and even if something goes wrong, we won't lose data.
-	//
-	// After moving the result file, we can remove the first merged file as we don't need it anymore.
-	// Then we remove its ssTable instance from the list.
-	// However, we already don't use it automatically since all newer keys are in the newer file.
-	for s.running == true {
-		firstMerged, secondMerged, resultFile, isMerged := compact(
-			s.Config.ssTablesDir,
-			s.Config.tmpDir,
-			s.Config.MinimumFilesToCompact,
-			s.Config.MaxCompactFileSize,
+		newt, err := newSSTable(
+			&ssTableConfig{
+				filename:   filename,
+				blockCache: s.blockCache,
+				files:      s.files,
+				mmap:       s.Config.UseMmap,
+			},
 		)
-		if isMerged {
-			ssTablesListMutex.Lock()
+		if err != nil {
+			return err
+		}
 
-			// find ssTables which we need to remove
-			firstIndex := s.findSSTableIndex(firstMerged)
-			secondIndex := s.findSSTableIndex(secondMerged)
+		err = s.manifest.apply(&versionEdit{
+			added: map[string]tableMeta{filepath.Base(filename): {level: newt.level, seq: newt.seq}},
+		})
+		if err != nil {
+			return err
+		}
 
-			// initiate it to pre-build index
-			newSSTable := newSSTable(
-				&ssTableConfig{
-					filename:       resultFile,
-					readBufferSize: s.Config.SSTableReadBufferSize,
-				},
-			)
+		// It is the newest SSTable, so put it at the beginning of the list.
+		s.ssTablesListMutex.Lock()
+		s.ssTablesAccessMutex.Lock()
+		s.ssTables = append([]*ssTable{newt}, s.ssTables...)
+		s.ssTablesAccessMutex.Unlock()
+		s.ssTablesListMutex.Unlock()
+		atomic.AddInt64(&s.level0Files, 1)
+
+		// The table is in the manifest, we don't need the log anymore.
+		f.removeLog()
+
+		// The memtable is flushed, it's still the last one in the queue, so we can remove it.
+		s.flushQueueMutex.Lock()
+		s.memtablesFlushQueue = s.memtablesFlushQueue[:len(s.memtablesFlushQueue)-1]
+		s.flushQueueMutex.Unlock()
+		atomic.AddInt64(&s.flushQueueSize, -m.Size())
+		atomic.AddInt64(&s.flushQueueLength, -1)
+		s.notifyBackgroundDone()
+
+		// the memtable doesn't hide the values from the garbage collection anymore
+		s.values.commit()
+	}
 
-			file, _ := os.Open(resultFile)
-			defer file.Close()
+	return nil
+}
 
-			ssTablesAccessMutex.Lock()
-			// Move the result file to the location of the second merged file.
-			err := os.Rename(resultFile, secondMerged)
-			if err != nil {
-				log.Printf("[ERROR] Can't move merged file from '%s' to '%s': %v", resultFile, secondMerged, err)
-				ssTablesAccessMutex.Unlock()
-				continue
-			}
-			s.ssTables[secondIndex].index = newSSTable.index
+// startCompactionProcess merges SSTables in the background until the storage is stopped.
+// A running compaction is always finished before the process exits.
+func (s *Storage) startCompactionProcess() {
+	defer s.workers.Done()
 
-			// remove the first merged file
-			// https://github.com/golang/go/wiki/SliceTricks : delete without memory leak
-			copy(s.ssTables[firstIndex:], s.ssTables[firstIndex+1:])
-			s.ssTables[len(s.ssTables)-1] = nil
-			s.ssTables = s.ssTables[:len(s.ssTables)-1]
+	log.Println("[DEBUG] Started compaction process")
+	for {
+		select {
+		case <-s.stop:
+			log.Println("[DEBUG] Stopped compaction process")
+			return
+		default:
+		}
 
-			ssTablesAccessMutex.Unlock()
+		task, err := s.compactOnce()
+		if err != nil {
+			log.Printf("[ERROR] Compaction failed: %v", err)
+		}
 
-			err = os.Remove(firstMerged)
-			if err != nil {
-				log.Printf("[ERROR] Can't remove merged file from '%s': %v", firstMerged, err)
-				ssTablesListMutex.Unlock()
-				continue
-			}
-			ssTablesListMutex.Unlock()
-			log.Println("[DEBUG] Compaction completed")
-		} else {
+		if err != nil || task == nil {
 			// If we didn't merge files, let's sleep.
 			// But if we just merged files, we want to check if we need to merge them again.
-			time.Sleep(time.Millisecond * 100)
+			select {
+			case <-s.stop:
+			case <-time.After(time.Millisecond * 100):
+			}
 		}
 	}
 }
 
-// findSSTableIndex returns the index of an SSTable in the ssTables list.
-func (s *Storage) findSSTableIndex(filename string) int {
-	index := -1
+// compactOnce runs one compaction if the strategy finds something to compact
+// and replaces the merged tables with the result. It returns nil if there was nothing to compact.
+func (s *Storage) compactOnce() (*compactionTask, error) {
+	s.compactionMutex.Lock()
+	defer s.compactionMutex.Unlock()
+
+	s.ssTablesListMutex.Lock()
+	tables := append([]*ssTable{}, s.ssTables...)
+	s.ssTablesListMutex.Unlock()
+
+	task, results, err := compact(&s.Config, s.manifest, tables)
+	if err == nil && task != nil {
+		err = s.replaceMergedSSTables(task, results)
+	}
+	return task, err
+}
+
+// replaceMergedSSTables replaces merged SSTables with the result of the compaction.
+//
+// We merge files together and place the result files in the temporary directory.
+// Then we lock ssTables to ensure exclusive access to change it,
+// and move the result files to the SSTables directory.
+// The change is saved to the manifest, and only then we change the list of tables:
+// if the process crashes before that, the result files are removed on start,
+// and the merged files are still used.
+//
+// After saving the change, we can remove the merged files as we don't need them anymore.
+func (s *Storage) replaceMergedSSTables(task *compactionTask, results []string) error {
+	s.ssTablesListMutex.Lock()
+	defer s.ssTablesListMutex.Unlock()
+
+	edit := &versionEdit{added: map[string]tableMeta{}}
+
+	// initiate them to pre-build indexes
+	newTables := make([]*ssTable, 0, len(results))
+	for _, resultFile := range results {
+		t, err := newSSTable(
+			&ssTableConfig{
+				filename:   resultFile,
+				blockCache: s.blockCache,
+				files:      s.files,
+				mmap:       s.Config.UseMmap,
+			},
+		)
+		if err != nil {
+			return err
+		}
+		t.seq = task.seq
 
-	for i, t := range s.ssTables {
-		if t.config.filename == filename {
-			index = i
-			break
+		path := filepath.Join(s.Config.ssTablesDir, filepath.Base(resultFile))
+		err = os.Rename(resultFile, path)
+		if err != nil {
+			return fmt.Errorf("can't move merged file from '%s' to '%s': %w", resultFile, path, err)
 		}
+		t.config.filename = path
+
+		newTables = append(newTables, t)
+		edit.added[filepath.Base(path)] = tableMeta{level: t.level, seq: t.seq}
+	}
+	for _, t := range task.inputs {
+		edit.removed = append(edit.removed, filepath.Base(t.config.filename))
+	}
+
+	err := s.manifest.apply(edit)
+	if err != nil {
+		return err
 	}
 
-	return index
+	tables := newTables
+	for _, t := range s.ssTables {
+		if !task.isInput(t) {
+			tables = append(tables, t)
+		}
+	}
+	sortSSTables(tables)
+
+	s.ssTablesAccessMutex.Lock()
+	s.ssTables = tables
+	s.ssTablesAccessMutex.Unlock()
+	atomic.StoreInt64(&s.level0Files, countLevel0Files(tables))
+	s.notifyBackgroundDone()
+
+	// nobody reads the merged tables anymore, so their blocks can't get back to the cache
+	for _, t := range task.inputs {
+		t.retire()
+		err := os.Remove(t.config.filename)
+		if err != nil {
+			// it will be removed on start
+			log.Printf("[ERROR] Can't remove merged file '%s': %v", t.config.filename, err)
+		}
+	}
+	log.Println("[DEBUG] Compaction completed")
+	return nil
+}
+
+// Stop stops the storage, it waits for the background processes without a timeout.
+func (s *Storage) Stop() error {
+	return s.Close(context.Background())
 }
 
-// Stop stops the storage
-func (s *Storage) Stop() {
-	utils.RemovePIDFile(s.Config.pidFilePath)
+// Close stops the storage gracefully: it stops the background processes and waits until they exit,
+// flushes all memtables to SSTables if FlushOnStop is set, and closes all files.
+// The storage doesn't touch any files after Close returns without an error.
+//
+// If the context is done before the background processes exit, Close returns the error of the context.
+// The running flush or compaction can't be interrupted safely, so the files are closed when it's finished.
+func (s *Storage) Close(ctx context.Context) error {
+	// it waits for the writes which are being applied to the memtable
+	s.mutex.Lock()
+	if !s.running {
+		s.mutex.Unlock()
+		return nil
+	}
 	s.running = false
+	s.mutex.Unlock()
+
+	close(s.stop)
+	s.notifyBackgroundDone()
+
+	done := make(chan error, 1)
+	go func() {
+		s.workers.Wait()
+		done <- s.closeFiles()
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return fmt.Errorf("background processes are still running: %w", ctx.Err())
+	}
+}
+
+// closeFiles flushes memtables if it's needed and closes all files of the storage.
+// The background processes must be stopped.
+func (s *Storage) closeFiles() error {
+	if s.Config.FlushOnStop {
+		err := s.flushAll()
+		if err != nil {
+			return fmt.Errorf("can't flush memtables: %w", err)
+		}
+	}
+
+	err := s.memtable.closeLog()
+	if err != nil {
+		return err
+	}
+	for _, m := range s.flushQueueSnapshot() {
+		err = m.closeLog()
+		if err != nil {
+			return err
+		}
+	}
+
+	// iterators which are not closed yet keep their files open or mapped
+	s.files.close()
+	s.ssTablesAccessMutex.Lock()
+	for _, t := range s.ssTables {
+		t.unmap()
+	}
+	s.ssTablesAccessMutex.Unlock()
+
+	err = s.values.close()
+	if err != nil {
+		return err
+	}
+
+	err = s.manifest.close()
+	if err != nil {
+		return err
+	}
+	log.Println("[INFO] Storage stopped")
+	return utils.RemovePIDFile(s.Config.pidFilePath)
+}
+
+// flushAll moves the memtable to the flush queue and flushes the queue.
+func (s *Storage) flushAll() error {
+	s.flushMutex.Lock()
+	defer s.flushMutex.Unlock()
+
+	s.mutex.Lock()
+	var err error
+	if s.memtable.data.Len() > 0 {
+		err = s.rotateMemtable()
+	}
+	s.mutex.Unlock()
+	if err != nil {
+		return err
+	}
+	return s.flushQueue()
 }
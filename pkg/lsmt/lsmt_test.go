@@ -1,10 +1,17 @@
 package lsmt
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/entry"
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/skiplist"
 	"github.com/alexander-akhmetov/mdb/pkg/test_utils"
 	"github.com/alexander-akhmetov/mdb/pkg/utils"
 	"github.com/stretchr/testify/assert"
@@ -20,7 +27,7 @@ func TestStorage(t *testing.T) {
 			CompactionEnabled: false,
 		},
 	}
-	storage.Start()
+	assert.Nil(t, storage.Start())
 	defer storage.Stop()
 
 	content := testutils.ReadFile(storage.memtable.logFilename)
@@ -35,11 +42,14 @@ func TestStorage(t *testing.T) {
 	}
 	testutils.AssertKeysInFile(t, storage.memtable.logFilename, expData)
 
-	value, exists := storage.Get(testKey)
+	value, exists, err := storage.Get(testKey)
+	assert.Nil(t, err)
 	assert.True(t, exists)
 	assert.Equal(t, testValue, value)
 
-	assert.Equal(t, testValue, storage.memtable.data[testKey])
+	e, found := storage.memtable.Get(testKey)
+	assert.True(t, found)
+	assert.Equal(t, testValue, e.Value)
 }
 
 func TestStorageSSTable(t *testing.T) {
@@ -53,7 +63,7 @@ func TestStorageSSTable(t *testing.T) {
 	value2 := "v2"
 
 	// let's create one simple sstable
-	testutils.CreateFileWithKeyValues(
+	createSSTable(
 		".test/lsmt_data/sstables/0.sstable",
 		[][2]string{
 			{key1, value1},
@@ -66,14 +76,16 @@ func TestStorageSSTable(t *testing.T) {
 			WorkDir: ".test/lsmt_data/",
 		},
 	}
-	storage.Start()
+	assert.Nil(t, storage.Start())
 	defer storage.Stop()
 
-	value, exists := storage.Get(key1)
+	value, exists, err := storage.Get(key1)
+	assert.Nil(t, err)
 	assert.True(t, exists)
 	assert.Equal(t, value, value1)
 
-	value, exists = storage.Get(key2)
+	value, exists, err = storage.Get(key2)
+	assert.Nil(t, err)
 	assert.True(t, exists)
 	assert.Equal(t, value, value2)
 }
@@ -91,7 +103,7 @@ func TestStorageSSTablesOrdering(t *testing.T) {
 	oldValue2 := "1"
 
 	// let's create two sstables and check that we use them in the correct order
-	testutils.CreateFileWithKeyValues(
+	createSSTable(
 		".test/lsmt_data/sstables/0.sstable",
 		[][2]string{
 			{key1, oldValue1},
@@ -99,7 +111,7 @@ func TestStorageSSTablesOrdering(t *testing.T) {
 		},
 	)
 
-	testutils.CreateFileWithKeyValues(
+	createSSTable(
 		".test/lsmt_data/sstables/1.sstable",
 		[][2]string{
 			{key1, value1},
@@ -112,14 +124,16 @@ func TestStorageSSTablesOrdering(t *testing.T) {
 			WorkDir: ".test/lsmt_data/",
 		},
 	}
-	storage.Start()
+	assert.Nil(t, storage.Start())
 	defer storage.Stop()
 
-	value, exists := storage.Get(key1)
+	value, exists, err := storage.Get(key1)
+	assert.Nil(t, err)
 	assert.True(t, exists)
 	assert.Equal(t, value, value1)
 
-	value, exists = storage.Get(key2)
+	value, exists, err = storage.Get(key2)
+	assert.Nil(t, err)
 	assert.True(t, exists)
 	assert.Equal(t, value, value2)
 }
@@ -143,7 +157,7 @@ func TestStorageAOLogRestoring(t *testing.T) {
 		},
 	)
 
-	testutils.CreateFileWithKeyValues(
+	createSSTable(
 		".test/lsmt_data/sstables/1544288836377002.sstable",
 		[][2]string{
 			{"k1", "0"},
@@ -156,18 +170,48 @@ func TestStorageAOLogRestoring(t *testing.T) {
 			WorkDir: ".test/lsmt_data/",
 		},
 	}
-	storage.Start()
+	assert.Nil(t, storage.Start())
 	defer storage.Stop()
 
-	value, exists := storage.Get(key1)
+	value, exists, err := storage.Get(key1)
+	assert.Nil(t, err)
 	assert.True(t, exists)
 	assert.Equal(t, value1, value)
 
-	value, exists = storage.Get(key2)
+	value, exists, err = storage.Get(key2)
+	assert.Nil(t, err)
 	assert.True(t, exists)
 	assert.Equal(t, value2, value)
 }
 
+func TestStorageAOLogBrokenRecordLength(t *testing.T) {
+	// a broken length makes a record look incomplete, but it's not a torn write
+	// if other records follow it: the storage must not start and must not truncate the log
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	f := ".test/lsmt_data/log.aolog"
+	testutils.CreateFileWithKeyValues(f, [][2]string{{"k1", "v1"}, {"k2", "v2"}, {"k3", "v3"}, {"k4", "v4"}})
+
+	// the key length of the second record becomes longer than the rest of the file
+	data := testutils.ReadFileBinary(f)
+	recordLength := len(encodeRecord(&entry.DBEntry{Key: "k1", Value: "v1"}))
+	data[recordLength+checksumSize+3] ^= 0x10
+	testutils.CreateFile(f, string(data))
+
+	storage := &Storage{
+		Config: StorageConfig{
+			WorkDir: ".test/lsmt_data/",
+		},
+	}
+	err := storage.Start()
+	var corruptionErr *utils.CorruptionError
+	assert.True(t, errors.As(err, &corruptionErr))
+	assert.Equal(t, f, corruptionErr.Filename)
+	assert.Equal(t, int64(recordLength), corruptionErr.Offset)
+	assert.Equal(t, data, testutils.ReadFileBinary(f))
+}
+
 func TestStorageMemtablesToFlush(t *testing.T) {
 	// we will create memtables to flush and check that they will be flushed and data will be used correctly
 	testutils.SetUp()
@@ -192,39 +236,46 @@ func TestStorageMemtablesToFlush(t *testing.T) {
 		{key1, oldValue1},
 		{key2, oldValue2},
 	}
-	testutils.CreateFileWithKeyValues(".test/lsmt_data/sstables/0.sstable", data)
+	createSSTable(".test/lsmt_data/sstables/0.sstable", data)
 
 	storage := &Storage{
 		Config: StorageConfig{
 			WorkDir: ".test/lsmt_data/",
 		},
 	}
-	storage.Start()
+	assert.Nil(t, storage.Start())
 	defer storage.Stop()
 
 	// wait for flush process
 	time.Sleep(time.Millisecond * 200)
 
-	value, exists := storage.Get(key1)
+	value, exists, err := storage.Get(key1)
+	assert.Nil(t, err)
 	assert.True(t, exists)
 	assert.Equal(t, value1, value)
 
-	value, exists = storage.Get(key2)
+	value, exists, err = storage.Get(key2)
+	assert.Nil(t, err)
 	assert.True(t, exists)
 	assert.Equal(t, value2, value)
 
 	expectedNewSSTablePath := ".test/lsmt_data/sstables/1.sstable"
 	assert.True(t, testutils.IsFileExists(expectedNewSSTablePath))
 
-	// manually clean memtables and memtablesToFlush queue to check that data will be readed from SSTable
+	// manually clean memtables and memtablesToFlush queue to check that data will be readed from SSTable,
+	// the flusher process doesn't touch them while the mutex is locked
+	storage.flushMutex.Lock()
 	storage.memtablesFlushQueue = []*memtable{}
-	storage.memtable.data = map[string]string{}
+	storage.memtable.data = skiplist.New()
+	storage.flushMutex.Unlock()
 
-	value, exists = storage.Get(key1)
+	value, exists, err = storage.Get(key1)
+	assert.Nil(t, err)
 	assert.True(t, exists)
 	assert.Equal(t, value1, value)
 
-	value, exists = storage.Get(key2)
+	value, exists, err = storage.Get(key2)
+	assert.Nil(t, err)
 	assert.True(t, exists)
 	assert.Equal(t, value2, value)
 }
@@ -260,17 +311,19 @@ func TestStorageMemtableMustBeMoreImportantThanMemtablesToFlush(t *testing.T) {
 			WorkDir: ".test/lsmt_data/",
 		},
 	}
-	storage.Start()
+	assert.Nil(t, storage.Start())
 	defer storage.Stop()
 
 	// wait for flush process
 	time.Sleep(time.Millisecond * 200)
 
-	value, exists := storage.Get(key1)
+	value, exists, err := storage.Get(key1)
+	assert.Nil(t, err)
 	assert.True(t, exists)
 	assert.Equal(t, value1, value)
 
-	value, exists = storage.Get(key2)
+	value, exists, err = storage.Get(key2)
+	assert.Nil(t, err)
 	assert.True(t, exists)
 	assert.Equal(t, value2, value)
 }
@@ -299,15 +352,17 @@ func TestStorageMemtablesToFlushOnly(t *testing.T) {
 		},
 	}
 	// lock flush process
-	flushMutex.Lock()
-	storage.Start()
+	storage.flushMutex.Lock()
+	assert.Nil(t, storage.Start())
 	defer storage.Stop()
 
-	value, exists := storage.Get(key1)
+	value, exists, err := storage.Get(key1)
+	assert.Nil(t, err)
 	assert.True(t, exists)
 	assert.Equal(t, value1, value)
 
-	value, exists = storage.Get(key2)
+	value, exists, err = storage.Get(key2)
+	assert.Nil(t, err)
 	assert.True(t, exists)
 	assert.Equal(t, value2, value)
 
@@ -315,22 +370,26 @@ func TestStorageMemtablesToFlushOnly(t *testing.T) {
 	assert.Equal(t, 0, len(storage.ssTables))
 
 	// unlock flush process
-	flushMutex.Unlock()
+	storage.flushMutex.Unlock()
 	time.Sleep(time.Millisecond * 200)
 
 	// now we should have one sstable
+	storage.flushMutex.Lock()
 	assert.False(t, testutils.IsDirEmpty(storage.Config.ssTablesDir))
 	assert.Equal(t, 1, len(storage.ssTables))
 	// and no memtables to flush
 	assert.Equal(t, 0, len(storage.memtablesFlushQueue))
+	storage.flushMutex.Unlock()
 	assert.True(t, testutils.IsDirEmpty(storage.Config.memtablesFlushTmpDir))
 
 	// and we still have these keys and values :)
-	value, exists = storage.Get(key1)
+	value, exists, err = storage.Get(key1)
+	assert.Nil(t, err)
 	assert.True(t, exists)
 	assert.Equal(t, value1, value)
 
-	value, exists = storage.Get(key2)
+	value, exists, err = storage.Get(key2)
+	assert.Nil(t, err)
 	assert.True(t, exists)
 	assert.Equal(t, value2, value)
 }
@@ -349,12 +408,12 @@ func TestStorageWithManyMemtablesToFlush(t *testing.T) {
 
 	file1 := ".test/lsmt_data/aolog_tf/0.aolog"
 	utils.CreateFileIfNotExists(file1)
-	appendBinaryToFile(file1, &entry.DBEntry{
+	writeTestRecord(t, file1, &entry.DBEntry{
 		Type:  0,
 		Key:   key1,
 		Value: oldValue1,
 	})
-	appendBinaryToFile(file1, &entry.DBEntry{
+	writeTestRecord(t, file1, &entry.DBEntry{
 		Type:  0,
 		Key:   key2,
 		Value: oldValue2,
@@ -362,12 +421,12 @@ func TestStorageWithManyMemtablesToFlush(t *testing.T) {
 
 	file2 := ".test/lsmt_data/aolog_tf/1.aolog"
 	utils.CreateFileIfNotExists(file2)
-	appendBinaryToFile(file2, &entry.DBEntry{
+	writeTestRecord(t, file2, &entry.DBEntry{
 		Type:  0,
 		Key:   key1,
 		Value: value1,
 	})
-	appendBinaryToFile(file2, &entry.DBEntry{
+	writeTestRecord(t, file2, &entry.DBEntry{
 		Type:  0,
 		Key:   key2,
 		Value: value2,
@@ -379,15 +438,17 @@ func TestStorageWithManyMemtablesToFlush(t *testing.T) {
 		},
 	}
 	// lock flush process
-	flushMutex.Lock()
-	storage.Start()
+	storage.flushMutex.Lock()
+	assert.Nil(t, storage.Start())
 	defer storage.Stop()
 
-	value, exists := storage.Get(key1)
+	value, exists, err := storage.Get(key1)
+	assert.Nil(t, err)
 	assert.True(t, exists)
 	assert.Equal(t, value1, value)
 
-	value, exists = storage.Get(key2)
+	value, exists, err = storage.Get(key2)
+	assert.Nil(t, err)
 	assert.True(t, exists)
 	assert.Equal(t, value2, value)
 
@@ -395,22 +456,26 @@ func TestStorageWithManyMemtablesToFlush(t *testing.T) {
 	assert.Equal(t, 0, len(storage.ssTables))
 
 	// unlock flush process
-	flushMutex.Unlock()
+	storage.flushMutex.Unlock()
 	time.Sleep(time.Millisecond * 200)
 
 	// now we should have one sstable
+	storage.flushMutex.Lock()
 	assert.False(t, testutils.IsDirEmpty(storage.Config.ssTablesDir))
 	assert.Equal(t, 2, len(storage.ssTables))
 	// and no memtables to flush
 	assert.Equal(t, 0, len(storage.memtablesFlushQueue))
+	storage.flushMutex.Unlock()
 	assert.True(t, testutils.IsDirEmpty(storage.Config.memtablesFlushTmpDir))
 
 	// and we still have these keys and values :)
-	value, exists = storage.Get(key1)
+	value, exists, err = storage.Get(key1)
+	assert.Nil(t, err)
 	assert.True(t, exists)
 	assert.Equal(t, value1, value)
 
-	value, exists = storage.Get(key2)
+	value, exists, err = storage.Get(key2)
+	assert.Nil(t, err)
 	assert.True(t, exists)
 	assert.Equal(t, value2, value)
 }
@@ -427,7 +492,7 @@ func TestStorageCompaction(t *testing.T) {
 	value2 := "22"
 	oldValue2 := "2"
 
-	testutils.CreateFileWithKeyValues(
+	createSSTable(
 		".test/lsmt_data/sstables/0.sstable",
 		[][2]string{
 			{key1, oldValue1},
@@ -435,7 +500,7 @@ func TestStorageCompaction(t *testing.T) {
 		},
 	)
 
-	testutils.CreateFileWithKeyValues(
+	createSSTable(
 		".test/lsmt_data/sstables/1.sstable",
 		[][2]string{
 			{key1, value1},
@@ -449,27 +514,33 @@ func TestStorageCompaction(t *testing.T) {
 			CompactionEnabled: true,
 		},
 	}
-	storage.Start()
+	assert.Nil(t, storage.Start())
 	defer storage.Stop()
 
 	// wait for compaction process
 	time.Sleep(time.Millisecond * 200)
 
-	value, exists := storage.Get(key1)
+	value, exists, err := storage.Get(key1)
+	assert.Nil(t, err)
 	assert.True(t, exists)
 	assert.Equal(t, value1, value)
 
-	value, exists = storage.Get(key2)
+	value, exists, err = storage.Get(key2)
+	assert.Nil(t, err)
 	assert.True(t, exists)
 	assert.Equal(t, value2, value)
 
-	expectedNewSSTablePath := ".test/lsmt_data/sstables/1.sstable"
+	// the result gets a new file number
+	expectedNewSSTablePath := ".test/lsmt_data/sstables/2.sstable"
 	assert.True(t, testutils.IsFileExists(expectedNewSSTablePath))
 	assert.False(t, testutils.IsFileExists(".test/lsmt_data/sstables/0.sstable"))
+	assert.False(t, testutils.IsFileExists(".test/lsmt_data/sstables/1.sstable"))
 
-	binaryContent := testutils.ReadFileBinary(expectedNewSSTablePath)
-	expContent := []byte{0x0, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x2, 0x6b, 0x31, 0x31, 0x31, 0x0, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x2, 0x6b, 0x32, 0x32, 0x32}
-	assert.Equal(t, expContent, binaryContent)
+	expData := [][2]string{
+		{key1, value1},
+		{key2, value2},
+	}
+	assertKeysInSSTable(t, expectedNewSSTablePath, expData)
 }
 
 func TestStorageCompactionForOldFiles(t *testing.T) {
@@ -486,7 +557,7 @@ func TestStorageCompactionForOldFiles(t *testing.T) {
 	oldestValue2 := "22"
 	oldValue2 := "2"
 
-	testutils.CreateFileWithKeyValues(
+	createSSTable(
 		".test/lsmt_data/sstables/0.sstable",
 		[][2]string{
 			{key1, oldestValue1},
@@ -494,7 +565,7 @@ func TestStorageCompactionForOldFiles(t *testing.T) {
 		},
 	)
 
-	testutils.CreateFileWithKeyValues(
+	createSSTable(
 		".test/lsmt_data/sstables/1.sstable",
 		[][2]string{
 			{key1, oldValue1},
@@ -502,7 +573,7 @@ func TestStorageCompactionForOldFiles(t *testing.T) {
 		},
 	)
 
-	testutils.CreateFileWithKeyValues(
+	createSSTable(
 		".test/lsmt_data/sstables/2.sstable",
 		[][2]string{
 			{key1, value1},
@@ -517,27 +588,706 @@ func TestStorageCompactionForOldFiles(t *testing.T) {
 			MinimumFilesToCompact: 3,
 		},
 	}
-	storage.Start()
+	assert.Nil(t, storage.Start())
 	defer storage.Stop()
 
 	// wait for compaction process
 	time.Sleep(time.Millisecond * 200)
 
-	value, exists := storage.Get(key1)
+	value, exists, err := storage.Get(key1)
+	assert.Nil(t, err)
 	assert.True(t, exists)
 	assert.Equal(t, value1, value)
 
-	value, exists = storage.Get(key2)
+	value, exists, err = storage.Get(key2)
+	assert.Nil(t, err)
 	assert.True(t, exists)
 	assert.Equal(t, value2, value)
 
-	expectedNewSSTablePath := ".test/lsmt_data/sstables/1.sstable"
+	expectedNewSSTablePath := ".test/lsmt_data/sstables/3.sstable"
 	assert.True(t, testutils.IsFileExists(expectedNewSSTablePath))
 	assert.False(t, testutils.IsFileExists(".test/lsmt_data/sstables/0.sstable"))
+	assert.False(t, testutils.IsFileExists(".test/lsmt_data/sstables/1.sstable"))
+	assert.True(t, testutils.IsFileExists(".test/lsmt_data/sstables/2.sstable"))
 
 	expData := [][2]string{
 		{key1, oldValue1},
 		{key2, oldValue2},
 	}
-	testutils.AssertKeysInFile(t, expectedNewSSTablePath, expData)
+	assertKeysInSSTable(t, expectedNewSSTablePath, expData)
+}
+
+func TestStorageLeveledCompaction(t *testing.T) {
+	// level 0 tables must be merged into level 1, and levels must survive a restart
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	createLevelSSTable(".test/lsmt_data/sstables/1.sstable", 1, [][2]string{{"k1", "1"}, {"k2", "1"}})
+	createLevelSSTable(".test/lsmt_data/sstables/2.sstable", 1, [][2]string{{"k7", "2"}, {"k8", "2"}})
+	createSSTable(".test/lsmt_data/sstables/3.sstable", [][2]string{{"k2", "3"}, {"k3", "3"}})
+	createSSTableWithEntries(".test/lsmt_data/sstables/4.sstable", []*entry.DBEntry{
+		{Type: entry.TypeTombstone, Key: "k1"},
+		{Type: entry.TypeValue, Key: "k4", Value: "4"},
+	})
+
+	config := StorageConfig{
+		WorkDir:            ".test/lsmt_data/",
+		CompactionEnabled:  true,
+		CompactionStrategy: &LeveledStrategy{Level0FilesToCompact: 2},
+	}
+	storage := &Storage{Config: config}
+	assert.Nil(t, storage.Start())
+
+	// wait for compaction process
+	time.Sleep(time.Millisecond * 200)
+
+	expData := map[string]string{"k2": "3", "k3": "3", "k4": "4", "k7": "2", "k8": "2"}
+	for key, expValue := range expData {
+		value, exists, err := storage.Get(key)
+		assert.Nil(t, err)
+		assert.True(t, exists)
+		assert.Equal(t, expValue, value)
+	}
+	_, exists, err := storage.Get("k1")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+
+	for _, filename := range []string{"1.sstable", "3.sstable", "4.sstable"} {
+		assert.False(t, testutils.IsFileExists(".test/lsmt_data/sstables/"+filename))
+	}
+	assert.True(t, testutils.IsFileExists(".test/lsmt_data/sstables/2.sstable"))
+	assert.Nil(t, storage.Stop())
+	time.Sleep(time.Millisecond * 200)
+
+	config.CompactionEnabled = false
+	storage = &Storage{Config: config}
+	assert.Nil(t, storage.Start())
+	defer storage.Stop()
+
+	assert.Equal(t, 2, len(storage.ssTables))
+	for _, table := range storage.ssTables {
+		assert.Equal(t, 1, table.level)
+	}
+	// the compaction result is newer than the untouched table, so it goes first
+	assert.Equal(t, "k2", storage.ssTables[0].smallest)
+	assert.Equal(t, "k4", storage.ssTables[0].largest)
+	assert.Equal(t, ".test/lsmt_data/sstables/2.sstable", storage.ssTables[1].config.filename)
+}
+
+func TestStorageManifest(t *testing.T) {
+	// the storage must use only tables from the manifest and remove other files
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	createSSTable(".test/lsmt_data/sstables/1.sstable", [][2]string{{"k1", "1"}})
+	createSSTable(".test/lsmt_data/sstables/2.sstable", [][2]string{{"k1", "2"}})
+
+	config := StorageConfig{WorkDir: ".test/lsmt_data/"}
+	storage := &Storage{Config: config}
+	assert.Nil(t, storage.Start())
+	assert.Nil(t, storage.Stop())
+
+	tables, nextFileNumber, err := readManifest(".test/lsmt_data/MANIFEST")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]tableMeta{"1.sstable": {level: 0, seq: 1}, "2.sstable": {level: 0, seq: 2}}, tables)
+	assert.Equal(t, int64(3), nextFileNumber)
+
+	// A compaction result which has not been added to the manifest before a crash
+	// and an incomplete table are orphans.
+	createSSTable(".test/lsmt_data/sstables/3.sstable", [][2]string{{"k1", "3"}})
+	testutils.CreateFile(".test/lsmt_data/sstables/4.sstable.tmp", "")
+
+	storage = &Storage{Config: config}
+	assert.Nil(t, storage.Start())
+
+	value, exists, err := storage.Get("k1")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, "2", value)
+	assert.Equal(t, 2, len(storage.ssTables))
+	assert.False(t, testutils.IsFileExists(".test/lsmt_data/sstables/3.sstable"))
+	assert.False(t, testutils.IsFileExists(".test/lsmt_data/sstables/4.sstable.tmp"))
+	assert.Nil(t, storage.Stop())
+
+	// the table from the manifest is missing
+	os.Remove(".test/lsmt_data/sstables/1.sstable")
+	storage = &Storage{Config: config}
+	err = storage.Start()
+	assert.True(t, errors.Is(err, utils.ErrCorrupted))
+}
+
+func TestStorageFlushUsesManifest(t *testing.T) {
+	// flushed tables must be added to the manifest and get new file numbers
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	// every memtable is flushed when it has two entries
+	config := StorageConfig{WorkDir: ".test/lsmt_data/", MaxMemtableSize: 100}
+	storage := &Storage{Config: config}
+	assert.Nil(t, storage.Start())
+
+	for _, key := range []string{"k1", "k2", "k3", "k4", "k5"} {
+		assert.Nil(t, storage.Set(key, "v"))
+	}
+	// wait for the flusher process
+	time.Sleep(time.Millisecond * 300)
+	assert.Nil(t, storage.Stop())
+
+	tables, _, err := readManifest(".test/lsmt_data/MANIFEST")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]tableMeta{"1.sstable": {level: 0, seq: 1}, "2.sstable": {level: 0, seq: 2}}, tables)
+
+	storage = &Storage{Config: config}
+	assert.Nil(t, storage.Start())
+	defer storage.Stop()
+	for _, key := range []string{"k1", "k2", "k3", "k4", "k5"} {
+		_, exists, err := storage.Get(key)
+		assert.Nil(t, err)
+		assert.True(t, exists)
+	}
+}
+
+func TestStorageMemtablesMemoryLimit(t *testing.T) {
+	// writes must wait for the flusher process when memtables use too much memory
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	// every memtable is flushed when it has two entries, and the limit is less than five entries
+	config := StorageConfig{WorkDir: ".test/lsmt_data/", MaxMemtableSize: 100, MaxMemtablesMemory: 400}
+	storage := &Storage{Config: config}
+	assert.Nil(t, storage.Start())
+	defer storage.Stop()
+
+	// the flusher process can't flush memtables while the mutex is locked
+	storage.flushMutex.Lock()
+	for _, key := range []string{"k1", "k2", "k3", "k4", "k5"} {
+		assert.Nil(t, storage.Set(key, "v"))
+	}
+
+	done := make(chan error)
+	go func() {
+		done <- storage.Set("k6", "v")
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("write must wait for the flusher process")
+	case <-time.After(time.Millisecond * 200):
+	}
+
+	storage.flushMutex.Unlock()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second * 2):
+		t.Fatal("write must continue after the flush")
+	}
+
+	value, exists, err := storage.Get("k6")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, "v", value)
+}
+
+func TestStorageFlushOnStop(t *testing.T) {
+	// all memtables must be flushed to SSTables on Stop
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	config := StorageConfig{WorkDir: ".test/lsmt_data/", MaxMemtableSize: 100, FlushOnStop: true}
+	storage := &Storage{Config: config}
+	assert.Nil(t, storage.Start())
+
+	// the flusher process can't flush memtables while the mutex is locked
+	storage.flushMutex.Lock()
+	for _, key := range []string{"k1", "k2", "k3"} {
+		assert.Nil(t, storage.Set(key, "v"))
+	}
+	storage.flushMutex.Unlock()
+	assert.Nil(t, storage.Stop())
+
+	assert.True(t, testutils.IsDirEmpty(".test/lsmt_data/aolog_tf"))
+	assert.Equal(t, "", testutils.ReadFile(".test/lsmt_data/log.aolog"))
+	tables, _, err := readManifest(".test/lsmt_data/MANIFEST")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(tables))
+
+	storage = &Storage{Config: config}
+	assert.Nil(t, storage.Start())
+	defer storage.Stop()
+	assert.Equal(t, 0, storage.memtable.data.Len())
+	assert.Equal(t, 0, len(storage.memtablesFlushQueue))
+	for _, key := range []string{"k1", "k2", "k3"} {
+		_, exists, err := storage.Get(key)
+		assert.Nil(t, err)
+		assert.True(t, exists)
+	}
+}
+
+func TestStorageFlushedLogRestoring(t *testing.T) {
+	// a log of the flush queue must be removed after restart if its table has been added to the manifest:
+	// the process crashed after the flush, but before the log was removed
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	config := StorageConfig{WorkDir: ".test/lsmt_data/", FlushOnStop: true}
+	storage := &Storage{Config: config}
+	assert.Nil(t, storage.Start())
+	for _, key := range []string{"k1", "k2"} {
+		assert.Nil(t, storage.Set(key, "v"))
+	}
+	data := testutils.ReadFileBinary(".test/lsmt_data/log.aolog")
+	assert.Nil(t, storage.Stop())
+
+	tables, _, err := readManifest(".test/lsmt_data/MANIFEST")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(tables))
+	var logFilename string
+	for filename := range tables {
+		logFilename = ".test/lsmt_data/aolog_tf/" + strings.TrimSuffix(filename, ".sstable") + ".aolog"
+	}
+	testutils.CreateFile(logFilename, string(data))
+
+	storage = &Storage{Config: config}
+	assert.Nil(t, storage.Start())
+	assert.False(t, testutils.IsFileExists(logFilename))
+	assert.Equal(t, 0, len(storage.memtablesFlushQueue))
+	assert.Equal(t, 1, len(storage.ssTables))
+	assertValues(t, storage, map[string]string{"k1": "v", "k2": "v"})
+	assert.Nil(t, storage.Stop())
+
+	tables, _, err = readManifest(".test/lsmt_data/MANIFEST")
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(tables))
+}
+
+func TestStorageCloseTimeout(t *testing.T) {
+	// Close returns when the context is done, and the files are closed when the background processes exit
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	storage := &Storage{Config: StorageConfig{WorkDir: ".test/lsmt_data/"}}
+	assert.Nil(t, storage.Start())
+
+	// the flusher process can't exit while the mutex is locked
+	storage.flushMutex.Lock()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*100)
+	defer cancel()
+	err := storage.Close(ctx)
+	assert.True(t, errors.Is(err, context.DeadlineExceeded))
+	assert.True(t, testutils.IsFileExists(".test/lsmt_data/mdb.pid"))
+
+	// the storage is stopped anyway
+	assert.True(t, errors.Is(storage.Set("k", "v"), utils.ErrClosed))
+
+	storage.flushMutex.Unlock()
+	for i := 0; i < 20 && testutils.IsFileExists(".test/lsmt_data/mdb.pid"); i++ {
+		time.Sleep(time.Millisecond * 50)
+	}
+	assert.False(t, testutils.IsFileExists(".test/lsmt_data/mdb.pid"))
+}
+
+func TestManyStorages(t *testing.T) {
+	// storages in one process must not share any state: run with -race
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+
+			storage := &Storage{
+				Config: StorageConfig{
+					WorkDir:            fmt.Sprintf(".test/lsmt_data_%v/", i),
+					CompactionEnabled:  true,
+					CompactionStrategy: &LeveledStrategy{Level0FilesToCompact: 2},
+					MaxMemtableSize:    1024,
+				},
+			}
+			assert.Nil(t, storage.Start())
+
+			for j := 0; j < 300; j++ {
+				assert.Nil(t, storage.Set(fmt.Sprintf("key-%v", j), fmt.Sprintf("value-%v-%v", i, j)))
+			}
+			for j := 0; j < 300; j++ {
+				value, exists, err := storage.Get(fmt.Sprintf("key-%v", j))
+				assert.Nil(t, err)
+				assert.True(t, exists)
+				assert.Equal(t, fmt.Sprintf("value-%v-%v", i, j), value)
+			}
+			assert.Nil(t, storage.Stop())
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestStorageConcurrentAccess(t *testing.T) {
+	// small memtables make the flusher and the compaction work during the test: run with -race
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	storage := &Storage{
+		Config: StorageConfig{
+			WorkDir:            ".test/lsmt_data/",
+			CompactionEnabled:  true,
+			CompactionStrategy: &LeveledStrategy{Level0FilesToCompact: 2},
+			MaxMemtableSize:    2048,
+			SyncMode:           SyncEveryWrite,
+		},
+	}
+	assert.Nil(t, storage.Start())
+	defer storage.Stop()
+
+	// scans must return sorted keys while memtables are flushed and SSTables are replaced
+	done := make(chan struct{})
+	scanned := make(chan struct{})
+	go func() {
+		defer close(scanned)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			it, err := storage.Scan("", "")
+			if !assert.Nil(t, err) {
+				return
+			}
+			previous := ""
+			for it.Next() {
+				assert.True(t, previous < it.Key())
+				previous = it.Key()
+			}
+			assert.Nil(t, it.Err())
+			it.Close()
+		}
+	}()
+
+	testutils.StressTest(t, storage, testutils.StressConfig{Writers: 8, Readers: 8, Keys: 100, Rounds: 3})
+	close(done)
+	<-scanned
+}
+
+func TestStorageDelete(t *testing.T) {
+	// we will delete a key which exists in the memtable and in the SSTable
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	createSSTable(
+		".test/lsmt_data/sstables/0.sstable",
+		[][2]string{
+			{"k1", "v1"},
+			{"k2", "v2"},
+		},
+	)
+
+	storage := &Storage{
+		Config: StorageConfig{
+			WorkDir: ".test/lsmt_data/",
+		},
+	}
+	assert.Nil(t, storage.Start())
+	defer storage.Stop()
+
+	storage.Set("k3", "v3")
+
+	storage.Delete("k1")
+	storage.Delete("k3")
+
+	value, exists, err := storage.Get("k1")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, "", value)
+
+	value, exists, err = storage.Get("k3")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, "", value)
+
+	// other keys are still here
+	value, exists, err = storage.Get("k2")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, "v2", value)
+
+	// a deleted key can be saved again
+	storage.Set("k1", "new")
+	value, exists, err = storage.Get("k1")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, "new", value)
+}
+
+func TestStorageTombstoneInSSTable(t *testing.T) {
+	// a tombstone in the newer SSTable must hide the value in the older one
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	createSSTable(
+		".test/lsmt_data/sstables/0.sstable",
+		[][2]string{
+			{"k1", "v1"},
+			{"k2", "v2"},
+		},
+	)
+	createSSTableWithEntries(".test/lsmt_data/sstables/1.sstable", []*entry.DBEntry{
+		{Type: entry.TypeTombstone, Key: "k1"},
+	})
+
+	storage := &Storage{
+		Config: StorageConfig{
+			WorkDir: ".test/lsmt_data/",
+		},
+	}
+	assert.Nil(t, storage.Start())
+	defer storage.Stop()
+
+	value, exists, err := storage.Get("k1")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	assert.Equal(t, "", value)
+
+	value, exists, err = storage.Get("k2")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, "v2", value)
+}
+
+func TestStorageBlockCache(t *testing.T) {
+	// hot keys are read from the block cache, and blocks of merged tables are evicted
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	createSSTable(".test/lsmt_data/sstables/0.sstable", [][2]string{{"k1", "v1"}})
+	createSSTable(".test/lsmt_data/sstables/1.sstable", [][2]string{{"k2", "v2"}})
+
+	storage := &Storage{
+		Config: StorageConfig{
+			WorkDir: ".test/lsmt_data/",
+		},
+	}
+	assert.Nil(t, storage.Start())
+	defer storage.Stop()
+
+	for i := 0; i < 3; i++ {
+		for _, key := range []string{"k1", "k2"} {
+			_, exists, err := storage.Get(key)
+			assert.Nil(t, err)
+			assert.True(t, exists)
+		}
+	}
+	stats := storage.Stats()
+	assert.Equal(t, int64(4), stats.BlockCacheHits)
+	assert.Equal(t, int64(2), stats.BlockCacheMisses)
+	assert.True(t, storage.blockCache.Size() > 0)
+
+	task, err := storage.compactOnce()
+	assert.Nil(t, err)
+	assert.NotNil(t, task)
+	assert.Equal(t, int64(0), storage.blockCache.Size())
+
+	value, exists, err := storage.Get("k1")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, "v1", value)
+	assert.Equal(t, int64(3), storage.Stats().BlockCacheMisses)
+}
+
+func TestStorageScanDuringCompaction(t *testing.T) {
+	// an open iterator keeps reading tables which have been merged and removed
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	createSSTable(".test/lsmt_data/sstables/0.sstable", [][2]string{{"k1", "v1"}, {"k3", "v3"}})
+	createSSTable(".test/lsmt_data/sstables/1.sstable", [][2]string{{"k2", "v2"}})
+
+	storage := &Storage{
+		Config: StorageConfig{
+			WorkDir: ".test/lsmt_data/",
+		},
+	}
+	assert.Nil(t, storage.Start())
+	defer storage.Stop()
+
+	it, err := storage.Scan("", "")
+	assert.Nil(t, err)
+	assert.Equal(t, 2, storage.files.len())
+
+	task, err := storage.compactOnce()
+	assert.Nil(t, err)
+	assert.NotNil(t, task)
+	assert.Equal(t, 0, storage.files.len())
+	assert.False(t, testutils.IsFileExists(".test/lsmt_data/sstables/0.sstable"))
+
+	keys := []string{}
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+	assert.Nil(t, it.Err())
+	it.Close()
+	assert.Equal(t, []string{"k1", "k2", "k3"}, keys)
+}
+
+func TestStorageGetSkipsSSTables(t *testing.T) {
+	// tables out of the key range and tables older than the one with the key must not be read:
+	// broken data blocks show that they are not touched
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	corruptDataBlock := func(filename string) {
+		data := testutils.ReadFileBinary(filename)
+		data[entry.HeaderSize] ^= 1
+		testutils.CreateFile(filename, string(data))
+	}
+
+	createSSTable(".test/lsmt_data/sstables/0.sstable", [][2]string{{"k1", "old"}, {"k2", "v2"}})
+	corruptDataBlock(".test/lsmt_data/sstables/0.sstable")
+	createSSTable(".test/lsmt_data/sstables/1.sstable", [][2]string{{"k1", "new"}})
+	createSSTable(".test/lsmt_data/sstables/2.sstable", [][2]string{{"z1", "v"}, {"z2", "v"}})
+	corruptDataBlock(".test/lsmt_data/sstables/2.sstable")
+
+	storage := &Storage{
+		Config: StorageConfig{
+			WorkDir: ".test/lsmt_data/",
+		},
+	}
+	assert.Nil(t, storage.Start())
+	defer storage.Stop()
+
+	value, exists, err := storage.Get("k1")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, "new", value)
+
+	// the only table which can have the key is broken
+	_, _, err = storage.Get("k2")
+	assert.True(t, errors.Is(err, utils.ErrCorrupted))
+}
+
+func TestStorageWriteBatch(t *testing.T) {
+	// all changes of a batch must be applied and restored after restart
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	config := StorageConfig{
+		WorkDir: ".test/lsmt_data/",
+	}
+	storage := &Storage{Config: config}
+	assert.Nil(t, storage.Start())
+
+	assert.Nil(t, storage.Set("k1", "v1"))
+
+	batch := &WriteBatch{}
+	batch.Set("k2", "v2")
+	batch.Delete("k1")
+	batch.Set("k3", "v3")
+	assert.Equal(t, 3, batch.Len())
+	assert.Nil(t, storage.Write(batch))
+
+	// an empty batch doesn't change anything
+	assert.Nil(t, storage.Write(&WriteBatch{}))
+
+	assertBatch := func(storage *Storage) {
+		_, exists, err := storage.Get("k1")
+		assert.Nil(t, err)
+		assert.False(t, exists)
+
+		for _, kv := range [][2]string{{"k2", "v2"}, {"k3", "v3"}} {
+			value, exists, err := storage.Get(kv[0])
+			assert.Nil(t, err)
+			assert.True(t, exists)
+			assert.Equal(t, kv[1], value)
+		}
+	}
+	assertBatch(storage)
+
+	assert.Nil(t, storage.Stop())
+
+	storage = &Storage{Config: config}
+	assert.Nil(t, storage.Start())
+	defer storage.Stop()
+	assertBatch(storage)
+}
+
+func TestStorageRejectsTooBigRecords(t *testing.T) {
+	// a record which can't be restored from AOLog must not be written
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	config := StorageConfig{
+		WorkDir: ".test/lsmt_data/",
+	}
+	storage := &Storage{Config: config}
+	assert.Nil(t, storage.Start())
+
+	assert.Nil(t, storage.Set("k1", "v1"))
+	big := strings.Repeat("v", maxEntrySize)
+	assert.True(t, errors.Is(storage.Set("k2", big), utils.ErrTooBig))
+	assert.True(t, errors.Is(storage.Delete(big), utils.ErrTooBig))
+
+	// every entry fits, but the batch record doesn't
+	batch := &WriteBatch{}
+	batch.Set("k3", big[:maxEntrySize/2])
+	batch.Set("k4", big[:maxEntrySize/2])
+	assert.True(t, errors.Is(storage.Write(batch), utils.ErrTooBig))
+
+	assert.Nil(t, storage.Stop())
+
+	// the log has only the first record, so the storage starts
+	storage = &Storage{Config: config}
+	assert.Nil(t, storage.Start())
+	defer storage.Stop()
+	for key, exp := range map[string]bool{"k1": true, "k2": false, "k3": false, "k4": false} {
+		_, found, err := storage.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, exp, found)
+	}
+}
+
+func TestStorageClosed(t *testing.T) {
+	// the stopped storage must return ErrClosed
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	storage := &Storage{
+		Config: StorageConfig{
+			WorkDir: ".test/lsmt_data/",
+		},
+	}
+	assert.Equal(t, utils.ErrClosed, storage.Set("k1", "v1"))
+
+	assert.Nil(t, storage.Start())
+	assert.Nil(t, storage.Set("k1", "v1"))
+	assert.Nil(t, storage.Stop())
+
+	_, _, err := storage.Get("k1")
+	assert.Equal(t, utils.ErrClosed, err)
+	assert.Equal(t, utils.ErrClosed, storage.Delete("k1"))
+	assert.Equal(t, utils.ErrClosed, storage.Write(&WriteBatch{}))
+	_, err = storage.Scan("", "")
+	assert.Equal(t, utils.ErrClosed, err)
+}
+
+func TestStorageLocked(t *testing.T) {
+	// only one instance can use the same directory
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	storage := &Storage{
+		Config: StorageConfig{
+			WorkDir: ".test/lsmt_data/",
+		},
+	}
+	assert.Nil(t, storage.Start())
+	defer storage.Stop()
+
+	another := &Storage{
+		Config: StorageConfig{
+			WorkDir: ".test/lsmt_data/",
+		},
+	}
+	assert.True(t, errors.Is(another.Start(), utils.ErrLocked))
 }
@@ -0,0 +1,283 @@
+package lsmt
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/entry"
+	"github.com/alexander-akhmetov/mdb/pkg/utils"
+)
+
+// The manifest is a log of changes of the SSTables set (version edits).
+// Every edit is one AOLog record with a batch entry:
+//
+//	added table:      value, key: the filename, value: "<level> <sequence>"
+//	removed table:    tombstone, key: the filename
+//	next file number: value, key: "next-file-number", value: the number
+//
+// A change is applied to the SSTables list only after its record is synced to disk,
+// so after a crash the storage is either before or after the change.
+// New files which are not in the manifest yet and removed tables which are not deleted yet
+// are orphans: they are deleted on start.
+//
+// The manifest is rewritten with the current state on every start, so it doesn't grow forever.
+const manifestNextFileNumberKey = "next-file-number"
+
+// tableMeta describes a live SSTable in the manifest.
+type tableMeta struct {
+	level int
+	seq   int64 // tables with bigger sequences have newer data
+}
+
+// versionEdit is one change of the SSTables set.
+type versionEdit struct {
+	added          map[string]tableMeta // filename => table
+	removed        []string
+	nextFileNumber int64
+}
+
+// entry returns the batch entry with all changes of the edit.
+func (e *versionEdit) entry() *entry.DBEntry {
+	filenames := []string{}
+	for filename := range e.added {
+		filenames = append(filenames, filename)
+	}
+	sort.Strings(filenames)
+
+	entries := []*entry.DBEntry{}
+	for _, filename := range filenames {
+		t := e.added[filename]
+		entries = append(entries, &entry.DBEntry{
+			Type:  entry.TypeValue,
+			Key:   filename,
+			Value: fmt.Sprintf("%v %v", t.level, t.seq),
+		})
+	}
+	for _, filename := range e.removed {
+		entries = append(entries, &entry.DBEntry{Type: entry.TypeTombstone, Key: filename})
+	}
+	entries = append(entries, &entry.DBEntry{
+		Type:  entry.TypeValue,
+		Key:   manifestNextFileNumberKey,
+		Value: strconv.FormatInt(e.nextFileNumber, 10),
+	})
+	return entry.NewBatchEntry(entries)
+}
+
+// newVersionEdit parses a version edit from the batch entry.
+func newVersionEdit(e *entry.DBEntry) (*versionEdit, error) {
+	if e.Type != entry.TypeBatch {
+		return nil, fmt.Errorf("wrong entry type=%v", e.Type)
+	}
+	entries, err := e.BatchEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	edit := &versionEdit{added: map[string]tableMeta{}}
+	for _, be := range entries {
+		switch {
+		case be.IsTombstone():
+			edit.removed = append(edit.removed, be.Key)
+		case be.Key == manifestNextFileNumberKey:
+			edit.nextFileNumber, err = strconv.ParseInt(be.Value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("wrong next file number=%s", be.Value)
+			}
+		default:
+			t := tableMeta{}
+			_, err = fmt.Sscanf(be.Value, "%d %d", &t.level, &t.seq)
+			if err != nil || t.level < 0 || t.level >= maxLevels {
+				return nil, fmt.Errorf("wrong table=%s: %s", be.Key, be.Value)
+			}
+			edit.added[be.Key] = t
+		}
+	}
+	return edit, nil
+}
+
+// manifest keeps the log of the SSTables set changes and allocates file numbers.
+type manifest struct {
+	filename       string
+	file           *os.File
+	mutex          sync.Mutex
+	nextFileNumber int64
+	tables         map[string]tableMeta // live tables
+}
+
+// readManifest replays the manifest and returns the live tables and the next file number.
+// An incomplete record at the end means that the process crashed while the edit
+// was being written, so the edit has never been applied: it's ignored.
+func readManifest(filename string) (map[string]tableMeta, int64, error) {
+	file, err := os.OpenFile(filename, os.O_RDONLY, filePermissions)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+
+	tables := map[string]tableMeta{}
+	nextFileNumber := int64(1)
+
+	scanner := newBinFileScanner(file, aoLogReadBufferSize)
+	for scanner.Scan() {
+		e, err := entry.NewDBEntry(scanner.Bytes())
+		if err != nil {
+			return nil, 0, err
+		}
+		edit, err := newVersionEdit(e)
+		if err != nil {
+			return nil, 0, &utils.CorruptionError{
+				Filename: filename,
+				Offset:   scanner.Offset() - int64(checksumSize+e.Length()),
+				Reason:   fmt.Sprintf("can't read version edit: %v", err),
+			}
+		}
+
+		for _, name := range edit.removed {
+			delete(tables, name)
+		}
+		for name, t := range edit.added {
+			tables[name] = t
+		}
+		if edit.nextFileNumber > nextFileNumber {
+			nextFileNumber = edit.nextFileNumber
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, 0, err
+	}
+	return tables, nextFileNumber, nil
+}
+
+// newManifest writes a new manifest with the given tables and opens it for new edits.
+// The new manifest replaces the old one atomically.
+func newManifest(filename string, tables map[string]tableMeta, nextFileNumber int64) (*manifest, error) {
+	tmpFilename := filename + ".tmp"
+	file, err := os.OpenFile(tmpFilename, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, filePermissions)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &manifest{
+		filename:       filename,
+		file:           file,
+		nextFileNumber: nextFileNumber,
+		tables:         map[string]tableMeta{},
+	}
+	err = m.apply(&versionEdit{added: tables})
+	if err == nil {
+		err = os.Rename(tmpFilename, filename)
+	}
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("can't create manifest=%s: %w", filename, err)
+	}
+
+	// Reopen the file in the append mode: after the rename, the descriptor points to the same file.
+	m.file.Close()
+	m.file, err = os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, filePermissions)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// apply saves the edit to the manifest. The edit is synced to disk before the function returns.
+func (m *manifest) apply(edit *versionEdit) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	edit.nextFileNumber = m.nextFileNumber
+	_, err := m.file.Write(encodeRecord(edit.entry()))
+	if err != nil {
+		return err
+	}
+	err = m.file.Sync()
+	if err != nil {
+		return err
+	}
+
+	for _, name := range edit.removed {
+		delete(m.tables, name)
+	}
+	for name, t := range edit.added {
+		m.tables[name] = t
+	}
+	return nil
+}
+
+// newFileNumber returns a unique number for a new file.
+// Numbers grow, so newer files have bigger numbers.
+func (m *manifest) newFileNumber() int64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	number := m.nextFileNumber
+	m.nextFileNumber++
+	return number
+}
+
+// markFileNumberUsed makes sure that new files don't get the given number.
+func (m *manifest) markFileNumberUsed(number int64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if number >= m.nextFileNumber {
+		m.nextFileNumber = number + 1
+	}
+}
+
+// isLive returns true if the SSTable with the given file name is in the set of live tables.
+func (m *manifest) isLive(filename string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	_, ok := m.tables[filename]
+	return ok
+}
+
+// isOrphan returns true if the file in the SSTables directory is an SSTable which is not live,
+// or an incomplete SSTable.
+func (m *manifest) isOrphan(filename string) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	if strings.HasSuffix(filename, ".sstable.tmp") {
+		return true
+	}
+	_, ok := m.tables[filename]
+	return !ok && strings.HasSuffix(filename, ".sstable")
+}
+
+// close closes the manifest file.
+func (m *manifest) close() error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	return m.file.Close()
+}
+
+// removeOrphans removes all files from the directory which are not live tables of the manifest.
+func (m *manifest) removeOrphans(dir string) error {
+	files, err := utils.ListFilesOrdered(dir, "")
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if !m.isOrphan(filepath.Base(f.Name)) {
+			continue
+		}
+		log.Printf("[WARN] Removing orphan file=%s", f.Name)
+		err = os.Remove(f.Name)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+package lsmt
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/entry"
+	"github.com/alexander-akhmetov/mdb/pkg/test_utils"
+	"github.com/alexander-akhmetov/mdb/pkg/utils"
+)
+
+func TestVersionEdit(t *testing.T) {
+	edit := &versionEdit{
+		added: map[string]tableMeta{
+			"3.sstable": {level: 1, seq: 2},
+			"4.sstable": {level: 0, seq: 4},
+		},
+		removed:        []string{"1.sstable", "2.sstable"},
+		nextFileNumber: 5,
+	}
+
+	parsed, err := newVersionEdit(edit.entry())
+	assert.Nil(t, err)
+	assert.Equal(t, edit, parsed)
+}
+
+func TestManifest(t *testing.T) {
+	// the manifest must keep the state after all edits
+	testutils.SetUp()
+	defer testutils.Teardown()
+	os.MkdirAll(".test/manifest", os.ModePerm)
+
+	filename := ".test/manifest/MANIFEST"
+	m, err := newManifest(filename, map[string]tableMeta{"1.sstable": {level: 0, seq: 1}}, 2)
+	assert.Nil(t, err)
+
+	assert.Equal(t, int64(2), m.newFileNumber())
+	assert.Equal(t, int64(3), m.newFileNumber())
+	m.markFileNumberUsed(10)
+	assert.Equal(t, int64(11), m.newFileNumber())
+
+	err = m.apply(&versionEdit{added: map[string]tableMeta{"2.sstable": {level: 0, seq: 2}}})
+	assert.Nil(t, err)
+	err = m.apply(&versionEdit{
+		added:   map[string]tableMeta{"3.sstable": {level: 1, seq: 2}},
+		removed: []string{"1.sstable", "2.sstable"},
+	})
+	assert.Nil(t, err)
+	assert.Nil(t, m.close())
+
+	tables, nextFileNumber, err := readManifest(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]tableMeta{"3.sstable": {level: 1, seq: 2}}, tables)
+	assert.Equal(t, int64(12), nextFileNumber)
+
+	// a new manifest has only the current state
+	m, err = newManifest(filename, tables, nextFileNumber)
+	assert.Nil(t, err)
+	defer m.close()
+
+	newTables, newNextFileNumber, err := readManifest(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, tables, newTables)
+	assert.Equal(t, nextFileNumber, newNextFileNumber)
+	assert.False(t, testutils.IsFileExists(filename+".tmp"))
+}
+
+func TestManifestIgnoresIncompleteEdit(t *testing.T) {
+	// an edit which has not been written completely has never been applied
+	testutils.SetUp()
+	defer testutils.Teardown()
+	os.MkdirAll(".test/manifest", os.ModePerm)
+
+	filename := ".test/manifest/MANIFEST"
+	m, err := newManifest(filename, map[string]tableMeta{"1.sstable": {level: 0, seq: 1}}, 2)
+	assert.Nil(t, err)
+	assert.Nil(t, m.close())
+
+	edit := &versionEdit{removed: []string{"1.sstable"}, nextFileNumber: 3}
+	record := encodeRecord(edit.entry())
+	data := append(testutils.ReadFileBinary(filename), record[:len(record)-1]...)
+	testutils.CreateFile(filename, string(data))
+
+	tables, nextFileNumber, err := readManifest(filename)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]tableMeta{"1.sstable": {level: 0, seq: 1}}, tables)
+	assert.Equal(t, int64(2), nextFileNumber)
+}
+
+func TestManifestCorrupted(t *testing.T) {
+	testutils.SetUp()
+	defer testutils.Teardown()
+	os.MkdirAll(".test/manifest", os.ModePerm)
+
+	filename := ".test/manifest/MANIFEST"
+	m, err := newManifest(filename, map[string]tableMeta{"1.sstable": {level: 0, seq: 1}}, 2)
+	assert.Nil(t, err)
+	assert.Nil(t, m.apply(&versionEdit{removed: []string{"1.sstable"}}))
+	assert.Nil(t, m.close())
+
+	// flip a bit in the data of the first record
+	data := testutils.ReadFileBinary(filename)
+	data[checksumSize+entry.HeaderSize+1] ^= 1
+	testutils.CreateFile(filename, string(data))
+
+	_, _, err = readManifest(filename)
+	assert.True(t, errors.Is(err, utils.ErrCorrupted))
+}
+
+func TestManifestRemoveOrphans(t *testing.T) {
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	dir := ".test/manifest/sstables"
+	os.MkdirAll(dir+"/tmp", os.ModePerm)
+	for _, f := range []string{"1.sstable", "2.sstable", "3.sstable.tmp", "other.txt"} {
+		testutils.CreateFile(dir+"/"+f, "")
+	}
+
+	m, err := newManifest(".test/manifest/MANIFEST", map[string]tableMeta{"1.sstable": {level: 0, seq: 1}}, 4)
+	assert.Nil(t, err)
+	defer m.close()
+
+	assert.Nil(t, m.removeOrphans(dir))
+	assert.True(t, testutils.IsFileExists(dir+"/1.sstable"))
+	assert.False(t, testutils.IsFileExists(dir+"/2.sstable"))
+	assert.False(t, testutils.IsFileExists(dir+"/3.sstable.tmp"))
+	assert.True(t, testutils.IsFileExists(dir+"/other.txt"))
+	assert.True(t, testutils.IsFileExists(dir+"/tmp"))
+}
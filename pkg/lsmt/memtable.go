@@ -1,119 +1,246 @@
 package lsmt
 
 import (
-	"io"
+	"fmt"
 	"log"
 	"os"
-	"sort"
 	"sync"
+	"sync/atomic"
 
 	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/entry"
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/skiplist"
 	"github.com/alexander-akhmetov/mdb/pkg/utils"
 )
 
-var writeMutex = &sync.Mutex{}
-
 const aoLogReadBufferSize = 4096
 
+// memtableEntryOverhead is an estimation of the memory used by one memtable entry besides its key and value:
+// the entry struct, string headers, and the skip list node.
+const memtableEntryOverhead = 96
+
+// memtable keeps entries sorted by key in a skip list.
+// Writes go through the write queue one group at a time, reads don't need locks.
 type memtable struct {
-	data        map[string]string // In-memory data structure to keep information before saving to disk as SSTable.
-	logFilename string            // AOLog: append-only log to restore information in case of a crash.
-	timestamp   int64             // Used for the flush process.
+	// Memory used by the entries in bytes, it's accessed atomically.
+	// It's the first field to be aligned on 32-bit platforms.
+	size int64
+
+	data        *skiplist.SkipList // In-memory data structure to keep information before saving to disk as SSTable.
+	log         *aoLogWriter       // AOLog: append-only log to restore information in case of a crash.
+	logFilename string             // The path of AOLog, it's changed when the memtable goes to the flush queue.
+	fileNumber  int64              // Used for the flush process: the number of the SSTable file.
+
+	writeMutex sync.Mutex // protects writeQueue
+	writeCond  *sync.Cond // signals that a group of writes is done
+	writeQueue []*writeRequest
 }
 
-// Set writes information to AOLog.
-func (m *memtable) Set(key string, value string) {
-	m.appendToLog(key, value)
-	m.data[key] = value
+// writeRequest is a write which waits in the memtable write queue.
+type writeRequest struct {
+	record  []byte           // the AOLog record
+	entries []*entry.DBEntry // entries which are added to the memtable after the record is saved
+	done    bool
+	err     error
 }
 
-// appendToLog appends binary data to AOLog
-func (m *memtable) appendToLog(key string, value string) {
-	writeMutex.Lock()
-	defer writeMutex.Unlock()
-
-	log.Printf("[DEBUG] Adding key=%s to AOLog", key)
-	appendBinaryToFile(m.logFilename, &entry.DBEntry{
-		Type:  0,
+// Set writes information to AOLog.
+func (m *memtable) Set(key string, value string) error {
+	return m.put(&entry.DBEntry{
+		Type:  entry.TypeValue,
 		Key:   key,
 		Value: value,
 	})
 }
 
-// Get returns the value of a key from the memtable.
-func (m *memtable) Get(key string) (string, bool) {
-	if value, ok := m.data[key]; ok {
-		return value, true
+// Delete writes a tombstone for the key to AOLog.
+// The tombstone hides all older versions of the key.
+func (m *memtable) Delete(key string) error {
+	return m.put(&entry.DBEntry{
+		Type: entry.TypeTombstone,
+		Key:  key,
+	})
+}
+
+// put saves the entry to AOLog and to the memtable.
+func (m *memtable) put(e *entry.DBEntry) error {
+	return m.write(&writeRequest{record: encodeRecord(e), entries: []*entry.DBEntry{e}})
+}
+
+// applyBatch saves all entries to AOLog as one batch record and then applies them to the memtable.
+// If the record is not fully written because of a crash, none of the entries are restored.
+func (m *memtable) applyBatch(entries []*entry.DBEntry) error {
+	return m.write(&writeRequest{record: encodeRecord(entry.NewBatchEntry(entries)), entries: entries})
+}
+
+// write saves the record of the request to AOLog and adds its entries to the memtable.
+// The memtable is not changed if the record can't be saved to AOLog.
+// Records bigger than maxEntrySize are rejected: they couldn't be restored from AOLog.
+//
+// Concurrent writes are grouped (group commit): the first request in the queue becomes the leader,
+// it saves the records of all waiting requests with one system call and one sync,
+// and adds their entries to the memtable in the order of the queue. Other requests just wait for the result.
+func (m *memtable) write(req *writeRequest) error {
+	if len(req.record) > maxEntrySize {
+		return fmt.Errorf("record size=%v exceeds the limit=%v: %w", len(req.record), maxEntrySize, utils.ErrTooBig)
+	}
+
+	m.writeMutex.Lock()
+	m.writeQueue = append(m.writeQueue, req)
+	for !req.done && m.writeQueue[0] != req {
+		m.writeCond.Wait()
+	}
+	if req.done {
+		m.writeMutex.Unlock()
+		return req.err
+	}
+	group := m.writeQueue
+	m.writeMutex.Unlock()
+
+	records := []byte{}
+	for _, r := range group {
+		records = append(records, r.record...)
+	}
+	log.Printf("[DEBUG] Adding %v records to AOLog", len(group))
+	err := m.log.write(records)
+	if err == nil {
+		for _, r := range group {
+			for _, e := range r.entries {
+				m.add(e)
+			}
+		}
+	}
+
+	m.writeMutex.Lock()
+	m.writeQueue = m.writeQueue[len(group):]
+	for _, r := range group {
+		r.done = true
+		r.err = err
+	}
+	m.writeCond.Broadcast()
+	m.writeMutex.Unlock()
+	return err
+}
+
+// add puts the entry to the memtable and updates its size.
+// A new version of a key replaces the old one, so the size of the old version is subtracted.
+func (m *memtable) add(e *entry.DBEntry) {
+	delta := entryMemorySize(e)
+	if old, ok := m.Get(e.Key); ok {
+		delta -= entryMemorySize(old)
+	}
+	m.data.Put(e.Key, e)
+	atomic.AddInt64(&m.size, delta)
+}
+
+// entryMemorySize returns the estimated number of bytes which the entry takes in the memtable.
+func entryMemorySize(e *entry.DBEntry) int64 {
+	return int64(len(e.Key) + len(e.Value) + memtableEntryOverhead)
+}
+
+// Get returns the entry of a key from the memtable.
+// The entry can be a tombstone, it means that the key has been deleted.
+func (m *memtable) Get(key string) (*entry.DBEntry, bool) {
+	if e, ok := m.data.Get(key); ok {
+		return e.(*entry.DBEntry), true
 	}
 
-	return "", false
+	return nil, false
 }
 
-// Size returns the size of a memtable in bytes.
+// Size returns the size of a memtable in bytes: keys, values and the overhead of every entry.
 // It's needed to decide if we need to dump this memtable to disk as an SSTable or not.
 func (m *memtable) Size() int64 {
-	return int64(len(m.data))
+	return atomic.LoadInt64(&m.size)
 }
 
 // restoreFromLog reads the AOLog file and restores all information back to the memtable.
 // We use it in case of a crash or when the server was stopped with some information in the memtable.
-func (m *memtable) restoreFromLog() {
+func (m *memtable) restoreFromLog() error {
 	file, err := os.OpenFile(m.logFilename, os.O_RDONLY, 0600)
 	if os.IsNotExist(err) {
 		// if file doesn't exist - it's a new memtable
 		log.Println("[DEBUG] AOLog file does not exist, skipping restoring process")
-		utils.CreateFileIfNotExists(m.logFilename)
-		return
+		return utils.CreateFileIfNotExists(m.logFilename)
 	}
 
 	log.Println("[DEBUG] AOLog file exists, restoring...")
 
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 	defer file.Close()
 
 	scanner := newBinFileScanner(file, aoLogReadBufferSize)
 
+	// The scanner returns only complete records, so a batch
+	// which has been written partially before a crash is skipped entirely.
 	for scanner.Scan() {
-		entry, _ := entry.NewDBEntry(scanner.Bytes())
-		m.data[entry.Key] = entry.Value
-	}
-	counter := len(m.data)
-	log.Printf("[DEBUG] Restored %v entries", counter)
-}
+		e, err := entry.NewDBEntry(scanner.Bytes())
+		if err != nil {
+			return err
+		}
 
-// Write writes binary representation of the memtable to io.Writer
-func (m *memtable) Write(wr io.Writer) (n int, err error) {
-	result := []*entry.DBEntry{}
-	for key, value := range m.data {
-		result = append(result, &entry.DBEntry{
-			Key:   key,
-			Value: value,
-			Type:  0,
-		})
-	}
-	sort.Slice(result, func(i, j int) bool {
-		return result[i].Key < result[j].Key
-	})
+		if e.Type != entry.TypeBatch {
+			m.add(e)
+			continue
+		}
+
+		batchEntries, err := e.BatchEntries()
+		if err != nil {
+			return &utils.CorruptionError{
+				Filename: m.logFilename,
+				Offset:   scanner.Offset() - int64(checksumSize+e.Length()),
+				Reason:   fmt.Sprintf("can't restore batch: %v", err),
+			}
+		}
+		for _, be := range batchEntries {
+			m.add(be)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
 
-	for _, entry := range result {
-		written, err := entry.Write(wr)
+	// Remove the incomplete record, otherwise new records would be appended after it
+	// and we would not be able to read them.
+	size, err := utils.GetFileSize(m.logFilename)
+	if err != nil {
+		return err
+	}
+	if size > scanner.Offset() {
+		log.Printf("[WARN] AOLog file=%s has an incomplete record at offset=%v, truncating it", m.logFilename, scanner.Offset())
+		err = os.Truncate(m.logFilename, scanner.Offset())
 		if err != nil {
-			return n, err
+			return err
 		}
-		n += written
 	}
 
-	return n, err
+	counter := m.data.Len()
+	log.Printf("[DEBUG] Restored %v entries", counter)
+	return nil
+}
+
+// closeLog syncs and closes AOLog. The memtable can't be changed after that.
+func (m *memtable) closeLog() error {
+	return m.log.close()
 }
 
 // newMemtable returns a new instance of a writer.
-func newMemtable(aoLogFileName string) *memtable {
+// It restores entries from AOLog and opens it for new records.
+func newMemtable(aoLogFileName string, logConfig aoLogConfig) (*memtable, error) {
 	m := &memtable{
-		data:        map[string]string{},
+		data:        skiplist.New(),
 		logFilename: aoLogFileName,
 	}
-	m.restoreFromLog()
-	return m
+	m.writeCond = sync.NewCond(&m.writeMutex)
+
+	err := m.restoreFromLog()
+	if err != nil {
+		return nil, err
+	}
+	m.log, err = newAOLogWriter(aoLogFileName, logConfig)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
 }
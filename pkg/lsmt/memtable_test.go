@@ -1,39 +1,36 @@
 package lsmt
 
 import (
+	"errors"
 	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/entry"
 	"github.com/alexander-akhmetov/mdb/pkg/test_utils"
+	"github.com/alexander-akhmetov/mdb/pkg/utils"
 )
 
-func TestMemtableFlush(t *testing.T) {
-	// test that when we flush memtable to disk it writes it correctly
-	// and the keys are sorted
+func TestMemtableSortedEntries(t *testing.T) {
+	// test that the memtable returns entries sorted by key
+	// for the flush process
 	testutils.SetUp()
 	defer testutils.Teardown()
 
-	m := newMemtable(".test/log")
+	m, err := newMemtable(".test/log", aoLogConfig{})
+	assert.Nil(t, err)
 
 	m.Set("k2", "v2")
 	m.Set("k1", "v1")
+	m.Delete("k0")
 
-	filename := ".test/dump"
-	file, _ := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
-
-	_, err := m.Write(file)
-	file.Close()
-
-	assert.Nil(t, err)
-
-	expData := []byte{0x0, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x2, 0x6b, 0x31, 0x76, 0x31, 0x0, 0x0, 0x0, 0x0, 0x2, 0x0, 0x0, 0x0, 0x2, 0x6b, 0x32, 0x76, 0x32}
-	data := testutils.ReadFileBinary(filename)
-	assert.Equal(t, expData, data)
-
-	expDataStr := "\x00\x00\x00\x00\x02\x00\x00\x00\x02k1v1\x00\x00\x00\x00\x02\x00\x00\x00\x02k2v2"
-	assert.Equal(t, expDataStr, string(data))
+	expEntries := []*entry.DBEntry{
+		{Type: entry.TypeTombstone, Key: "k0"},
+		{Type: entry.TypeValue, Key: "k1", Value: "v1"},
+		{Type: entry.TypeValue, Key: "k2", Value: "v2"},
+	}
+	assert.Equal(t, expEntries, memtableEntries(m))
 }
 
 func TestNewMemtable(t *testing.T) {
@@ -42,9 +39,10 @@ func TestNewMemtable(t *testing.T) {
 	defer testutils.Teardown()
 
 	f := ".test/log"
-	m := newMemtable(f)
+	m, err := newMemtable(f, aoLogConfig{})
+	assert.Nil(t, err)
 
-	assert.Equal(t, map[string]string{}, m.data)
+	assert.Equal(t, 0, m.data.Len())
 	assert.Equal(t, f, m.logFilename)
 }
 
@@ -52,21 +50,40 @@ func TestSize(t *testing.T) {
 	testutils.SetUp()
 	defer testutils.Teardown()
 
-	m := newMemtable(".test/log")
+	m, err := newMemtable(".test/log", aoLogConfig{})
+	assert.Nil(t, err)
 
 	// at first the size is zero
 	assert.Equal(t, int64(0), m.Size())
 
+	// keys and values are counted in bytes with the overhead of every entry
 	m.Set("k1", "v1")
-	assert.Equal(t, int64(1), m.Size())
+	assert.Equal(t, int64(4+memtableEntryOverhead), m.Size())
 
 	// add the same key, the size must be the same
 	m.Set("k1", "v1")
-	assert.Equal(t, int64(1), m.Size())
+	assert.Equal(t, int64(4+memtableEntryOverhead), m.Size())
 
 	// a new key: the size must change
 	m.Set("k2", "v2")
-	assert.Equal(t, int64(2), m.Size())
+	assert.Equal(t, int64(8+2*memtableEntryOverhead), m.Size())
+
+	// a bigger value replaces the old one
+	m.Set("k1", "value")
+	assert.Equal(t, int64(11+2*memtableEntryOverhead), m.Size())
+
+	// a tombstone doesn't have a value
+	m.Delete("k2")
+	assert.Equal(t, int64(9+2*memtableEntryOverhead), m.Size())
+
+	// batches and restored entries are counted the same way
+	m.applyBatch([]*entry.DBEntry{
+		{Type: entry.TypeValue, Key: "k3", Value: "v3"},
+		{Type: entry.TypeValue, Key: "k1", Value: "v1"},
+	})
+	assert.Equal(t, int64(10+3*memtableEntryOverhead), m.Size())
+	m = restoreMemtable(t, ".test/log")
+	assert.Equal(t, int64(10+3*memtableEntryOverhead), m.Size())
 }
 
 func TestAppendOnlyLog(t *testing.T) {
@@ -76,7 +93,8 @@ func TestAppendOnlyLog(t *testing.T) {
 
 	f := ".test/log"
 
-	m := newMemtable(f)
+	m, err := newMemtable(f, aoLogConfig{})
+	assert.Nil(t, err)
 
 	data := testutils.ReadFileBinary(f)
 	assert.Equal(t, []byte{}, data)
@@ -84,34 +102,181 @@ func TestAppendOnlyLog(t *testing.T) {
 	// add a key-value pair and check aolog
 	m.Set("k", "v")
 
-	expData := []byte{0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x1, 0x6b, 0x76}
+	expData := []byte{0x19, 0xc5, 0xf5, 0x8c, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x1, 0x6b, 0x76}
 	data = testutils.ReadFileBinary(f)
 	assert.Equal(t, expData, data)
 
-	// dump this data: it must be the same
-	df := ".test/dump"
-	file, _ := os.OpenFile(df, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
-	_, err := m.Write(file)
-	file.Close()
-	assert.Nil(t, err)
-	data = testutils.ReadFileBinary(df)
-	assert.Equal(t, expData, data)
+	// the memtable must have the same data
+	assert.Equal(t, []*entry.DBEntry{{Key: "k", Value: "v"}}, memtableEntries(m))
 
 	// add a new value for the same key and check aolog
 	m.Set("k", "v2")
 
-	expData = []byte{0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x1, 0x6b, 0x76, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x2, 0x6b, 0x76, 0x32}
+	expData = []byte{0x19, 0xc5, 0xf5, 0x8c, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x1, 0x6b, 0x76, 0x2e, 0x2b, 0xd2, 0x73, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x2, 0x6b, 0x76, 0x32}
 	data = testutils.ReadFileBinary(f)
 	assert.Equal(t, expData, data)
 
-	// dump this data again:
-	// it must save only the last value for the key
-	os.Remove(df)
-	file, _ = os.OpenFile(df, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
-	_, err = m.Write(file)
-	file.Close()
+	// the memtable must keep only the last value for the key
+	assert.Equal(t, []*entry.DBEntry{{Key: "k", Value: "v2"}}, memtableEntries(m))
+}
+
+func TestMemtableDelete(t *testing.T) {
+	// test that Delete writes a tombstone to the memtable and to the append only log
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	f := ".test/log"
+	m, err := newMemtable(f, aoLogConfig{})
 	assert.Nil(t, err)
-	data = testutils.ReadFileBinary(df)
-	expData = []byte{0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x2, 0x6b, 0x76, 0x32}
-	assert.Equal(t, expData, data)
+
+	m.Set("k", "v")
+	m.Delete("k")
+
+	e, found := m.Get("k")
+	assert.True(t, found)
+	assert.True(t, e.IsTombstone())
+
+	expData := []byte{0x19, 0xc5, 0xf5, 0x8c, 0x0, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x1, 0x6b, 0x76, 0x3f, 0xf4, 0xd8, 0x8e, 0x1, 0x0, 0x0, 0x0, 0x1, 0x0, 0x0, 0x0, 0x0, 0x6b}
+	assert.Equal(t, expData, testutils.ReadFileBinary(f))
+
+	// the tombstone must be restored from the log
+	m, err = newMemtable(f, aoLogConfig{})
+	assert.Nil(t, err)
+	e, found = m.Get("k")
+	assert.True(t, found)
+	assert.True(t, e.IsTombstone())
+}
+
+func TestMemtableApplyBatch(t *testing.T) {
+	// test that a batch is saved as one record and restored from the log
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	f := ".test/log"
+	m, err := newMemtable(f, aoLogConfig{})
+	assert.Nil(t, err)
+
+	m.Set("k1", "v1")
+	entries := []*entry.DBEntry{
+		{Type: entry.TypeValue, Key: "k2", Value: "v2"},
+		{Type: entry.TypeTombstone, Key: "k1"},
+	}
+	err = m.applyBatch(entries)
+	assert.Nil(t, err)
+
+	expData := encodeRecord(&entry.DBEntry{Key: "k1", Value: "v1"})
+	expData = append(expData, encodeRecord(entry.NewBatchEntry(entries))...)
+	assert.Equal(t, expData, testutils.ReadFileBinary(f))
+
+	for _, m := range []*memtable{m, restoreMemtable(t, f)} {
+		e, found := m.Get("k1")
+		assert.True(t, found)
+		assert.True(t, e.IsTombstone())
+
+		e, found = m.Get("k2")
+		assert.True(t, found)
+		assert.Equal(t, "v2", e.Value)
+	}
+}
+
+func TestMemtableRestoreIgnoresTruncatedBatch(t *testing.T) {
+	// test that a batch which has been written partially is ignored completely
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	f := ".test/log"
+	m, err := newMemtable(f, aoLogConfig{})
+	assert.Nil(t, err)
+
+	m.Set("k1", "v1")
+	err = m.applyBatch([]*entry.DBEntry{
+		{Type: entry.TypeValue, Key: "k2", Value: "v2"},
+		{Type: entry.TypeValue, Key: "k3", Value: "v3"},
+	})
+	assert.Nil(t, err)
+
+	// simulate a crash in the middle of the batch writing
+	data := testutils.ReadFileBinary(f)
+	assert.Nil(t, os.Truncate(f, int64(len(data)-3)))
+
+	m = restoreMemtable(t, f)
+	assert.Equal(t, 1, m.data.Len())
+	_, found := m.Get("k2")
+	assert.False(t, found)
+	_, found = m.Get("k3")
+	assert.False(t, found)
+
+	// the incomplete record is removed, so new records can be restored too
+	m.Set("k4", "v4")
+	m = restoreMemtable(t, f)
+	assert.Equal(t, 2, m.data.Len())
+	e, found := m.Get("k4")
+	assert.True(t, found)
+	assert.Equal(t, "v4", e.Value)
+}
+
+func restoreMemtable(t *testing.T, f string) *memtable {
+	m, err := newMemtable(f, aoLogConfig{})
+	assert.Nil(t, err)
+	return m
+}
+
+func TestMemtableRestoreCorruptedLog(t *testing.T) {
+	// a record with a wrong checksum in the middle of the log means that the log is corrupted
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	f := ".test/log"
+	m, err := newMemtable(f, aoLogConfig{})
+	assert.Nil(t, err)
+	m.Set("k1", "v1")
+	m.Set("k2", "v2")
+	m.Set("k3", "v3")
+
+	// flip a bit in the value of the second record
+	data := testutils.ReadFileBinary(f)
+	recordLength := len(encodeRecord(&entry.DBEntry{Key: "k1", Value: "v1"}))
+	data[2*recordLength-1] ^= 1
+	testutils.CreateFile(f, string(data))
+
+	_, err = newMemtable(f, aoLogConfig{})
+	var corruptionErr *utils.CorruptionError
+	assert.True(t, errors.As(err, &corruptionErr))
+	assert.True(t, errors.Is(err, utils.ErrCorrupted))
+	assert.Equal(t, f, corruptionErr.Filename)
+	assert.Equal(t, int64(recordLength), corruptionErr.Offset)
+}
+
+func TestMemtableRestoreIgnoresCorruptedLastRecord(t *testing.T) {
+	// a record with a wrong checksum at the end of the log is a torn write
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	f := ".test/log"
+	m, err := newMemtable(f, aoLogConfig{})
+	assert.Nil(t, err)
+	m.Set("k1", "v1")
+	m.Set("k2", "v2")
+
+	data := testutils.ReadFileBinary(f)
+	data[len(data)-1] ^= 1
+	testutils.CreateFile(f, string(data))
+
+	m = restoreMemtable(t, f)
+	assert.Equal(t, 1, m.data.Len())
+	_, found := m.Get("k2")
+	assert.False(t, found)
+
+	// the broken record is removed
+	assert.Equal(t, encodeRecord(&entry.DBEntry{Key: "k1", Value: "v1"}), testutils.ReadFileBinary(f))
+}
+
+// memtableEntries returns all entries of the memtable in the sorted order.
+func memtableEntries(m *memtable) []*entry.DBEntry {
+	entries := []*entry.DBEntry{}
+	it := newMemtableIterator(m, "", "")
+	for it.Next() {
+		entries = append(entries, it.Entry())
+	}
+	return entries
 }
@@ -0,0 +1,21 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd && !solaris
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+package lsmt
+
+import (
+	"errors"
+	"os"
+)
+
+const mmapSupported = false
+
+var errMmapUnsupported = errors.New("mmap is not supported on this platform")
+
+func mmapFile(file *os.File, size int64) ([]byte, error) {
+	return nil, errMmapUnsupported
+}
+
+func munmapFile(data []byte) error {
+	return errMmapUnsupported
+}
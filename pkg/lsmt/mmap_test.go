@@ -0,0 +1,161 @@
+package lsmt
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/cache"
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/entry"
+	"github.com/alexander-akhmetov/mdb/pkg/test_utils"
+	"github.com/alexander-akhmetov/mdb/pkg/utils"
+)
+
+func skipIfMmapUnsupported(t *testing.T) {
+	if !mmapSupported {
+		t.Skip("mmap is not supported on this platform")
+	}
+}
+
+func TestSSTableMmap(t *testing.T) {
+	skipIfMmapUnsupported(t)
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	filename := ".test/sstables-test/0.sstable"
+	createSSTable(filename, [][2]string{{"k1", "v1"}, {"k2", "v2"}})
+
+	blockCache := cache.New(1024)
+	table, err := newSSTable(&ssTableConfig{filename: filename, blockCache: blockCache, mmap: true})
+	assert.Nil(t, err)
+	assert.NotNil(t, table.mapped)
+
+	e, found, err := table.Get("k2")
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, "v2", e.Value)
+	// uncompressed blocks are read from the mapping, the cache is not used for them
+	assert.Equal(t, int64(0), blockCache.Size())
+	assert.Equal(t, int64(0), blockCache.Misses())
+
+	// the iterator keeps the file mapped after the table has been removed
+	it, err := newSSTableIterator(table, "", "")
+	assert.Nil(t, err)
+	table.retire()
+	assert.Equal(t, int32(1), table.mapped.refs)
+
+	keys := []string{}
+	for it.Next() {
+		keys = append(keys, it.Entry().Key)
+	}
+	assert.Nil(t, it.Err())
+	assert.Equal(t, []string{"k1", "k2"}, keys)
+
+	it.Close()
+	assert.Equal(t, int32(0), table.mapped.refs)
+
+	_, _, err = table.Get("k1")
+	assert.True(t, errors.Is(err, utils.ErrClosed))
+}
+
+func TestSSTableMmapCompressedBlocks(t *testing.T) {
+	// decompressed blocks don't point to the mapping, so they are cached
+	skipIfMmapUnsupported(t)
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	filename := ".test/sstables-test/0.sstable"
+	config := ssTableWriterConfig{blockSize: defaultReadBufferSize, compression: DeflateCompression}
+	createSSTableWithConfig(filename, config, []*entry.DBEntry{
+		{Type: entry.TypeValue, Key: "k1", Value: strings.Repeat("v", 1000)},
+	})
+
+	blockCache := cache.New(4096)
+	table, err := newSSTable(&ssTableConfig{filename: filename, blockCache: blockCache, mmap: true})
+	assert.Nil(t, err)
+	defer table.retire()
+
+	e, found, err := table.Get("k1")
+	assert.Nil(t, err)
+	assert.True(t, found)
+	assert.Equal(t, strings.Repeat("v", 1000), e.Value)
+	assert.True(t, blockCache.Size() > 0)
+	assert.Equal(t, int64(1), blockCache.Misses())
+
+	_, _, err = table.Get("k1")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1), blockCache.Hits())
+}
+
+func TestStorageMmap(t *testing.T) {
+	skipIfMmapUnsupported(t)
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	createSSTable(".test/lsmt_data/sstables/0.sstable", [][2]string{{"k1", "v1"}, {"k3", "v3"}})
+	createSSTable(".test/lsmt_data/sstables/1.sstable", [][2]string{{"k2", "v2"}})
+
+	storage := &Storage{
+		Config: StorageConfig{
+			WorkDir: ".test/lsmt_data/",
+			UseMmap: true,
+		},
+	}
+	assert.Nil(t, storage.Start())
+
+	// mapped files are not kept in the file cache
+	it, err := storage.Scan("", "")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, storage.files.len())
+
+	task, err := storage.compactOnce()
+	assert.Nil(t, err)
+	assert.NotNil(t, task)
+
+	keys := []string{}
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+	assert.Nil(t, it.Err())
+	it.Close()
+	assert.Equal(t, []string{"k1", "k2", "k3"}, keys)
+
+	for i := 1; i <= 3; i++ {
+		value, found, err := storage.Get(fmt.Sprintf("k%v", i))
+		assert.Nil(t, err)
+		assert.True(t, found)
+		assert.Equal(t, fmt.Sprintf("v%v", i), value)
+	}
+	stats := storage.Stats()
+	assert.Equal(t, int64(0), stats.BlockCacheHits)
+	assert.Equal(t, int64(0), stats.BlockCacheMisses)
+
+	tables := storage.ssTables
+	assert.Nil(t, storage.Stop())
+	for _, table := range tables {
+		assert.Equal(t, int32(0), table.mapped.refs)
+	}
+}
+
+func TestStorageMmapConcurrentAccess(t *testing.T) {
+	skipIfMmapUnsupported(t)
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	storage := &Storage{
+		Config: StorageConfig{
+			WorkDir:            ".test/lsmt_data/",
+			CompactionEnabled:  true,
+			CompactionStrategy: &LeveledStrategy{Level0FilesToCompact: 2},
+			MaxMemtableSize:    2048,
+			UseMmap:            true,
+		},
+	}
+	assert.Nil(t, storage.Start())
+	defer storage.Stop()
+
+	testutils.StressTest(t, storage, testutils.StressConfig{Writers: 4, Readers: 4, Keys: 100, Rounds: 3})
+}
@@ -1,102 +1,418 @@
 package lsmt
 
 import (
-	"io"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/bloom"
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/cache"
 	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/entry"
-	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/rbt"
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/index"
 	"github.com/alexander-akhmetov/mdb/pkg/utils"
 )
 
 type ssTableConfig struct {
-	readBufferSize int
-	filename       string
+	filename   string
+	blockCache *cache.Cache // shared by all tables of the storage, nil disables caching
+	files      *fileCache   // shared by all tables of the storage, nil means that every read opens the file
+	mmap       bool         // map the file into memory once instead of reading it, files are not used then
 }
 
 const defaultReadBufferSize = 4096
 
 type ssTable struct {
-	index  *rbt.RedBlackTree
-	config *ssTableConfig
+	index      *index.Index // the last key of every data block, the position of a key is the position of the block
+	blocks     []blockHandle
+	filter     *bloom.Filter // can be nil if the table doesn't have a filter
+	dataSize   int64         // size of the file without the footer
+	version    uint32        // format version of the file
+	size       int64         // size of the file
+	fileNumber int64         // number from the filename
+	seq        int64         // tables with bigger sequences have newer data
+	level      int
+	smallest   string // the smallest key, empty if the table has no keys
+	largest    string // the largest key, empty if the table has no keys
+	createdAt  time.Time
+	cacheID    uint64     // identifies blocks of the table in the block cache
+	mapped     *tableFile // the mapped file, nil if the table isn't mapped
+	config     *ssTableConfig
 }
 
 // listSSTables returns filenames ordered by last modified time in descending order.
-func listSSTables(dir string) []utils.FileInfo {
+func listSSTables(dir string) ([]utils.FileInfo, error) {
 	return utils.ListFilesOrdered(dir, ".sstable")
 }
 
-func (s *ssTable) Get(key string) (string, bool) {
-	offset := s.index.GetClosest(key)
+// sortSSTables orders tables the way we search keys in them:
+// level by level starting from level 0, and newer tables first inside of every level.
+func sortSSTables(tables []*ssTable) {
+	sort.SliceStable(tables, func(i, j int) bool {
+		if tables[i].level != tables[j].level {
+			return tables[i].level < tables[j].level
+		}
+		if tables[i].seq != tables[j].seq {
+			return tables[i].seq > tables[j].seq
+		}
+		return tables[i].fileNumber > tables[j].fileNumber
+	})
+}
+
+// isEmpty returns true if the table has no keys.
+func (s *ssTable) isEmpty() bool {
+	return len(s.blocks) == 0
+}
+
+// info returns the description of the table for compaction strategies.
+func (s *ssTable) info() TableInfo {
+	return TableInfo{
+		Filename:  s.config.filename,
+		Level:     s.level,
+		Size:      s.size,
+		Empty:     s.isEmpty(),
+		Smallest:  s.smallest,
+		Largest:   s.largest,
+		CreatedAt: s.createdAt,
+	}
+}
+
+// mayContain returns false if the key is out of the key range of the table.
+func (s *ssTable) mayContain(key string) bool {
+	return !s.isEmpty() && key >= s.smallest && key <= s.largest
+}
+
+// Get returns the entry of a key from the SSTable.
+// The entry can be a tombstone, it means that the key has been deleted.
+func (s *ssTable) Get(key string) (*entry.DBEntry, bool, error) {
+	if !s.mayContain(key) {
+		return nil, false, nil
+	}
+
+	if s.filter != nil && !s.filter.MayContain(key) {
+		log.Printf("[DEBUG] key=%s is not in the bloom filter of sstable=%s", key, s.config.filename)
+		return nil, false, nil
+	}
+
+	position, found := s.findBlock(key)
+	if !found {
+		// the key is bigger than all keys of the table
+		return nil, false, nil
+	}
+
+	log.Printf("[DEBUG] Reading block=%v to find key=%s", position, key)
 
-	file, err := os.OpenFile(s.config.filename, os.O_RDONLY, 0600)
+	data, release, err := s.readDataBlock(position)
 	if err != nil {
-		log.Panicf("[ERROR]: Can't read sstable file=%s, err:%v", s.config.filename, err)
+		return nil, false, err
+	}
+	defer release()
+
+	it := newBlockIterator(data, s.version)
+	if it.Seek(key) && it.Entry().Key == key {
+		return it.Entry(), true, nil
+	}
+
+	if it.Err() != nil {
+		return nil, false, fmt.Errorf("can't read block of sstable file=%s: %w", s.config.filename, it.Err())
+	}
+	return nil, false, nil
+}
+
+// readDataBlock returns the data block from the block cache or reads it from the file and caches it.
+// Uncompressed blocks of a mapped table are already in memory: they are read from the mapping
+// without the block cache, and release must be called when the block is not used anymore.
+func (s *ssTable) readDataBlock(position int) (data []byte, release func(), err error) {
+	h := s.blocks[position]
+	if s.mapped != nil {
+		data, release, err = s.readMappedDataBlock(h)
+		if err != nil || release != nil {
+			return data, release, err
+		}
 	}
-	defer file.Close()
 
-	log.Printf("[DEBUG] Reading file from offset=%v to find key=%s", offset, key)
+	key := cache.Key{Table: s.cacheID, Offset: h.offset}
+	if s.config.blockCache != nil {
+		if data, found := s.config.blockCache.Get(key); found {
+			return data, func() {}, nil
+		}
+	}
 
-	file.Seek(int64(offset), io.SeekStart)
-	scanner := newBinFileScanner(file, s.config.readBufferSize)
+	f, err := s.openFile()
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't read sstable file=%s: %w", s.config.filename, err)
+	}
+
+	data, mapped, err := f.readBlock(h, s.dataSize, s.version)
+	if err != nil {
+		f.release()
+		return nil, nil, fmt.Errorf("can't read block of sstable file=%s: %w", s.config.filename, err)
+	}
+
+	// mapped blocks are already in memory, and they are unmapped with the file
+	if mapped {
+		return data, f.release, nil
+	}
+	f.release()
+	if s.config.blockCache != nil {
+		s.config.blockCache.Put(key, data)
+	}
+	return data, func() {}, nil
+}
+
+// readMappedDataBlock returns the block from the mapping if it's stored uncompressed.
+// Otherwise, it returns a nil release func, and the block must be read the usual way.
+func (s *ssTable) readMappedDataBlock(h blockHandle) (data []byte, release func(), err error) {
+	f, err := s.openFile()
+	if err != nil {
+		return nil, nil, fmt.Errorf("can't read sstable file=%s: %w", s.config.filename, err)
+	}
+	err = checkBlockHandle(f.name, h, s.dataSize, s.version)
+	if err != nil || !isStoredUncompressed(f.data, h, s.version) {
+		// a broken handle is reported by the usual read
+		f.release()
+		return nil, nil, nil
+	}
 
-	counter := 0
-	for scanner.Scan() {
-		counter++
-		entry, _ := entry.NewDBEntry(scanner.Bytes())
+	data, _, err = f.readBlock(h, s.dataSize, s.version)
+	if err != nil {
+		f.release()
+		return nil, nil, fmt.Errorf("can't read block of sstable file=%s: %w", s.config.filename, err)
+	}
+	return data, f.release, nil
+}
 
-		if entry.Key == key {
-			log.Printf("[DEBUG] Scanned %v entries to find the key", counter)
-			return entry.Value, true
+// openFile returns the open file of the table, it must be released after use.
+func (s *ssTable) openFile() (*tableFile, error) {
+	if s.mapped != nil {
+		if !s.mapped.acquire() {
+			return nil, fmt.Errorf("sstable file=%s is unmapped: %w", s.config.filename, utils.ErrClosed)
 		}
+		return s.mapped, nil
+	}
+	if s.config.files != nil {
+		return s.config.files.acquire(s)
+	}
+
+	file, err := os.OpenFile(s.config.filename, os.O_RDONLY, filePermissions)
+	if err != nil {
+		return nil, err
+	}
+	return &tableFile{file: file, name: file.Name(), refs: 1}, nil
+}
+
+// mmap maps the file of the table into memory. The table holds the mapping until it's unmapped.
+func (s *ssTable) mmap() error {
+	file, err := os.OpenFile(s.config.filename, os.O_RDONLY, filePermissions)
+	if err != nil {
+		return err
 	}
+	defer file.Close()
 
-	return "", false
+	data, err := mmapFile(file, s.size)
+	if err != nil {
+		return err
+	}
+	s.mapped = &tableFile{data: data, name: s.config.filename, refs: 1}
+	return nil
 }
 
-// rebuildSparseIndex reads the entire file and builds the initial index.
-func (s *ssTable) rebuildSparseIndex() {
-	s.index = rbt.NewRBTree()
+// unmap releases the mapping held by the table.
+// Readers which still use the mapped file can finish, it's unmapped after them.
+func (s *ssTable) unmap() {
+	if s.mapped != nil {
+		s.mapped.release()
+	}
+}
 
-	file, err := os.OpenFile(s.config.filename, os.O_RDONLY, 0600)
+// retire removes blocks of the table from the block cache and its file from the file cache or unmaps it,
+// it's called when the table is removed. Readers which still use the file can finish reading it.
+func (s *ssTable) retire() {
+	if s.config.blockCache != nil {
+		s.config.blockCache.EvictTable(s.cacheID)
+	}
+	if s.config.files != nil {
+		s.config.files.evict(s)
+	}
+	s.unmap()
+}
+
+// findBlock returns the position of the first block which can contain the key:
+// the block with the smallest last key which is not less than the key.
+func (s *ssTable) findBlock(key string) (int, bool) {
+	return s.index.Ceiling(key)
+}
+
+// load reads the footer, the index and the meta blocks of the table.
+// It doesn't depend on the size of the table: only a few reads are needed.
+func (s *ssTable) load() error {
+	file, err := os.OpenFile(s.config.filename, os.O_RDONLY, filePermissions)
 	if err != nil {
-		log.Printf("[ERROR]: Can't read sstable file=%s, err:%v", s.config.filename, err)
-		return
+		return fmt.Errorf("can't read sstable file=%s: %w", s.config.filename, err)
 	}
 	defer file.Close()
 
-	scanner := newBinFileScanner(file, s.config.readBufferSize)
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	s.size = stat.Size()
+	// tables without the creation time in the meta block use the modification time
+	s.createdAt = stat.ModTime()
+	s.dataSize = s.size - footerSize
+	if s.dataSize < 0 {
+		return &utils.CorruptionError{Filename: s.config.filename, Offset: 0, Reason: "file is too small for an sstable"}
+	}
+
+	footerData := make([]byte, footerSize)
+	_, err = file.ReadAt(footerData, s.dataSize)
+	if err != nil {
+		return fmt.Errorf("can't read footer of sstable file=%s: %w", s.config.filename, err)
+	}
+	f, err := newFooter(footerData)
+	if err != nil {
+		return &utils.CorruptionError{Filename: s.config.filename, Offset: s.dataSize, Reason: err.Error()}
+	}
+
+	s.version = f.version
+
+	err = s.loadIndex(file, f.index)
+	if err != nil {
+		return fmt.Errorf("can't read index of sstable file=%s: %w", s.config.filename, err)
+	}
+
+	err = s.loadMeta(file, f.meta)
+	if err != nil {
+		return fmt.Errorf("can't read meta block of sstable file=%s: %w", s.config.filename, err)
+	}
+
+	if !s.isEmpty() && s.smallest == "" && s.largest == "" {
+		err = s.loadKeyRange(file)
+		if err != nil {
+			return fmt.Errorf("can't read key range of sstable file=%s: %w", s.config.filename, err)
+		}
+	}
+	return nil
+}
+
+// loadKeyRange finds the smallest and the largest keys of a table which doesn't have them in the meta block:
+// the largest key is the last key of the index, and the smallest one is the first key of the first block.
+func (s *ssTable) loadKeyRange(file *os.File) error {
+	data, err := readBlock(file, s.blocks[0], s.dataSize, s.version)
+	if err != nil {
+		return err
+	}
+
+	it := newBlockIterator(data, s.version)
+	if !it.Next() {
+		if it.Err() != nil {
+			return it.Err()
+		}
+		return &utils.CorruptionError{Filename: s.config.filename, Offset: int64(s.blocks[0].offset), Reason: "empty data block"}
+	}
+	s.smallest = it.Entry().Key
+	s.largest = s.index.Key(s.index.Len() - 1)
+	return nil
+}
+
+// loadIndex reads the index block.
+func (s *ssTable) loadIndex(file *os.File, h blockHandle) error {
+	s.index = index.New(0)
+	s.blocks = []blockHandle{}
+
+	data, err := readBlock(file, h, s.dataSize, s.version)
+	if err != nil {
+		return err
+	}
 
-	offset := 0
-	previousKeyOffset := 0
+	it := newBlockIterator(data, s.version)
+	for it.Next() {
+		handle, err := newBlockHandle([]byte(it.Entry().Value))
+		if err != nil {
+			return &utils.CorruptionError{Filename: s.config.filename, Offset: int64(h.offset), Reason: err.Error()}
+		}
+		s.index.Add(it.Entry().Key)
+		s.blocks = append(s.blocks, handle)
+	}
+	return it.Err()
+}
 
-	for scanner.Scan() {
-		entry, _ := entry.NewDBEntry(scanner.Bytes())
+// loadMeta reads the meta block.
+// Tables without a Bloom filter are still valid: we just always read them.
+// Tables without a level belong to level 0.
+func (s *ssTable) loadMeta(file *os.File, h blockHandle) error {
+	data, err := readBlock(file, h, s.dataSize, s.version)
+	if err != nil {
+		return err
+	}
 
-		if s.index.Size() == 0 || offset-previousKeyOffset > s.config.readBufferSize {
-			s.index.Put(entry.Key, offset)
-			previousKeyOffset = offset
+	it := newBlockIterator(data, s.version)
+	for it.Next() {
+		switch it.Entry().Key {
+		case metaBloomFilterKey:
+			s.filter, err = bloom.NewFromBinary([]byte(it.Entry().Value))
+			if err != nil {
+				log.Printf("[ERROR] Can't load bloom filter of sstable=%s, err:%v", s.config.filename, err)
+			}
+		case metaLevelKey:
+			s.level, err = strconv.Atoi(it.Entry().Value)
+			if err != nil || s.level < 0 || s.level >= maxLevels {
+				return &utils.CorruptionError{
+					Filename: s.config.filename,
+					Offset:   int64(h.offset),
+					Reason:   fmt.Sprintf("wrong level=%s", it.Entry().Value),
+				}
+			}
+		case metaSmallestKey:
+			s.smallest = it.Entry().Value
+		case metaLargestKey:
+			s.largest = it.Entry().Value
+		case metaCreatedAtKey:
+			createdAt, err := strconv.ParseInt(it.Entry().Value, 10, 64)
+			if err != nil {
+				return &utils.CorruptionError{
+					Filename: s.config.filename,
+					Offset:   int64(h.offset),
+					Reason:   fmt.Sprintf("wrong creation time=%s", it.Entry().Value),
+				}
+			}
+			s.createdAt = time.Unix(0, createdAt)
 		}
-		offset += entry.Length()
 	}
+	return it.Err()
 }
 
 // newSSTable returns an SSTable instance that can be used to retrieve information from this table.
-func newSSTable(config *ssTableConfig) *ssTable {
+func newSSTable(config *ssTableConfig) (*ssTable, error) {
 	log.Println("[DEBUG] Initializing a new SSTable instance...")
-	if config.readBufferSize == 0 {
-		config.readBufferSize = defaultReadBufferSize
-	}
 	s := ssTable{
 		config: config,
 	}
-	s.rebuildSparseIndex()
+	// the error is ignored: tables with other names are treated as the oldest ones
+	s.fileNumber, _ = strconv.ParseInt(strings.Split(filepath.Base(config.filename), ".")[0], 10, 64)
+	s.seq = s.fileNumber
+	if config.blockCache != nil {
+		s.cacheID = config.blockCache.NewID()
+	}
+	err := s.load()
+	if err != nil {
+		return nil, err
+	}
+	if config.mmap {
+		err = s.mmap()
+		if err != nil {
+			return nil, fmt.Errorf("can't map sstable file=%s: %w", s.config.filename, err)
+		}
+	}
 	log.Printf(
-		"[DEBUG] New SSTable instance ready to use, filename=%s bufferSize=%v indexSize=%v",
+		"[DEBUG] New SSTable instance ready to use, filename=%s blocks=%v level=%v",
 		s.config.filename,
-		s.config.readBufferSize,
-		s.index.Size(),
+		len(s.blocks),
+		s.level,
 	)
-	return &s
+	return &s, nil
 }
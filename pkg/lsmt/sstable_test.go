@@ -1,11 +1,15 @@
 package lsmt
 
 import (
+	"errors"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/cache"
 	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/entry"
 	"github.com/alexander-akhmetov/mdb/pkg/utils"
 
@@ -23,11 +27,11 @@ func TestListSSTables(t *testing.T) {
 	sstablesDir := "./.test/sstables-test/"
 	os.MkdirAll(sstablesDir, os.ModePerm)
 
-	assert.Equal(t, []utils.FileInfo{}, listSSTables(sstablesDir))
+	files, err := listSSTables(sstablesDir)
+	assert.Nil(t, err)
+	assert.Equal(t, []utils.FileInfo{}, files)
 
-	files := []string{"file.sstable", "another.sstable", "sometmpfile.txt"}
-
-	for _, f := range files {
+	for _, f := range []string{"file.sstable", "another.sstable", "sometmpfile.txt"} {
 		os.OpenFile(filepath.Join(sstablesDir, f), os.O_RDONLY|os.O_CREATE, 0600)
 	}
 
@@ -41,194 +45,411 @@ func TestListSSTables(t *testing.T) {
 			Size: 0,
 		},
 	}
-	assert.Equal(t, expFiles, listSSTables(sstablesDir))
+	files, err = listSSTables(sstablesDir)
+	assert.Nil(t, err)
+	assert.Equal(t, expFiles, files)
+}
+
+// createSSTableWithEntries writes entries to a new level 0 SSTable file, creating all necessary dirs.
+func createSSTableWithEntries(filename string, entries []*entry.DBEntry) {
+	createLevelSSTableWithEntries(filename, 0, entries)
+}
+
+// createLevelSSTableWithEntries writes entries to a new SSTable file of the given level.
+func createLevelSSTableWithEntries(filename string, level int, entries []*entry.DBEntry) {
+	config := ssTableWriterConfig{blockSize: defaultReadBufferSize, bloomBitsPerKey: defaultBloomFilterBitsPerKey, level: level}
+	createSSTableWithConfig(filename, config, entries)
+}
+
+// createSSTableWithConfig writes entries to a new SSTable file with the given parameters.
+func createSSTableWithConfig(filename string, config ssTableWriterConfig, entries []*entry.DBEntry) {
+	os.MkdirAll(filepath.Dir(filename), os.ModePerm)
+
+	w, err := newSSTableWriter(filename, config)
+	if err != nil {
+		log.Panic(err)
+	}
+	defer w.Close()
+
+	for _, e := range entries {
+		err = w.Add(e)
+		if err != nil {
+			log.Panic(err)
+		}
+	}
+	err = w.Finish()
+	if err != nil {
+		log.Panic(err)
+	}
+}
+
+// createSSTable writes key-value pairs to a new level 0 SSTable file, creating all necessary dirs.
+func createSSTable(filename string, keyValues [][2]string) {
+	createLevelSSTable(filename, 0, keyValues)
+}
+
+// createLevelSSTable writes key-value pairs to a new SSTable file of the given level.
+func createLevelSSTable(filename string, level int, keyValues [][2]string) {
+	entries := []*entry.DBEntry{}
+	for _, kv := range keyValues {
+		entries = append(entries, &entry.DBEntry{Type: entry.TypeValue, Key: kv[0], Value: kv[1]})
+	}
+	createLevelSSTableWithEntries(filename, level, entries)
+}
+
+// readSSTable returns all entries of the SSTable file.
+func readSSTable(t *testing.T, filename string) []*entry.DBEntry {
+	table, err := newSSTable(&ssTableConfig{filename: filename})
+	assert.Nil(t, err)
+
+	it, err := newSSTableIterator(table, "", "")
+	assert.Nil(t, err)
+	defer it.Close()
+
+	entries := []*entry.DBEntry{}
+	for it.Next() {
+		entries = append(entries, it.Entry())
+	}
+	assert.Nil(t, it.Err())
+	return entries
+}
+
+// assertKeysInSSTable checks that the SSTable file has only the given key-value pairs.
+func assertKeysInSSTable(t *testing.T, filename string, expData [][2]string) {
+	data := [][2]string{}
+	for _, e := range readSSTable(t, filename) {
+		data = append(data, [2]string{e.Key, e.Value})
+	}
+	assert.Equal(t, expData, data)
 }
 
 func TestSSTableGet(t *testing.T) {
 	// test that SSTable reads content from the file
-
-	// create two key-value pairs manually and read them with .Get method
 	testutils.SetUp()
 	defer testutils.Teardown()
 
-	sstablesDir := "./.test/sstables-test/"
-	os.MkdirAll(sstablesDir, os.ModePerm)
+	filePath := ".test/sstables-test/0.sstable"
+	createSSTable(filePath, [][2]string{
+		{"key1", "value1"},
+		{"key2", "value2"},
+	})
+
+	ssTable, err := newSSTable(&ssTableConfig{filename: filePath})
+	assert.Nil(t, err)
 
-	filePath := filepath.Join(sstablesDir, "TestSSTableGet")
+	e, exists, err := ssTable.Get("key1")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, "value1", e.Value)
 
-	key1 := "key1"
-	value1 := "value1"
-	key2 := "key2"
-	value2 := "value2"
+	e, exists, err = ssTable.Get("key2")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, "value2", e.Value)
 
-	f, _ := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE, 0600)
-	f.Close()
+	for _, key := range []string{"key0", "key11", "unknownkey"} {
+		e, exists, err = ssTable.Get(key)
+		assert.Nil(t, err)
+		assert.False(t, exists)
+		assert.Nil(t, e)
+	}
+}
 
-	appendBinaryToFile(filePath, &entry.DBEntry{
-		Type:  0,
-		Key:   key1,
-		Value: value1,
-	})
-	appendBinaryToFile(filePath, &entry.DBEntry{
-		Type:  0,
-		Key:   key2,
-		Value: value2,
+func TestSSTableGetWithBlockCache(t *testing.T) {
+	// the second read of a block must not touch the file
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	filePath := ".test/sstables-test/0.sstable"
+	createSSTable(filePath, [][2]string{
+		{"key1", "value1"},
+		{"key2", "value2"},
 	})
 
-	ssTable := newSSTable(&ssTableConfig{filename: filePath})
+	blockCache := cache.New(1024)
+	ssTable, err := newSSTable(&ssTableConfig{filename: filePath, blockCache: blockCache})
+	assert.Nil(t, err)
 
-	value, exists := ssTable.Get(key1)
+	e, exists, err := ssTable.Get("key1")
+	assert.Nil(t, err)
 	assert.True(t, exists)
-	assert.Equal(t, value1, value)
+	assert.Equal(t, "value1", e.Value)
+	assert.Equal(t, int64(0), blockCache.Hits())
+	assert.Equal(t, int64(1), blockCache.Misses())
 
-	value, exists = ssTable.Get(key2)
+	assert.Nil(t, os.Remove(filePath))
+	e, exists, err = ssTable.Get("key2")
+	assert.Nil(t, err)
 	assert.True(t, exists)
-	assert.Equal(t, value2, value)
+	assert.Equal(t, "value2", e.Value)
+	assert.Equal(t, int64(1), blockCache.Hits())
+
+	// another table with the same file doesn't see blocks of the first one
+	createSSTable(filePath, [][2]string{{"key1", "new-value1"}})
+	another, err := newSSTable(&ssTableConfig{filename: filePath, blockCache: blockCache})
+	assert.Nil(t, err)
+	e, _, err = another.Get("key1")
+	assert.Nil(t, err)
+	assert.Equal(t, "new-value1", e.Value)
+
+	ssTable.retire()
+	another.retire()
+	assert.Equal(t, int64(0), blockCache.Size())
+}
+
+func TestSSTableEmpty(t *testing.T) {
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	filePath := ".test/sstables-test/0.sstable"
+	createSSTable(filePath, [][2]string{})
 
-	value, exists = ssTable.Get("unknownkey")
+	ssTable, err := newSSTable(&ssTableConfig{filename: filePath})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, len(ssTable.blocks))
+
+	e, exists, err := ssTable.Get("key")
+	assert.Nil(t, err)
 	assert.False(t, exists)
-	assert.Equal(t, "", value)
+	assert.Nil(t, e)
 }
 
-func TestRebuildSparseIndexWithOneElement(t *testing.T) {
+func TestSSTableIndexWithManyBlocks(t *testing.T) {
+	// each block is bigger than the block size, so every key must have its own block
 	testutils.SetUp()
 	defer testutils.Teardown()
 
-	sstablesDir := "./.test/sstables-test/"
-	os.MkdirAll(sstablesDir, os.ModePerm)
+	filePath := ".test/sstables-test/0.sstable"
+	os.MkdirAll(filepath.Dir(filePath), os.ModePerm)
+	w, err := newSSTableWriter(filePath, ssTableWriterConfig{blockSize: 1, bloomBitsPerKey: defaultBloomFilterBitsPerKey})
+	assert.Nil(t, err)
+	for _, i := range []int{1, 2, 3, 4, 5} {
+		err = w.Add(&entry.DBEntry{
+			Key:   fmt.Sprintf("key_%v", i),
+			Value: fmt.Sprintf("value_%v", i),
+		})
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, w.Finish())
+
+	ssTable, err := newSSTable(&ssTableConfig{filename: filePath})
+	assert.Nil(t, err)
+
+	// every entry is 16 bytes long, the restart point with the count of restart points takes 8 bytes,
+	// and every block has a 5 bytes trailer: the compression and the checksum
+	assert.Equal(t, 5, ssTable.index.Len())
+	for i := 0; i < 5; i++ {
+		assert.Equal(t, fmt.Sprintf("key_%v", i+1), ssTable.index.Key(i))
+		position, found := ssTable.findBlock(fmt.Sprintf("key_%v", i+1))
+		assert.True(t, found)
+		assert.Equal(t, i, position)
+		assert.Equal(t, blockHandle{offset: uint64(i * 29), size: 24}, ssTable.blocks[i])
+
+		e, exists, err := ssTable.Get(fmt.Sprintf("key_%v", i+1))
+		assert.Nil(t, err)
+		assert.True(t, exists)
+		assert.Equal(t, fmt.Sprintf("value_%v", i+1), e.Value)
+	}
+}
 
-	filePath := filepath.Join(sstablesDir, "ftest.sstable")
-	os.OpenFile(filePath, os.O_RDONLY|os.O_CREATE, 0600)
+func TestSSTableWriterRequiresSortedKeys(t *testing.T) {
+	testutils.SetUp()
+	defer testutils.Teardown()
 
-	e := &entry.DBEntry{
-		Type:  0,
-		Key:   "key",
-		Value: "value",
-	}
-	appendBinaryToFile(filePath, e)
+	filePath := ".test/0.sstable"
+	os.MkdirAll(filepath.Dir(filePath), os.ModePerm)
+	w, err := newSSTableWriter(filePath, ssTableWriterConfig{blockSize: defaultReadBufferSize})
+	assert.Nil(t, err)
+	defer w.Close()
 
-	ssTable := newSSTable(&ssTableConfig{filename: filePath})
+	assert.Nil(t, w.Add(&entry.DBEntry{Key: "k2"}))
+	assert.NotNil(t, w.Add(&entry.DBEntry{Key: "k2"}))
+	assert.NotNil(t, w.Add(&entry.DBEntry{Key: "k1"}))
 
-	ssTable.rebuildSparseIndex()
+	// the table is not finished, so it must not exist
+	assert.False(t, testutils.IsFileExists(filePath))
+}
+
+func TestSSTableCorrupted(t *testing.T) {
+	// a file without a correct footer can't be used as an SSTable
+	testutils.SetUp()
+	defer testutils.Teardown()
 
-	v, f := ssTable.index.Get("key")
-	assert.Equal(t, 0, v)
-	assert.True(t, f)
+	filePath := ".test/sstables-test/0.sstable"
+	createSSTable(filePath, [][2]string{{"key1", "value1"}})
+	data := testutils.ReadFileBinary(filePath)
+
+	for _, content := range [][]byte{
+		{},
+		data[:len(data)-1],
+		append(data, 0),
+	} {
+		testutils.CreateFile(filePath, string(content))
+		_, err := newSSTable(&ssTableConfig{filename: filePath})
+		assert.True(t, errors.Is(err, utils.ErrCorrupted))
+	}
 }
 
-func TestRebuildSparseIndexWithManyElements(t *testing.T) {
+func TestSSTableGetWithBloomFilter(t *testing.T) {
+	// if the bloom filter doesn't have a key, SSTable must not read the file
 	testutils.SetUp()
 	defer testutils.Teardown()
 
-	sstablesDir := "./.test/sstables-test/"
-	os.MkdirAll(sstablesDir, os.ModePerm)
+	filePath := ".test/sstables-test/0.sstable"
+	createSSTable(filePath, [][2]string{{"key1", "value1"}})
 
-	filePath := filepath.Join(sstablesDir, "ftest.sstable")
-	os.OpenFile(filePath, os.O_RDONLY|os.O_CREATE, 0600)
+	ssTable, err := newSSTable(&ssTableConfig{filename: filePath})
+	assert.Nil(t, err)
+	assert.NotNil(t, ssTable.filter)
 
-	for _, i := range []int{1, 2, 3, 4, 5} {
-		appendBinaryToFile(filePath, &entry.DBEntry{
-			Type:  0,
-			Key:   fmt.Sprintf("key_%v", i),
-			Value: fmt.Sprintf("value_%v", i),
-		})
-	}
+	e, exists, err := ssTable.Get("key1")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, "value1", e.Value)
 
-	ssTable := newSSTable(
-		&ssTableConfig{
-			filename:       filePath,
-			readBufferSize: 80, // key_5 should start at 84
-		},
-	)
+	// without the file SSTable can't read anything, so the filter must answer
+	os.Remove(filePath)
+	e, exists, err = ssTable.Get("key0")
+	assert.Nil(t, err)
+	assert.False(t, exists)
+	assert.Nil(t, e)
+}
 
-	ssTable.rebuildSparseIndex()
+func TestSSTableWithoutBloomFilter(t *testing.T) {
+	testutils.SetUp()
+	defer testutils.Teardown()
 
-	v, f := ssTable.index.Get("key_1")
-	assert.Equal(t, 0, v)
-	assert.True(t, f)
+	filePath := ".test/0.sstable"
+	os.MkdirAll(filepath.Dir(filePath), os.ModePerm)
+	w, err := newSSTableWriter(filePath, ssTableWriterConfig{blockSize: defaultReadBufferSize})
+	assert.Nil(t, err)
+	assert.Nil(t, w.Add(&entry.DBEntry{Key: "key1", Value: "value1"}))
+	assert.Nil(t, w.Finish())
 
-	v, f = ssTable.index.Get("key_5")
-	assert.Equal(t, 84, v)
-	assert.True(t, f)
+	ssTable, err := newSSTable(&ssTableConfig{filename: filePath})
+	assert.Nil(t, err)
+	assert.Nil(t, ssTable.filter)
 
-	v, e := ssTable.Get("key_5")
-	assert.True(t, e)
-	assert.Equal(t, "value_5", v)
+	e, exists, err := ssTable.Get("key1")
+	assert.Nil(t, err)
+	assert.True(t, exists)
+	assert.Equal(t, "value1", e.Value)
 }
 
-func TestRebuildSparseIndexWithManyElementsAndIncompleteLast(t *testing.T) {
+func TestSSTableCorruptedBlock(t *testing.T) {
+	// a block with a wrong checksum must not be used
 	testutils.SetUp()
 	defer testutils.Teardown()
 
-	sstablesDir := "./.test/sstables-test/"
-	os.MkdirAll(sstablesDir, os.ModePerm)
+	filePath := ".test/sstables-test/0.sstable"
+	createSSTable(filePath, [][2]string{{"key1", "value1"}})
 
-	filePath := filepath.Join(sstablesDir, "ftest.sstable")
-	os.OpenFile(filePath, os.O_RDONLY|os.O_CREATE, 0600)
+	data := testutils.ReadFileBinary(filePath)
+	data[entry.HeaderSize] ^= 1
+	testutils.CreateFile(filePath, string(data))
 
-	for _, i := range []int{1, 2, 3, 4, 5} {
-		appendBinaryToFile(filePath, &entry.DBEntry{
-			Type:  0,
-			Key:   fmt.Sprintf("key_%v", i),
-			Value: fmt.Sprintf("value_%v", i),
-		})
-	}
-	file, _ := os.OpenFile(filePath, os.O_APPEND|os.O_WRONLY, 0600)
-	file.Write([]byte{0})
-	file.Close()
-
-	ssTable := newSSTable(
-		&ssTableConfig{
-			filename:       filePath,
-			readBufferSize: 80, // key_5 should start at 84
-		},
-	)
-	ssTable.rebuildSparseIndex()
+	// only the data block is broken, so the table can be opened
+	ssTable, err := newSSTable(&ssTableConfig{filename: filePath})
+	assert.Nil(t, err)
 
-	v, f := ssTable.index.Get("key_1")
-	assert.Equal(t, 0, v)
-	assert.True(t, f)
+	_, _, err = ssTable.Get("key1")
+	var corruptionErr *utils.CorruptionError
+	assert.True(t, errors.As(err, &corruptionErr))
+	assert.Equal(t, filePath, corruptionErr.Filename)
+	assert.Equal(t, int64(0), corruptionErr.Offset)
+}
+
+func TestSSTableMeta(t *testing.T) {
+	// the level and the key range must be saved in the meta block
+	testutils.SetUp()
+	defer testutils.Teardown()
 
-	v, f = ssTable.index.Get("key_5")
-	assert.Equal(t, 84, v)
-	assert.True(t, f)
+	filePath := ".test/sstables-test/1.sstable"
+	createLevelSSTable(filePath, 3, [][2]string{{"a", "1"}, {"b", "2"}, {"c", "3"}})
+
+	table, err := newSSTable(&ssTableConfig{filename: filePath})
+	assert.Nil(t, err)
+	assert.Equal(t, 3, table.level)
+	assert.Equal(t, "a", table.smallest)
+	assert.Equal(t, "c", table.largest)
+	assert.Equal(t, int64(1), table.fileNumber)
+	assert.Equal(t, int64(1), table.seq)
+
+	size, err := utils.GetFileSize(filePath)
+	assert.Nil(t, err)
+	assert.Equal(t, size, table.size)
+
+	info := table.info()
+	assert.Equal(t, filePath, info.Filename)
+	assert.Equal(t, 3, info.Level)
+	assert.Equal(t, size, info.Size)
+	assert.False(t, info.Empty)
+	assert.True(t, time.Since(info.CreatedAt) < time.Minute)
+	assert.True(t, info.overlaps("c", "d"))
+	assert.True(t, info.overlaps("0", "a"))
+	assert.True(t, info.overlaps("aa", "ab"))
+	assert.False(t, info.overlaps("d", "e"))
+
+	// an empty table has no key range
+	emptyPath := ".test/sstables-test/2.sstable"
+	createSSTable(emptyPath, [][2]string{})
+	table, err = newSSTable(&ssTableConfig{filename: emptyPath})
+	assert.Nil(t, err)
+	assert.Equal(t, 0, table.level)
+	assert.True(t, table.isEmpty())
+	assert.False(t, table.info().overlaps("", "z"))
 }
 
-func TestRebuildSparseIndexWithManyElementsAndSmallBufferSize(t *testing.T) {
+func TestSSTableKeyRange(t *testing.T) {
+	// keys out of the key range must not be read from the file
 	testutils.SetUp()
 	defer testutils.Teardown()
 
-	sstablesDir := "./.test/sstables-test/"
-	os.MkdirAll(sstablesDir, os.ModePerm)
+	filePath := ".test/sstables-test/0.sstable"
+	createSSTableWithConfig(filePath, ssTableWriterConfig{blockSize: 1}, []*entry.DBEntry{
+		{Key: "b", Value: "1"},
+		{Key: "c", Value: "2"},
+		{Key: "d", Value: "3"},
+	})
 
-	filePath := filepath.Join(sstablesDir, "ftest.sstable")
-	os.OpenFile(filePath, os.O_RDONLY|os.O_CREATE, 0600)
+	blockCache := cache.New(1024)
+	table, err := newSSTable(&ssTableConfig{filename: filePath, blockCache: blockCache})
+	assert.Nil(t, err)
 
-	for _, i := range []int{1, 2, 3, 4, 5} {
-		appendBinaryToFile(filePath, &entry.DBEntry{
-			Type:  0,
-			Key:   fmt.Sprintf("key_%v", i),
-			Value: fmt.Sprintf("value_%v", i),
-		})
+	for key, expected := range map[string]bool{"a": false, "b": true, "bb": true, "d": true, "e": false} {
+		assert.Equal(t, expected, table.mayContain(key), key)
 	}
 
-	ssTable := newSSTable(
-		&ssTableConfig{
-			filename:       filePath,
-			readBufferSize: 1,
-		},
-	)
-
-	keys := map[string]int{
-		"key_1": 0,
-		"key_2": 21,
-		"key_3": 42,
-		"key_4": 63,
-		"key_5": 84,
+	_, found, err := table.Get("a")
+	assert.Nil(t, err)
+	assert.False(t, found)
+	assert.Equal(t, int64(0), blockCache.Misses())
+
+	// tables without the key range in the meta block find it in the index and the first block
+	file, err := os.Open(filePath)
+	assert.Nil(t, err)
+	defer file.Close()
+	table.smallest, table.largest = "", ""
+	assert.Nil(t, table.loadKeyRange(file))
+	assert.Equal(t, "b", table.smallest)
+	assert.Equal(t, "d", table.largest)
+}
+
+func TestSortSSTables(t *testing.T) {
+	// tables must be ordered by level, and newer tables go first inside of a level
+	tables := []*ssTable{
+		{fileNumber: 1, seq: 1, level: 1},
+		{fileNumber: 2, seq: 2, level: 0},
+		{fileNumber: 5, seq: 5, level: 2},
+		{fileNumber: 6, seq: 3, level: 0},
+		{fileNumber: 4, seq: 4, level: 1},
+		{fileNumber: 7, seq: 4, level: 1},
 	}
-	for key, offset := range keys {
-		v, f := ssTable.index.Get(key)
-		assert.Equal(t, offset, v)
-		assert.True(t, f)
+	sortSSTables(tables)
+
+	numbers := []int64{}
+	for _, table := range tables {
+		numbers = append(numbers, table.fileNumber)
 	}
+	assert.Equal(t, []int64{6, 2, 7, 4, 1, 5}, numbers)
 }
@@ -0,0 +1,210 @@
+package lsmt
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/bloom"
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/entry"
+)
+
+// ssTableWriter writes sorted entries to a new SSTable file.
+// The data is written to a temporary file first, which is renamed
+// to the final path only when the table is complete,
+// so a crash can't leave a half-written SSTable behind.
+type ssTableWriter struct {
+	filename    string
+	file        *os.File
+	writer      *bufio.Writer
+	blockSize   int
+	compression Compression
+	level       int
+	createdAt   time.Time
+	offset      uint64
+
+	block    *blockBuilder // the current data block
+	index    *blockBuilder // the index block
+	count    int
+	firstKey string
+	lastKey  string
+	filter   *bloom.Builder // nil if Bloom filters are disabled
+}
+
+// ssTableWriterConfig holds parameters of new SSTables.
+type ssTableWriterConfig struct {
+	blockSize       int
+	restartInterval int // number of keys between restart points in data blocks
+	compression     Compression
+	bloomBitsPerKey int       // the table has a Bloom filter only if it's positive
+	level           int       // the level of the table, flushed tables always have level 0
+	createdAt       time.Time // the current time is used if it's not set
+}
+
+// Add appends the entry to the table. Entries must be added in the sorted order.
+func (w *ssTableWriter) Add(e *entry.DBEntry) error {
+	if w.count > 0 && e.Key <= w.lastKey {
+		return fmt.Errorf("can't add key=%s after key=%s: keys must be sorted", e.Key, w.lastKey)
+	}
+
+	if w.count == 0 {
+		w.firstKey = e.Key
+	}
+	w.block.add(e)
+	w.lastKey = e.Key
+	w.count++
+	if w.filter != nil {
+		w.filter.Add(e.Key)
+	}
+
+	if w.block.size() >= w.blockSize {
+		return w.finishBlock()
+	}
+	return nil
+}
+
+// finishBlock writes the current data block and adds it to the index.
+func (w *ssTableWriter) finishBlock() error {
+	if w.block.empty() {
+		return nil
+	}
+
+	handle, err := w.writeBlock(w.block.finish())
+	if err != nil {
+		return err
+	}
+	w.index.add(&entry.DBEntry{Key: w.lastKey, Value: string(handle.Binary())})
+	w.block.reset()
+	return nil
+}
+
+// writeBlock compresses the data, writes it with the trailer to the file and returns its handle.
+func (w *ssTableWriter) writeBlock(data []byte) (blockHandle, error) {
+	data, compression, err := compressBlock(data, w.compression)
+	if err != nil {
+		return blockHandle{}, err
+	}
+
+	trailer := make([]byte, 1+checksumSize)
+	trailer[0] = byte(compression)
+	crc := crc32.Update(checksum(data), crcTable, trailer[:1])
+	binary.BigEndian.PutUint32(trailer[1:], crc)
+
+	for _, b := range [][]byte{data, trailer} {
+		_, err := w.writer.Write(b)
+		if err != nil {
+			return blockHandle{}, err
+		}
+	}
+	h := blockHandle{offset: w.offset, size: uint64(len(data))}
+	w.offset += h.size + uint64(len(trailer))
+	return h, nil
+}
+
+// Finish writes the last data block, the meta and index blocks and the footer,
+// and moves the complete file to its final path.
+func (w *ssTableWriter) Finish() error {
+	err := w.finishBlock()
+	if err != nil {
+		return err
+	}
+
+	metaEntries := []*entry.DBEntry{
+		{Key: metaLevelKey, Value: strconv.Itoa(w.level)},
+		{Key: metaCreatedAtKey, Value: strconv.FormatInt(w.createdAt.UnixNano(), 10)},
+	}
+	if w.count > 0 {
+		metaEntries = append(
+			metaEntries,
+			&entry.DBEntry{Key: metaSmallestKey, Value: w.firstKey},
+			&entry.DBEntry{Key: metaLargestKey, Value: w.lastKey},
+		)
+	}
+	if w.filter != nil {
+		metaEntries = append(metaEntries, &entry.DBEntry{Key: metaBloomFilterKey, Value: string(w.filter.Build().Binary())})
+	}
+	meta := newBlockBuilder(1)
+	for _, e := range metaEntries {
+		meta.add(e)
+	}
+
+	f := &footer{version: ssTableFormatVersion}
+	f.meta, err = w.writeBlock(meta.finish())
+	if err != nil {
+		return err
+	}
+	f.index, err = w.writeBlock(w.index.finish())
+	if err != nil {
+		return err
+	}
+	_, err = w.writer.Write(f.Binary())
+	if err != nil {
+		return err
+	}
+
+	err = w.writer.Flush()
+	if err != nil {
+		return err
+	}
+	err = w.file.Sync()
+	if err != nil {
+		return err
+	}
+	err = w.file.Close()
+	if err != nil {
+		return err
+	}
+	return os.Rename(w.file.Name(), w.filename)
+}
+
+// Size returns the number of bytes added to the table so far.
+// It doesn't include the meta and index blocks which are written by Finish.
+func (w *ssTableWriter) Size() int64 {
+	return int64(w.offset) + int64(w.block.size())
+}
+
+// Close closes the file. It's safe to call it after Finish,
+// and it must be called if the table can't be finished.
+func (w *ssTableWriter) Close() {
+	w.file.Close()
+}
+
+// newSSTableWriter creates a new SSTable writer.
+func newSSTableWriter(filename string, config ssTableWriterConfig) (*ssTableWriter, error) {
+	file, err := os.OpenFile(filename+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, filePermissions)
+	if err != nil {
+		return nil, err
+	}
+
+	blockSize := config.blockSize
+	if blockSize <= 0 {
+		blockSize = defaultReadBufferSize
+	}
+	if !config.compression.isSupported() {
+		file.Close()
+		return nil, fmt.Errorf("unsupported compression=%v", config.compression)
+	}
+
+	w := &ssTableWriter{
+		filename:    filename,
+		file:        file,
+		writer:      bufio.NewWriter(file),
+		blockSize:   blockSize,
+		compression: config.compression,
+		block:       newBlockBuilder(config.restartInterval),
+		index:       newBlockBuilder(1), // every index key is a restart point: the index is small and loaded once
+		level:       config.level,
+		createdAt:   config.createdAt,
+	}
+	if w.createdAt.IsZero() {
+		w.createdAt = time.Now()
+	}
+	if config.bloomBitsPerKey > 0 {
+		w.filter = bloom.NewBuilder(config.bloomBitsPerKey)
+	}
+	return w, nil
+}
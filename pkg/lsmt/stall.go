@@ -0,0 +1,145 @@
+package lsmt
+
+import (
+	"fmt"
+	"log"
+	"sync/atomic"
+	"time"
+
+	"github.com/alexander-akhmetov/mdb/pkg/utils"
+)
+
+// Stats holds counters of the storage.
+type Stats struct {
+	WriteStallTime time.Duration // total time of delayed and blocked writes
+	WriteSlowdowns int64         // number of writes delayed by WriteSlowdownDelay
+	WriteStops     int64         // number of writes blocked until the background processes caught up
+
+	BlockCacheHits   int64 // number of SSTable blocks found in the block cache
+	BlockCacheMisses int64 // number of SSTable blocks read from disk because they were not in the block cache
+}
+
+// Stats returns the current counters of the storage.
+func (s *Storage) Stats() Stats {
+	stats := Stats{
+		WriteStallTime: time.Duration(atomic.LoadInt64(&s.writeStallTime)),
+		WriteSlowdowns: atomic.LoadInt64(&s.writeSlowdowns),
+		WriteStops:     atomic.LoadInt64(&s.writeStops),
+	}
+	if s.blockCache != nil {
+		stats.BlockCacheHits = s.blockCache.Hits()
+		stats.BlockCacheMisses = s.blockCache.Misses()
+	}
+	return stats
+}
+
+// makeRoomForWrite delays or blocks the write when the flusher or the compaction fall behind.
+// After a slowdown threshold, the write sleeps once to give the background processes some time,
+// and after a stop threshold or the memory limit, it waits until a flush or a compaction is done.
+func (s *Storage) makeRoomForWrite() error {
+	start := time.Now()
+	stalled := false
+
+	if s.shouldSlowdownWrites() {
+		log.Println("[DEBUG] Background processes fall behind, delaying the write")
+		atomic.AddInt64(&s.writeSlowdowns, 1)
+		stalled = true
+		time.Sleep(s.Config.WriteSlowdownDelay)
+	}
+
+	// Close changes the running flag before it notifies the waiting writes,
+	// so checking it under stallMutex doesn't miss the notification.
+	s.stallMutex.Lock()
+	running := s.isRunning()
+	if running && s.shouldStopWrites() {
+		log.Println("[DEBUG] Background processes fall behind, waiting for them")
+		atomic.AddInt64(&s.writeStops, 1)
+		stalled = true
+	}
+	for running && s.shouldStopWrites() {
+		s.backgroundDone.Wait()
+		running = s.isRunning()
+	}
+	s.stallMutex.Unlock()
+
+	if stalled {
+		atomic.AddInt64(&s.writeStallTime, int64(time.Since(start)))
+	}
+	if !running {
+		return utils.ErrClosed
+	}
+	return nil
+}
+
+// shouldSlowdownWrites returns true if a slowdown threshold is reached.
+func (s *Storage) shouldSlowdownWrites() bool {
+	return isThresholdReached(atomic.LoadInt64(&s.flushQueueLength), s.Config.SlowdownImmutableMemtables) ||
+		(s.Config.CompactionEnabled && isThresholdReached(atomic.LoadInt64(&s.level0Files), s.Config.SlowdownLevel0Files))
+}
+
+// shouldStopWrites returns true if a stop threshold is reached or the memtables use too much memory.
+func (s *Storage) shouldStopWrites() bool {
+	return s.isMemoryLimitExceeded() ||
+		isThresholdReached(atomic.LoadInt64(&s.flushQueueLength), s.Config.MaxImmutableMemtables) ||
+		(s.Config.CompactionEnabled && isThresholdReached(atomic.LoadInt64(&s.level0Files), s.Config.MaxLevel0Files))
+}
+
+// checkLevel0Thresholds returns an error if writes could wait for the compaction of level 0 forever:
+// the strategy must move level 0 tables to deeper levels before the thresholds are reached.
+func (c *StorageConfig) checkLevel0Thresholds() error {
+	if !c.CompactionEnabled || (c.SlowdownLevel0Files <= 0 && c.MaxLevel0Files <= 0) {
+		return nil
+	}
+	limiter, ok := c.CompactionStrategy.(Level0Limiter)
+	if !ok {
+		return fmt.Errorf("level 0 write stall thresholds need a compaction strategy which reduces level 0, like LeveledStrategy")
+	}
+	limit := limiter.Level0Limit()
+	for _, threshold := range []int{c.SlowdownLevel0Files, c.MaxLevel0Files} {
+		if threshold > 0 && threshold < limit {
+			return fmt.Errorf("level 0 write stall threshold=%v is less than the compaction limit=%v", threshold, limit)
+		}
+	}
+	return nil
+}
+
+// isMemoryLimitExceeded returns true if the flush queue is not empty
+// and together with the memtable it uses more memory than MaxMemtablesMemory.
+// A single memtable can be bigger than the limit: it goes to the flush queue with the next write.
+func (s *Storage) isMemoryLimitExceeded() bool {
+	if s.Config.MaxMemtablesMemory <= 0 {
+		return false
+	}
+	queueSize := atomic.LoadInt64(&s.flushQueueSize)
+	if queueSize == 0 {
+		return false
+	}
+	m, err := s.currentMemtable()
+	if err != nil {
+		return false
+	}
+	return queueSize+m.Size() > s.Config.MaxMemtablesMemory
+}
+
+// notifyBackgroundDone wakes up writes which wait for the background processes.
+func (s *Storage) notifyBackgroundDone() {
+	s.stallMutex.Lock()
+	s.backgroundDone.Broadcast()
+	s.stallMutex.Unlock()
+}
+
+// isThresholdReached returns true if the threshold is enabled and the value is not less than it.
+func isThresholdReached(value int64, threshold int) bool {
+	return threshold > 0 && value >= int64(threshold)
+}
+
+// countLevel0Files returns the number of level 0 tables in the list.
+func countLevel0Files(tables []*ssTable) int64 {
+	count := int64(0)
+	for _, t := range tables {
+		if t.level == 0 {
+			count++
+		}
+	}
+	return count
+}
@@ -0,0 +1,174 @@
+package lsmt
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/alexander-akhmetov/mdb/pkg/test_utils"
+	"github.com/alexander-akhmetov/mdb/pkg/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteStopImmutableMemtables(t *testing.T) {
+	// writes must wait for the flusher process when the flush queue is full
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	// every memtable is flushed when it has two entries
+	storage := &Storage{
+		Config: StorageConfig{WorkDir: ".test/lsmt_data/", MaxMemtableSize: 100, MaxImmutableMemtables: 2},
+	}
+	assert.Nil(t, storage.Start())
+	defer storage.Stop()
+
+	// the flusher process can't flush memtables while the mutex is locked
+	storage.flushMutex.Lock()
+	for _, key := range []string{"k1", "k2", "k3", "k4"} {
+		assert.Nil(t, storage.Set(key, "v"))
+	}
+	assert.Equal(t, Stats{}, storage.Stats())
+
+	// the second memtable goes to the flush queue
+	done := make(chan error)
+	go func() {
+		done <- storage.Set("k5", "v")
+	}()
+
+	select {
+	case <-done:
+		t.Fatal("write must wait for the flusher process")
+	case <-time.After(time.Millisecond * 200):
+	}
+
+	storage.flushMutex.Unlock()
+	select {
+	case err := <-done:
+		assert.Nil(t, err)
+	case <-time.After(time.Second * 2):
+		t.Fatal("write must continue after the flush")
+	}
+
+	stats := storage.Stats()
+	assert.Equal(t, int64(1), stats.WriteStops)
+	assert.Equal(t, int64(0), stats.WriteSlowdowns)
+	assert.True(t, stats.WriteStallTime >= time.Millisecond*200)
+}
+
+func TestWriteSlowdownImmutableMemtables(t *testing.T) {
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	storage := &Storage{
+		Config: StorageConfig{
+			WorkDir:                    ".test/lsmt_data/",
+			MaxMemtableSize:            100,
+			SlowdownImmutableMemtables: 1,
+			WriteSlowdownDelay:         time.Millisecond * 20,
+		},
+	}
+	assert.Nil(t, storage.Start())
+	defer storage.Stop()
+
+	storage.flushMutex.Lock()
+	defer storage.flushMutex.Unlock()
+
+	for _, key := range []string{"k1", "k2", "k3", "k4"} {
+		assert.Nil(t, storage.Set(key, "v"))
+	}
+
+	// the first memtable is in the flush queue since the third write
+	stats := storage.Stats()
+	assert.Equal(t, int64(2), stats.WriteSlowdowns)
+	assert.Equal(t, int64(0), stats.WriteStops)
+	assert.True(t, stats.WriteStallTime >= time.Millisecond*40)
+}
+
+func TestWriteStopIsInterruptedByStop(t *testing.T) {
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	storage := &Storage{
+		Config: StorageConfig{WorkDir: ".test/lsmt_data/", MaxMemtableSize: 100, MaxImmutableMemtables: 1},
+	}
+	assert.Nil(t, storage.Start())
+
+	storage.flushMutex.Lock()
+	assert.Nil(t, storage.Set("k1", "v"))
+	assert.Nil(t, storage.Set("k2", "v"))
+
+	done := make(chan error)
+	go func() {
+		done <- storage.Set("k3", "v")
+	}()
+	time.Sleep(time.Millisecond * 100)
+
+	// Stop waits for the flusher process, but the waiting write returns at once
+	stopped := make(chan error)
+	go func() {
+		stopped <- storage.Stop()
+	}()
+
+	select {
+	case err := <-done:
+		assert.True(t, errors.Is(err, utils.ErrClosed))
+	case <-time.After(time.Second * 2):
+		t.Fatal("write must be interrupted by Stop")
+	}
+	storage.flushMutex.Unlock()
+	assert.Nil(t, <-stopped)
+}
+
+func TestWriteStallLevel0Files(t *testing.T) {
+	storage := &Storage{
+		Config: StorageConfig{CompactionEnabled: true, SlowdownLevel0Files: 2, MaxLevel0Files: 4},
+	}
+
+	storage.level0Files = 1
+	assert.False(t, storage.shouldSlowdownWrites())
+	assert.False(t, storage.shouldStopWrites())
+
+	storage.level0Files = 2
+	assert.True(t, storage.shouldSlowdownWrites())
+	assert.False(t, storage.shouldStopWrites())
+
+	storage.level0Files = 4
+	assert.True(t, storage.shouldStopWrites())
+
+	// nothing can reduce the number of level 0 tables without the compaction
+	storage.Config.CompactionEnabled = false
+	assert.False(t, storage.shouldSlowdownWrites())
+	assert.False(t, storage.shouldStopWrites())
+}
+
+func TestStartChecksLevel0Thresholds(t *testing.T) {
+	// writes must not wait for a compaction which never reduces level 0
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	configs := []StorageConfig{
+		// size-tiered compaction keeps big tables in level 0
+		{CompactionEnabled: true, MaxLevel0Files: 8},
+		{CompactionEnabled: true, SlowdownLevel0Files: 8, CompactionStrategy: &TimeWindowStrategy{}},
+		// the compaction starts only after the thresholds
+		{CompactionEnabled: true, MaxLevel0Files: 2, CompactionStrategy: &LeveledStrategy{}},
+		{CompactionEnabled: true, SlowdownLevel0Files: 3, CompactionStrategy: &LeveledStrategy{Level0FilesToCompact: 4}},
+	}
+	for _, config := range configs {
+		config.WorkDir = ".test/lsmt_data/"
+		storage := &Storage{Config: config}
+		assert.NotNil(t, storage.Start())
+	}
+
+	storage := &Storage{
+		Config: StorageConfig{
+			WorkDir:             ".test/lsmt_data/",
+			CompactionEnabled:   true,
+			SlowdownLevel0Files: 4,
+			MaxLevel0Files:      8,
+			CompactionStrategy:  &LeveledStrategy{Level0FilesToCompact: 4},
+		},
+	}
+	assert.Nil(t, storage.Start())
+	assert.Nil(t, storage.Stop())
+}
@@ -0,0 +1,417 @@
+package lsmt
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/entry"
+	"github.com/alexander-akhmetov/mdb/pkg/utils"
+)
+
+const defaultValueLogFileSize = 64 * 1024 * 1024
+
+const defaultValueLogGCRatio = 0.5
+
+// valuePointerSize is the size of the binary representation of a value pointer.
+const valuePointerSize = 20
+
+// valuePointer is the position of a value in the value log:
+//
+//	[file number: 8bytes][offset: 8bytes][record length: 4bytes]
+type valuePointer struct {
+	file   int64
+	offset int64
+	length uint32
+}
+
+func newValuePointer(data []byte) (valuePointer, error) {
+	if len(data) != valuePointerSize {
+		return valuePointer{}, fmt.Errorf("wrong value pointer size=%v", len(data))
+	}
+	return valuePointer{
+		file:   int64(binary.BigEndian.Uint64(data[:8])),
+		offset: int64(binary.BigEndian.Uint64(data[8:16])),
+		length: binary.BigEndian.Uint32(data[16:]),
+	}, nil
+}
+
+// Binary returns the binary representation of the pointer.
+func (p valuePointer) Binary() []byte {
+	data := make([]byte, valuePointerSize)
+	binary.BigEndian.PutUint64(data[:8], uint64(p.file))
+	binary.BigEndian.PutUint64(data[8:16], uint64(p.offset))
+	binary.BigEndian.PutUint32(data[16:], p.length)
+	return data
+}
+
+// pointerOf returns the position of the value of the entry with the TypeValuePointer type.
+func pointerOf(e *entry.DBEntry) (valuePointer, error) {
+	p, err := newValuePointer([]byte(e.Value))
+	if err != nil {
+		return valuePointer{}, fmt.Errorf("wrong value pointer of key=%s: %v: %w", e.Key, err, utils.ErrCorrupted)
+	}
+	return p, nil
+}
+
+// valueLog keeps big values out of SSTables, so the compaction copies only small pointers to them.
+//
+// The value log is a set of append-only files with records in the AOLog format: the record has the key too,
+// so the garbage collection can check whether the value is still used. Values are added by the flusher:
+// it writes them to the latest file and puts pointers to SSTables instead of the values.
+// Files are never changed after the storage is restarted or the file is full,
+// only the garbage collection removes them when they have no live values.
+type valueLog struct {
+	dir         string
+	maxFileSize int64
+
+	mutex       sync.RWMutex         // protects all fields below
+	files       map[int64]*tableFile // all files, including the one which receives new values
+	active      *tableFile           // the file which receives new values, nil until the first value is added
+	activeSize  int64
+	nextNumber  int64
+	uncommitted map[int64]bool // files with values of a flush which hasn't added its SSTable to the list yet
+}
+
+// openValueLog opens all files of the value log in the directory.
+// New values are written to a new file: the last file can end with an incomplete record after a crash.
+func openValueLog(dir string, maxFileSize int64) (*valueLog, error) {
+	err := utils.CreateDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &valueLog{
+		dir:         dir,
+		maxFileSize: maxFileSize,
+		files:       map[int64]*tableFile{},
+		nextNumber:  1,
+		uncommitted: map[int64]bool{},
+	}
+
+	infos, err := utils.ListFilesOrdered(dir, ".vlog")
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range infos {
+		number, err := strconv.ParseInt(strings.TrimSuffix(filepath.Base(info.Name), ".vlog"), 10, 64)
+		if err != nil {
+			log.Printf("[WARNING] Skipping value log file with an unexpected name=%s", info.Name)
+			continue
+		}
+		file, err := os.OpenFile(info.Name, os.O_RDONLY, filePermissions)
+		if err != nil {
+			l.close()
+			return nil, err
+		}
+		l.files[number] = &tableFile{file: file, name: info.Name, refs: 1}
+		if number >= l.nextNumber {
+			l.nextNumber = number + 1
+		}
+	}
+	return l, nil
+}
+
+// append adds the value to the latest file and returns its position.
+// The value is not synced to disk, sync must be called before the pointer is saved.
+// Only the flusher adds values: flushMutex serializes calls.
+func (l *valueLog) append(key string, value string) (valuePointer, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	if l.active == nil || l.activeSize >= l.maxFileSize {
+		err := l.rotate()
+		if err != nil {
+			return valuePointer{}, err
+		}
+	}
+
+	record := encodeRecord(&entry.DBEntry{Type: entry.TypeValue, Key: key, Value: value})
+	_, err := l.active.file.Write(record)
+	if err != nil {
+		return valuePointer{}, err
+	}
+
+	p := valuePointer{file: l.activeNumber(), offset: l.activeSize, length: uint32(len(record))}
+	l.activeSize += int64(len(record))
+	l.uncommitted[p.file] = true
+	return p, nil
+}
+
+// commit marks all added values as used by SSTables from the list, so the garbage collection can check them.
+// Until then, the files with these values are not collected: the memtable with the same keys
+// is still in the flush queue, and the values would look overwritten.
+// The flusher calls it after every flush, the values of a failed flush are not used and become garbage.
+func (l *valueLog) commit() {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	l.uncommitted = map[int64]bool{}
+}
+
+// rotate syncs the latest file and starts a new one. The mutex must be locked by the caller.
+func (l *valueLog) rotate() error {
+	if l.active != nil {
+		err := l.active.file.Sync()
+		if err != nil {
+			return err
+		}
+	}
+
+	filename := filepath.Join(l.dir, fmt.Sprintf("%v.vlog", l.nextNumber))
+	file, err := os.OpenFile(filename, os.O_CREATE|os.O_EXCL|os.O_RDWR|os.O_APPEND, filePermissions)
+	if err != nil {
+		return err
+	}
+	log.Printf("[DEBUG] Started value log file=%s", filename)
+
+	l.active = &tableFile{file: file, name: filename, refs: 1}
+	l.activeSize = 0
+	l.files[l.nextNumber] = l.active
+	l.nextNumber++
+	return nil
+}
+
+// activeNumber returns the number of the latest file. The mutex must be locked by the caller.
+func (l *valueLog) activeNumber() int64 {
+	return l.nextNumber - 1
+}
+
+// sync saves the added values to disk.
+func (l *valueLog) sync() error {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	if l.active == nil {
+		return nil
+	}
+	return l.active.file.Sync()
+}
+
+// acquire returns the file, it must be released after use.
+func (l *valueLog) acquire(number int64) (*tableFile, error) {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	f, found := l.files[number]
+	if !found || !f.acquire() {
+		return nil, fmt.Errorf("value log file=%v doesn't exist: %w", number, utils.ErrCorrupted)
+	}
+	return f, nil
+}
+
+// read returns the value of the key from the position in the value log.
+func (l *valueLog) read(key string, p valuePointer) (string, error) {
+	f, err := l.acquire(p.file)
+	if err != nil {
+		return "", err
+	}
+	defer f.release()
+	return readValue(f, key, p)
+}
+
+// readValue reads the record of the value at the position and verifies its checksum.
+func readValue(f *tableFile, key string, p valuePointer) (string, error) {
+	if p.length < checksumSize {
+		return "", &utils.CorruptionError{Filename: f.name, Offset: p.offset, Reason: "value record is too small"}
+	}
+	data := make([]byte, p.length)
+	_, err := f.file.ReadAt(data, p.offset)
+	if err != nil {
+		return "", fmt.Errorf("can't read value log file=%s: %w", f.name, err)
+	}
+
+	record := data[checksumSize:]
+	if binary.BigEndian.Uint32(data[:checksumSize]) != checksum(record) {
+		return "", &utils.CorruptionError{Filename: f.name, Offset: p.offset, Reason: "checksum mismatch"}
+	}
+	e, err := entry.NewDBEntry(record)
+	if err != nil || e.Key != key {
+		return "", &utils.CorruptionError{Filename: f.name, Offset: p.offset, Reason: "value record doesn't match the pointer"}
+	}
+	return e.Value, nil
+}
+
+// snapshot returns all files of the value log, they are not closed until the snapshot is released
+// even if the garbage collection removes them.
+func (l *valueLog) snapshot() *valueLogSnapshot {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	files := make(map[int64]*tableFile, len(l.files))
+	for number, f := range l.files {
+		if f.acquire() {
+			files[number] = f
+		}
+	}
+	return &valueLogSnapshot{files: files}
+}
+
+// sealedFiles returns numbers of files which don't receive new values
+// and have no values of unfinished flushes, the oldest first.
+func (l *valueLog) sealedFiles() []int64 {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	numbers := []int64{}
+	for number, f := range l.files {
+		if f != l.active && !l.uncommitted[number] {
+			numbers = append(numbers, number)
+		}
+	}
+	sort.Slice(numbers, func(i, j int) bool { return numbers[i] < numbers[j] })
+	return numbers
+}
+
+// scan calls fn for every value of the sealed file in the order they were added.
+// An incomplete record at the end of the file is ignored: it was being written when the process crashed,
+// and its pointer hasn't been saved.
+func (l *valueLog) scan(number int64, fn func(key string, value string, p valuePointer) error) error {
+	f, err := l.acquire(number)
+	if err != nil {
+		return err
+	}
+	defer f.release()
+
+	// the scanner needs its own file offset
+	file, err := os.OpenFile(f.name, os.O_RDONLY, filePermissions)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := newBinFileScanner(file, defaultReadBufferSize)
+	for {
+		offset := scanner.Offset()
+		e, err := scanner.ReadEntry()
+		var incomplete *entry.IncompleteEntryError
+		if errors.As(err, &incomplete) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		p := valuePointer{file: number, offset: offset, length: uint32(scanner.Offset() - offset)}
+		err = fn(e.Key, e.Value, p)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// scanKeys calls fn for every key of the sealed file without reading the values.
+// Checksums are not verified, the scan stops at an incomplete record.
+func (l *valueLog) scanKeys(number int64, fn func(key string, p valuePointer) error) error {
+	f, err := l.acquire(number)
+	if err != nil {
+		return err
+	}
+	defer f.release()
+
+	stat, err := f.file.Stat()
+	if err != nil {
+		return err
+	}
+
+	header := make([]byte, checksumSize+entry.HeaderSize)
+	for offset := int64(0); offset+int64(len(header)) <= stat.Size(); {
+		_, err = f.file.ReadAt(header, offset)
+		if err != nil {
+			return err
+		}
+		length, err := entry.BinaryLength(header[checksumSize:])
+		if err != nil {
+			return err
+		}
+		p := valuePointer{file: number, offset: offset, length: uint32(checksumSize + length)}
+		if offset+int64(p.length) > stat.Size() {
+			return nil
+		}
+
+		key := make([]byte, binary.BigEndian.Uint32(header[checksumSize+1:]))
+		_, err = f.file.ReadAt(key, offset+int64(len(header)))
+		if err != nil {
+			return err
+		}
+		err = fn(string(key), p)
+		if err != nil {
+			return err
+		}
+		offset += int64(p.length)
+	}
+	return nil
+}
+
+// remove deletes the sealed file. Readers which still use it can finish, it's closed after them.
+func (l *valueLog) remove(number int64) {
+	l.mutex.Lock()
+	f, found := l.files[number]
+	delete(l.files, number)
+	l.mutex.Unlock()
+	if !found {
+		return
+	}
+
+	log.Printf("[DEBUG] Removing value log file=%s", f.name)
+	f.release()
+	err := os.Remove(f.name)
+	if err != nil {
+		log.Printf("[ERROR] Can't remove value log file=%s: %v", f.name, err)
+	}
+}
+
+// len returns the number of files in the value log.
+func (l *valueLog) len() int {
+	l.mutex.RLock()
+	defer l.mutex.RUnlock()
+
+	return len(l.files)
+}
+
+// close syncs the latest file and closes all files. Readers which still use them can finish.
+func (l *valueLog) close() error {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	var err error
+	if l.active != nil {
+		err = l.active.file.Sync()
+	}
+	for number, f := range l.files {
+		f.release()
+		delete(l.files, number)
+	}
+	l.active = nil
+	return err
+}
+
+// valueLogSnapshot holds files of the value log for an iterator,
+// so the values stay readable after the garbage collection removes the files.
+type valueLogSnapshot struct {
+	files map[int64]*tableFile
+}
+
+// read returns the value of the key from the position in the value log.
+func (s *valueLogSnapshot) read(key string, p valuePointer) (string, error) {
+	f, found := s.files[p.file]
+	if !found {
+		return "", fmt.Errorf("value log file=%v doesn't exist: %w", p.file, utils.ErrCorrupted)
+	}
+	return readValue(f, key, p)
+}
+
+// release releases all files of the snapshot. It's safe to call it many times.
+func (s *valueLogSnapshot) release() {
+	for number, f := range s.files {
+		f.release()
+		delete(s.files, number)
+	}
+}
@@ -0,0 +1,167 @@
+package lsmt
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/entry"
+	"github.com/alexander-akhmetov/mdb/pkg/utils"
+)
+
+const defaultValueLogGCInterval = time.Minute * 10
+
+// CollectValueLogGarbage removes value log files in which at least ValueLogGCRatio of the data
+// belongs to overwritten or deleted keys, and returns the number of removed files.
+//
+// Live values of these files are written to the memtable again, as if they were set by a user,
+// and the memtables are flushed: the values are moved to the latest value log file, and new SSTables point to them.
+// Only then the files are removed. Reads and iterators which have found the old pointers can still use them.
+func (s *Storage) CollectValueLogGarbage() (int, error) {
+	s.valueLogGCMutex.Lock()
+	defer s.valueLogGCMutex.Unlock()
+
+	// Close waits for the collection like for the background processes before it closes the files.
+	// The running flag is changed under the mutex before Close waits, so it can't miss the collection.
+	s.mutex.RLock()
+	if !s.running {
+		s.mutex.RUnlock()
+		return 0, utils.ErrClosed
+	}
+	s.workers.Add(1)
+	s.mutex.RUnlock()
+	defer s.workers.Done()
+
+	collected := []int64{}
+	for _, number := range s.values.sealedFiles() {
+		ratio, err := s.valueLogGarbageRatio(number)
+		if err != nil {
+			return 0, fmt.Errorf("can't check value log file=%v: %w", number, err)
+		}
+		if ratio < s.Config.ValueLogGCRatio {
+			continue
+		}
+
+		log.Printf("[INFO] Collecting garbage of value log file=%v, garbage ratio=%.2f", number, ratio)
+		err = s.values.scan(number, s.rewriteValue)
+		if err != nil {
+			return 0, fmt.Errorf("can't rewrite values of value log file=%v: %w", number, err)
+		}
+		collected = append(collected, number)
+	}
+	if len(collected) == 0 {
+		return 0, nil
+	}
+
+	// The rewritten values must be in SSTables before the files are removed: AOLog can be not synced yet,
+	// and the old pointers must not be the latest versions of the keys in SSTables.
+	err := s.flushAll()
+	if err != nil {
+		return 0, fmt.Errorf("can't flush rewritten values: %w", err)
+	}
+
+	// readers hold the mutex while they resolve pointers found in SSTables
+	s.ssTablesAccessMutex.Lock()
+	for _, number := range collected {
+		s.values.remove(number)
+	}
+	s.ssTablesAccessMutex.Unlock()
+	return len(collected), nil
+}
+
+// valueLogGarbageRatio returns the part of the file which is taken by values that are not used anymore.
+// An empty file is all garbage.
+func (s *Storage) valueLogGarbageRatio(number int64) (float64, error) {
+	var total, garbage int64
+	err := s.values.scanKeys(number, func(key string, p valuePointer) error {
+		memtables, err := s.readSnapshot()
+		if err != nil {
+			return err
+		}
+		live, err := s.isLiveValue(memtables, key, p)
+		if err != nil {
+			return err
+		}
+		total += int64(p.length)
+		if !live {
+			garbage += int64(p.length)
+		}
+		return nil
+	})
+	if err != nil || total == 0 {
+		return 1, err
+	}
+	return float64(garbage) / float64(total), nil
+}
+
+// isLiveValue returns true if the latest version of the key is the value at the position in the value log.
+// Memtables never have pointers, so the value is not live if any memtable has the key.
+func (s *Storage) isLiveValue(memtables []*memtable, key string, p valuePointer) (bool, error) {
+	if _, found := getFromMemtables(memtables, key); found {
+		return false, nil
+	}
+
+	s.ssTablesAccessMutex.RLock()
+	defer s.ssTablesAccessMutex.RUnlock()
+
+	e, found, err := s.findInSSTables(key)
+	if err != nil || !found || e.Type != entry.TypeValuePointer {
+		return false, err
+	}
+	latest, err := pointerOf(e)
+	if err != nil {
+		return false, err
+	}
+	return latest == p, nil
+}
+
+// rewriteValue writes the value to the memtable again if it's still the latest version of the key.
+// The check and the write are atomic: other writes are not applied while the mutex is locked,
+// so a newer value of the key is never replaced with the old one.
+func (s *Storage) rewriteValue(key string, value string, p valuePointer) error {
+	err := s.flushmemtableIfNeeded()
+	if err != nil {
+		return err
+	}
+	err = s.makeRoomForWrite()
+	if err != nil {
+		return err
+	}
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !s.running {
+		return utils.ErrClosed
+	}
+
+	memtables := append([]*memtable{s.memtable}, s.flushQueueSnapshot()...)
+	live, err := s.isLiveValue(memtables, key, p)
+	if err != nil || !live {
+		return err
+	}
+	return s.memtable.Set(key, value)
+}
+
+// startValueLogGCProcess collects garbage of the value log every ValueLogGCInterval until the storage is stopped.
+func (s *Storage) startValueLogGCProcess() {
+	defer s.workers.Done()
+
+	log.Println("[DEBUG] Started value log garbage collection process")
+	for {
+		select {
+		case <-s.stop:
+			log.Println("[DEBUG] Stopped value log garbage collection process")
+			return
+		case <-time.After(s.Config.ValueLogGCInterval):
+		}
+
+		removed, err := s.CollectValueLogGarbage()
+		if err != nil && !errors.Is(err, utils.ErrClosed) {
+			log.Printf("[ERROR] Value log garbage collection failed: %v", err)
+		}
+		if removed > 0 {
+			log.Printf("[INFO] Value log garbage collection removed %v files", removed)
+		}
+	}
+}
@@ -0,0 +1,462 @@
+package lsmt
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/alexander-akhmetov/mdb/pkg/lsmt/internal/entry"
+	"github.com/alexander-akhmetov/mdb/pkg/test_utils"
+	"github.com/alexander-akhmetov/mdb/pkg/utils"
+)
+
+// bigValue returns a value which is moved to the value log in tests
+func bigValue(key string, version int) string {
+	return fmt.Sprintf("%s-v%v-", key, version) + strings.Repeat("x", 100)
+}
+
+// latestSSTableEntry returns the latest version of the key from the SSTables as it's stored there
+func latestSSTableEntry(t *testing.T, storage *Storage, key string) *entry.DBEntry {
+	storage.ssTablesAccessMutex.RLock()
+	defer storage.ssTablesAccessMutex.RUnlock()
+
+	e, found, err := storage.findInSSTables(key)
+	assert.Nil(t, err)
+	assert.True(t, found, key)
+	return e
+}
+
+func assertValues(t *testing.T, storage *Storage, expected map[string]string) {
+	for key, expectedValue := range expected {
+		value, exists, err := storage.Get(key)
+		assert.Nil(t, err)
+		assert.Equal(t, expectedValue != "", exists, key)
+		assert.Equal(t, expectedValue, value, key)
+	}
+}
+
+func TestValuePointerBinary(t *testing.T) {
+	p := valuePointer{file: 3, offset: 1 << 40, length: 129}
+	decoded, err := newValuePointer(p.Binary())
+	assert.Nil(t, err)
+	assert.Equal(t, p, decoded)
+
+	_, err = newValuePointer([]byte("short"))
+	assert.NotNil(t, err)
+}
+
+func TestValueLog(t *testing.T) {
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	// every value starts a new file
+	values, err := openValueLog(".test/vlog", 1)
+	assert.Nil(t, err)
+
+	p1, err := values.append("k1", "v1")
+	assert.Nil(t, err)
+	p2, err := values.append("k2", "v2")
+	assert.Nil(t, err)
+	assert.Nil(t, values.sync())
+	assert.Equal(t, valuePointer{file: 1, offset: 0, length: uint32(len(encodeRecord(&entry.DBEntry{Key: "k1", Value: "v1"})))}, p1)
+	assert.Equal(t, int64(2), p2.file)
+	// the pointers are not in SSTables yet
+	assert.Equal(t, []int64{}, values.sealedFiles())
+	values.commit()
+	assert.Equal(t, []int64{1}, values.sealedFiles())
+
+	value, err := values.read("k2", p2)
+	assert.Nil(t, err)
+	assert.Equal(t, "v2", value)
+
+	// the pointer must point to the value of the same key
+	_, err = values.read("k1", p2)
+	assert.True(t, errors.Is(err, utils.ErrCorrupted))
+
+	keys := map[string]valuePointer{}
+	assert.Nil(t, values.scanKeys(1, func(key string, p valuePointer) error {
+		keys[key] = p
+		return nil
+	}))
+	assert.Equal(t, map[string]valuePointer{"k1": p1}, keys)
+
+	scanned := map[string]string{}
+	assert.Nil(t, values.scan(1, func(key string, value string, p valuePointer) error {
+		assert.Equal(t, p1, p)
+		scanned[key] = value
+		return nil
+	}))
+	assert.Equal(t, map[string]string{"k1": "v1"}, scanned)
+
+	// a snapshot keeps the removed file readable
+	snapshot := values.snapshot()
+	values.remove(1)
+	assert.False(t, testutils.IsFileExists(".test/vlog/1.vlog"))
+	_, err = values.read("k1", p1)
+	assert.True(t, errors.Is(err, utils.ErrCorrupted))
+	value, err = snapshot.read("k1", p1)
+	assert.Nil(t, err)
+	assert.Equal(t, "v1", value)
+	snapshot.release()
+
+	// new values go to a new file after reopening
+	assert.Nil(t, values.close())
+	values, err = openValueLog(".test/vlog", 1024)
+	assert.Nil(t, err)
+	defer values.close()
+	assert.Equal(t, []int64{2}, values.sealedFiles())
+	p3, err := values.append("k3", "v3")
+	assert.Nil(t, err)
+	assert.Equal(t, int64(3), p3.file)
+
+	value, err = values.read("k2", p2)
+	assert.Nil(t, err)
+	assert.Equal(t, "v2", value)
+}
+
+func TestValueLogIncompleteRecord(t *testing.T) {
+	// the process can crash while a value is being written, the record is ignored
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	record := encodeRecord(&entry.DBEntry{Key: "k1", Value: "v1"})
+	incomplete := encodeRecord(&entry.DBEntry{Key: "k2", Value: "v2"})
+	testutils.CreateFile(".test/vlog/1.vlog", string(record)+string(incomplete[:len(incomplete)-1]))
+
+	values, err := openValueLog(".test/vlog", 1024)
+	assert.Nil(t, err)
+	defer values.close()
+
+	for _, scan := range []func() ([]string, error){
+		func() ([]string, error) {
+			keys := []string{}
+			err := values.scanKeys(1, func(key string, p valuePointer) error {
+				keys = append(keys, key)
+				return nil
+			})
+			return keys, err
+		},
+		func() ([]string, error) {
+			keys := []string{}
+			err := values.scan(1, func(key string, value string, p valuePointer) error {
+				keys = append(keys, key)
+				return nil
+			})
+			return keys, err
+		},
+	} {
+		keys, err := scan()
+		assert.Nil(t, err)
+		assert.Equal(t, []string{"k1"}, keys)
+	}
+}
+
+func TestStorageValueSeparation(t *testing.T) {
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	config := StorageConfig{WorkDir: ".test/lsmt_data/", ValueThreshold: 100}
+	storage := &Storage{Config: config}
+	assert.Nil(t, storage.Start())
+
+	expected := map[string]string{
+		"k1": bigValue("k1", 1),
+		"k2": "small",
+		"k3": bigValue("k3", 1),
+	}
+	for key, value := range expected {
+		assert.Nil(t, storage.Set(key, value))
+	}
+	assert.Nil(t, storage.flushAll())
+
+	// SSTables keep only pointers to big values
+	assert.Equal(t, entry.TypeValuePointer, latestSSTableEntry(t, storage, "k1").Type)
+	assert.Equal(t, entry.TypeValue, latestSSTableEntry(t, storage, "k2").Type)
+	assert.Equal(t, "small", latestSSTableEntry(t, storage, "k2").Value)
+	assertValues(t, storage, expected)
+
+	it, err := storage.Scan("", "")
+	assert.Nil(t, err)
+	scanned := map[string]string{}
+	for it.Next() {
+		scanned[it.Key()] = it.Value()
+	}
+	assert.Nil(t, it.Err())
+	it.Close()
+	assert.Equal(t, expected, scanned)
+
+	// the compaction copies pointers, the value log is not changed
+	assert.Nil(t, storage.Set("k1", bigValue("k1", 2)))
+	expected["k1"] = bigValue("k1", 2)
+	assert.Nil(t, storage.flushAll())
+	task, err := storage.compactOnce()
+	assert.Nil(t, err)
+	assert.NotNil(t, task)
+	assert.Equal(t, 1, len(storage.ssTables))
+	assert.Equal(t, entry.TypeValuePointer, latestSSTableEntry(t, storage, "k3").Type)
+	assert.Equal(t, 1, storage.values.len())
+	assertValues(t, storage, expected)
+
+	// values are read after restart even if the separation is disabled
+	assert.Nil(t, storage.Stop())
+	config.ValueThreshold = 0
+	storage = &Storage{Config: config}
+	assert.Nil(t, storage.Start())
+	defer storage.Stop()
+	assertValues(t, storage, expected)
+}
+
+func TestStorageValueLogGC(t *testing.T) {
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	config := StorageConfig{WorkDir: ".test/lsmt_data/", ValueThreshold: 100}
+	storage := &Storage{Config: config}
+	assert.Nil(t, storage.Start())
+	for _, key := range []string{"k1", "k2", "k3"} {
+		assert.Nil(t, storage.Set(key, bigValue(key, 1)))
+	}
+	assert.Nil(t, storage.flushAll())
+	assert.Nil(t, storage.Stop())
+
+	// the first file is sealed after restart, new values go to the second one
+	storage = &Storage{Config: config}
+	assert.Nil(t, storage.Start())
+	assert.Nil(t, storage.Set("k1", bigValue("k1", 2)))
+	assert.Nil(t, storage.Delete("k2"))
+	assert.Nil(t, storage.flushAll())
+	assert.Equal(t, []int64{1}, storage.values.sealedFiles())
+
+	// a third of the file is live
+	ratio, err := storage.valueLogGarbageRatio(1)
+	assert.Nil(t, err)
+	assert.InDelta(t, 2.0/3.0, ratio, 0.01)
+
+	// an open iterator still reads the values from the removed file
+	it, err := storage.Scan("", "")
+	assert.Nil(t, err)
+
+	removed, err := storage.CollectValueLogGarbage()
+	assert.Nil(t, err)
+	assert.Equal(t, 1, removed)
+	assert.False(t, testutils.IsFileExists(".test/lsmt_data/vlog/1.vlog"))
+
+	// the live value has been moved to the second file
+	p, err := pointerOf(latestSSTableEntry(t, storage, "k3"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), p.file)
+
+	expected := map[string]string{"k1": bigValue("k1", 2), "k2": "", "k3": bigValue("k3", 1)}
+	assertValues(t, storage, expected)
+
+	scanned := map[string]string{}
+	for it.Next() {
+		scanned[it.Key()] = it.Value()
+	}
+	assert.Nil(t, it.Err())
+	it.Close()
+	assert.Equal(t, map[string]string{"k1": bigValue("k1", 2), "k3": bigValue("k3", 1)}, scanned)
+
+	// there is no garbage in the second file, it's not sealed anyway
+	removed, err = storage.CollectValueLogGarbage()
+	assert.Nil(t, err)
+	assert.Equal(t, 0, removed)
+
+	assert.Nil(t, storage.Stop())
+	storage = &Storage{Config: config}
+	assert.Nil(t, storage.Start())
+	defer storage.Stop()
+	assertValues(t, storage, expected)
+
+	_, err = (&Storage{Config: config}).CollectValueLogGarbage()
+	assert.True(t, errors.Is(err, utils.ErrClosed))
+}
+
+func TestStorageValueLogGCKeepsNewerValues(t *testing.T) {
+	// a value which is written during the garbage collection must not be replaced with the old one
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	storage := &Storage{Config: StorageConfig{WorkDir: ".test/lsmt_data/", ValueThreshold: 100}}
+	assert.Nil(t, storage.Start())
+	defer storage.Stop()
+
+	assert.Nil(t, storage.Set("k1", bigValue("k1", 1)))
+	assert.Nil(t, storage.flushAll())
+	old := latestSSTableEntry(t, storage, "k1")
+	p, err := pointerOf(old)
+	assert.Nil(t, err)
+
+	assert.Nil(t, storage.Set("k1", bigValue("k1", 2)))
+	assert.Nil(t, storage.rewriteValue("k1", bigValue("k1", 1), p))
+	assertValues(t, storage, map[string]string{"k1": bigValue("k1", 2)})
+
+	// the same after the newer value is flushed
+	assert.Nil(t, storage.flushAll())
+	assert.Nil(t, storage.rewriteValue("k1", bigValue("k1", 1), p))
+	assertValues(t, storage, map[string]string{"k1": bigValue("k1", 2)})
+	_, found := storage.memtable.Get("k1")
+	assert.False(t, found)
+}
+
+func TestStorageValueLogConcurrentAccess(t *testing.T) {
+	// the garbage collection rewrites values while they are written and read: run with -race
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	storage := &Storage{
+		Config: StorageConfig{
+			WorkDir:            ".test/lsmt_data/",
+			CompactionEnabled:  true,
+			CompactionStrategy: &LeveledStrategy{Level0FilesToCompact: 2},
+			MaxMemtableSize:    2048,
+			ValueThreshold:     10,
+			ValueLogFileSize:   1024,
+		},
+	}
+	assert.Nil(t, storage.Start())
+	defer storage.Stop()
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+
+			// the flush seals value log files with overwritten values
+			if !assert.Nil(t, storage.flushAll()) {
+				return
+			}
+			_, err := storage.CollectValueLogGarbage()
+			if !assert.Nil(t, err) {
+				return
+			}
+		}
+	}()
+
+	testutils.StressTest(t, storage, testutils.StressConfig{Writers: 4, Readers: 4, Keys: 50, Rounds: 10})
+	close(done)
+	<-stopped
+
+	// The garbage collection above can find nothing to collect, it depends on the timing.
+	// Values of these keys fill whole files, and after they are deleted, the files are all garbage.
+	for _, deleted := range []bool{false, true} {
+		for i := 0; i < 40; i++ {
+			key := fmt.Sprintf("gc-%v", i)
+			if deleted {
+				assert.Nil(t, storage.Delete(key))
+			} else {
+				assert.Nil(t, storage.Set(key, bigValue(key, 1)))
+			}
+		}
+		assert.Nil(t, storage.flushAll())
+	}
+	removed, err := storage.CollectValueLogGarbage()
+	assert.Nil(t, err)
+	assert.True(t, removed > 0)
+}
+
+func TestStorageValueLogGCDuringFlush(t *testing.T) {
+	// the flusher seals value log files while it writes values, but the values are not garbage:
+	// the garbage collection must not remove the files before the SSTable with pointers to them is added
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	storage := &Storage{
+		Config: StorageConfig{
+			WorkDir:            ".test/lsmt_data/",
+			MaxMemtableSize:    4096,
+			ValueThreshold:     10,
+			ValueLogFileSize:   256,
+			ValueLogGCInterval: -1,
+		},
+	}
+	assert.Nil(t, storage.Start())
+	defer storage.Stop()
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			_, err := storage.CollectValueLogGarbage()
+			if !assert.Nil(t, err) {
+				return
+			}
+		}
+	}()
+
+	expected := map[string]string{}
+	for i := 0; i < 2000; i++ {
+		key := fmt.Sprintf("k%04d", i)
+		expected[key] = bigValue(key, 1)
+		assert.Nil(t, storage.Set(key, expected[key]))
+	}
+	close(done)
+	<-stopped
+
+	assert.Nil(t, storage.flushAll())
+	assertValues(t, storage, expected)
+}
+
+func TestStorageCloseWaitsForValueLogGC(t *testing.T) {
+	// files must not be closed while the garbage collection started by a user still reads them
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	storage := &Storage{
+		Config: StorageConfig{
+			WorkDir:            ".test/lsmt_data/",
+			ValueThreshold:     10,
+			ValueLogFileSize:   1,
+			ValueLogGCInterval: -1,
+		},
+	}
+	assert.Nil(t, storage.Start())
+
+	// every value starts a new file, so the first one is sealed
+	for _, key := range []string{"k1", "k2"} {
+		assert.Nil(t, storage.Set(key, bigValue(key, 1)))
+		assert.Nil(t, storage.flushAll())
+	}
+
+	// the collection waits for the mutex when it checks the first value
+	storage.ssTablesAccessMutex.Lock()
+	collected := make(chan error)
+	go func() {
+		_, err := storage.CollectValueLogGarbage()
+		collected <- err
+	}()
+	time.Sleep(time.Millisecond * 50)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*50)
+	defer cancel()
+	assert.True(t, errors.Is(storage.Close(ctx), context.DeadlineExceeded))
+	storage.memtable.log.mutex.Lock()
+	assert.False(t, storage.memtable.log.closed)
+	storage.memtable.log.mutex.Unlock()
+
+	storage.ssTablesAccessMutex.Unlock()
+	assert.Nil(t, <-collected)
+
+	// the files are closed after the collection, the PID file is removed the last
+	for i := 0; i < 100 && testutils.IsFileExists(storage.Config.pidFilePath); i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	assert.False(t, testutils.IsFileExists(storage.Config.pidFilePath))
+}
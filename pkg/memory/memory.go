@@ -1,32 +1,60 @@
 package memory
 
-import "log"
+import (
+	"log"
+	"sync"
 
-// Storage holds data in memory
+	"github.com/alexander-akhmetov/mdb/pkg/utils"
+)
+
+// Storage holds data in memory.
+// It's safe for concurrent use.
 type Storage struct {
+	mutex   sync.RWMutex // protects storage
 	storage map[string]string
 }
 
 // Set saves the given key and value.
-func (s *Storage) Set(key string, value string) {
+func (s *Storage) Set(key string, value string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.storage == nil {
+		return utils.ErrClosed
+	}
 	s.storage[key] = value
+	return nil
 }
 
 // Get returns a value for the given key.
-func (s *Storage) Get(key string) (string, bool) {
+func (s *Storage) Get(key string) (string, bool, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	if s.storage == nil {
+		return "", false, utils.ErrClosed
+	}
+
 	if value, exists := s.storage[key]; exists {
-		return value, true
+		return value, true, nil
 	}
 
-	return "", false
+	return "", false, nil
 }
 
 // Start initializes the memory storage
-func (s *Storage) Start() {
+func (s *Storage) Start() error {
 	log.Println("[INFO] Starting memory storage")
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
 	s.storage = map[string]string{}
+	return nil
 }
 
 // Stop stops the storage
-func (s *Storage) Stop() {
+func (s *Storage) Stop() error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.storage = nil
+	return nil
 }
@@ -4,6 +4,9 @@ import (
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+
+	"github.com/alexander-akhmetov/mdb/pkg/test_utils"
+	"github.com/alexander-akhmetov/mdb/pkg/utils"
 )
 
 func TestMemoryTestSet(t *testing.T) {
@@ -13,7 +16,7 @@ func TestMemoryTestSet(t *testing.T) {
 
 	testKey := "test-key"
 	testValue := "test-value"
-	db.Set(testKey, testValue)
+	assert.Nil(t, db.Set(testKey, testValue))
 
 	if db.storage[testKey] != testValue {
 		t.Errorf("MemoryStorage Set error")
@@ -29,7 +32,8 @@ func TestMemoryTestGet(t *testing.T) {
 	testValue := "test-value"
 	db.storage[testKey] = testValue
 
-	value, exists := db.Get(testKey)
+	value, exists, err := db.Get(testKey)
+	assert.Nil(t, err)
 	assert.Equal(t, testValue, value, "Wrong value")
 	assert.True(t, exists)
 }
@@ -44,7 +48,29 @@ func TestMemoryStorageSetGet(t *testing.T) {
 
 	db.Set(testKey, testValue)
 
-	value, exists := db.Get(testKey)
+	value, exists, err := db.Get(testKey)
+	assert.Nil(t, err)
 	assert.Equal(t, testValue, value, "Wrong value")
 	assert.True(t, exists)
 }
+
+func TestMemoryStorageClosed(t *testing.T) {
+	db := Storage{}
+
+	assert.Equal(t, utils.ErrClosed, db.Set("key", "value"))
+
+	assert.Nil(t, db.Start())
+	assert.Nil(t, db.Set("key", "value"))
+	assert.Nil(t, db.Stop())
+
+	_, _, err := db.Get("key")
+	assert.Equal(t, utils.ErrClosed, err)
+}
+
+func TestMemoryStorageConcurrentAccess(t *testing.T) {
+	db := &Storage{}
+	assert.Nil(t, db.Start())
+	defer db.Stop()
+
+	testutils.StressTest(t, db, testutils.StressConfig{Writers: 8, Readers: 8, Keys: 200, Rounds: 5})
+}
@@ -0,0 +1,99 @@
+package testutils
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// KeyValueStorage is the part of the storage interface used by the stress test
+type KeyValueStorage interface {
+	Set(string, string) error
+	Get(string) (string, bool, error)
+}
+
+// StressConfig defines the load of the stress test
+type StressConfig struct {
+	Writers int // every writer has its own keys
+	Readers int
+	Keys    int // number of keys of every writer
+	Rounds  int // how many times every key is written
+}
+
+// StressTest writes and reads keys from many goroutines at the same time.
+// Readers check that they never see a value which hasn't been written,
+// and at the end every key must have the value of the last round.
+// Run it with -race to find data races in the storage.
+func StressTest(t *testing.T, storage KeyValueStorage, config StressConfig) {
+	var writers sync.WaitGroup
+	for w := 0; w < config.Writers; w++ {
+		writers.Add(1)
+		go func(w int) {
+			defer writers.Done()
+			for round := 0; round < config.Rounds; round++ {
+				for k := 0; k < config.Keys; k++ {
+					key := stressKey(w, k)
+					err := storage.Set(key, stressValue(key, round))
+					if err != nil {
+						t.Errorf("can't set key=%s: %v", key, err)
+						return
+					}
+				}
+			}
+		}(w)
+	}
+
+	done := make(chan struct{})
+	var readers sync.WaitGroup
+	for r := 0; r < config.Readers; r++ {
+		readers.Add(1)
+		go func(r int) {
+			defer readers.Done()
+			random := rand.New(rand.NewSource(int64(r)))
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				key := stressKey(random.Intn(config.Writers), random.Intn(config.Keys))
+				value, exists, err := storage.Get(key)
+				if err != nil {
+					t.Errorf("can't get key=%s: %v", key, err)
+					return
+				}
+				if exists && !strings.HasPrefix(value, key+"-v") {
+					t.Errorf("key=%s has unexpected value=%s", key, value)
+					return
+				}
+			}
+		}(r)
+	}
+
+	writers.Wait()
+	close(done)
+	readers.Wait()
+
+	for w := 0; w < config.Writers; w++ {
+		for k := 0; k < config.Keys; k++ {
+			key := stressKey(w, k)
+			value, exists, err := storage.Get(key)
+			assert.Nil(t, err)
+			assert.True(t, exists, key)
+			assert.Equal(t, stressValue(key, config.Rounds-1), value)
+		}
+	}
+}
+
+func stressKey(writer int, key int) string {
+	return fmt.Sprintf("w%v-k%05d", writer, key)
+}
+
+func stressValue(key string, round int) string {
+	return fmt.Sprintf("%s-v%v", key, round)
+}
@@ -2,6 +2,7 @@ package testutils
 
 import (
 	"encoding/binary"
+	"hash/crc32"
 	"io/ioutil"
 	"log"
 	"os"
@@ -79,7 +80,7 @@ func IsDirEmpty(path string) bool {
 	return len(files) == 0
 }
 
-// CreateFileWithKeyValues creates file with binary key values
+// CreateFileWithKeyValues creates file with binary key values in the append only log format
 func CreateFileWithKeyValues(filename string, keyValues [][2]string) {
 	os.RemoveAll(filename)
 
@@ -123,13 +124,20 @@ func appendBinaryToFile(filename string, key string, value string) {
 		data = append(data, b...)
 	}
 
-	_, err = file.Write(data)
+	_, err = file.Write(withChecksum(data))
 	if err != nil {
 		log.Panic(err)
 	}
 }
 
-// AssertKeysInFile checks that file's content equals expected data
+// withChecksum adds the CRC32 checksum of the data before it, like the append only log does
+func withChecksum(data []byte) []byte {
+	record := make([]byte, 4)
+	binary.BigEndian.PutUint32(record, crc32.Checksum(data, crc32.MakeTable(crc32.Castagnoli)))
+	return append(record, data...)
+}
+
+// AssertKeysInFile checks that the append only log file's content equals expected data
 func AssertKeysInFile(t *testing.T, filename string, data [][2]string) {
 	expContent := []byte{}
 
@@ -144,11 +152,12 @@ func AssertKeysInFile(t *testing.T, filename string, data [][2]string) {
 			valueLength,
 			uint32(len(kv[1])),
 		)
-		expContent = append(expContent, []byte{0}...)
-		expContent = append(expContent, keyLength...)
-		expContent = append(expContent, valueLength...)
-		expContent = append(expContent, []byte(kv[0])...)
-		expContent = append(expContent, []byte(kv[1])...)
+		record := []byte{0}
+		record = append(record, keyLength...)
+		record = append(record, valueLength...)
+		record = append(record, []byte(kv[0])...)
+		record = append(record, []byte(kv[1])...)
+		expContent = append(expContent, withChecksum(record)...)
 	}
 
 	content := ReadFileBinary(filename)
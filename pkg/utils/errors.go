@@ -0,0 +1,35 @@
+package utils
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrClosed is returned when the storage is used before it has been started or after it has been stopped.
+var ErrClosed = errors.New("storage is closed")
+
+// ErrCorrupted is returned when the data on disk can't be read.
+var ErrCorrupted = errors.New("data is corrupted")
+
+// ErrLocked is returned when another instance of the database uses the same files.
+var ErrLocked = errors.New("database is locked by another instance")
+
+// ErrTooBig is returned when a write doesn't fit into one log record.
+var ErrTooBig = errors.New("record is too big")
+
+// CorruptionError describes a place in a file where the data is corrupted.
+// errors.Is(err, ErrCorrupted) returns true for it.
+type CorruptionError struct {
+	Filename string
+	Offset   int64
+	Reason   string
+}
+
+func (e *CorruptionError) Error() string {
+	return fmt.Sprintf("file=%s is corrupted at offset=%v: %s", e.Filename, e.Offset, e.Reason)
+}
+
+// Is makes CorruptionError compatible with ErrCorrupted.
+func (e *CorruptionError) Is(target error) bool {
+	return target == ErrCorrupted
+}
@@ -17,12 +17,12 @@ const filePermissions = 0600
 const pidFileName = "mdb.pid"
 
 // GetKeyValueFromString returns the key and value from a string.
-func GetKeyValueFromString(line string) (string, string) {
+func GetKeyValueFromString(line string) (string, string, error) {
 	splitted := strings.SplitN(line, ";", 2)
 	if len(splitted) != 2 {
-		log.Panicln("Wrong line: ", line)
+		return "", "", fmt.Errorf("wrong line '%s': %w", line, ErrCorrupted)
 	}
-	return splitted[0], strings.TrimRight(splitted[1], "\n")
+	return splitted[0], strings.TrimRight(splitted[1], "\n"), nil
 }
 
 // TrimKey removes the key and ";" prefix from the line
@@ -33,10 +33,10 @@ func TrimKey(key string, line string) string {
 
 // FindLineByKeyInFile returns the last line that starts with the given key and a boolean indicator of whether the line has been found.
 // If false, the line has not been found.
-func FindLineByKeyInFile(filename string, key string) (string, bool) {
+func FindLineByKeyInFile(filename string, key string) (string, bool, error) {
 	file, err := os.Open(filename)
 	if err != nil {
-		log.Fatal(err)
+		return "", false, err
 	}
 	defer file.Close()
 
@@ -54,111 +54,117 @@ func FindLineByKeyInFile(filename string, key string) (string, bool) {
 	}
 
 	if err := scanner.Err(); err != nil {
-		log.Fatal(err)
+		return "", false, err
 	}
 
-	return resultLine, found
+	return resultLine, found, nil
 }
 
 // AppendToFile appends the given string to a file with the specified filename.
-func AppendToFile(filename string, appendString string) {
+func AppendToFile(filename string, appendString string) error {
 	file, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, filePermissions)
 	if err != nil {
-		log.Panic(err)
+		return err
 	}
 	defer file.Close()
 
 	_, err = file.WriteString(appendString)
-	if err != nil {
-		log.Panic(err)
-	}
+	return err
 }
 
 // RecreateFile removes the old file and creates a new one.
-func RecreateFile(filename string) {
-	os.Remove(filename)
-	CreateFileIfNotExists(filename)
+func RecreateFile(filename string) error {
+	err := os.Remove(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return CreateFileIfNotExists(filename)
 }
 
 // CreateFileIfNotExists creates the file and all necessary directories if it doesn't exist.
-func CreateFileIfNotExists(filename string) {
+func CreateFileIfNotExists(filename string) error {
 	dir, _ := filepath.Split(filename)
-	CreateDir(dir)
+	err := CreateDir(dir)
+	if err != nil {
+		return err
+	}
 
-	if _, err := os.Stat(filename); os.IsNotExist(err) {
-		os.OpenFile(filename, os.O_RDONLY|os.O_CREATE, filePermissions)
+	file, err := os.OpenFile(filename, os.O_RDONLY|os.O_CREATE, filePermissions)
+	if err != nil {
+		return err
 	}
+	return file.Close()
 }
 
 // CreateDir creates a directory similarly to `mkdir -p`.
-func CreateDir(dir string) {
-	if _, err := os.Stat(dir); os.IsNotExist(err) {
-		os.MkdirAll(dir, os.ModePerm)
+func CreateDir(dir string) error {
+	if dir == "" {
+		return nil
 	}
+	return os.MkdirAll(dir, os.ModePerm)
 }
 
 // GetFileSize returns the file size.
-func GetFileSize(filename string) int64 {
-	file, err := os.OpenFile(filename, os.O_APPEND|os.O_WRONLY, filePermissions)
+func GetFileSize(filename string) (int64, error) {
+	fi, err := os.Stat(filename)
 	if err != nil {
-		log.Panic(err)
+		return 0, err
 	}
-	defer file.Close()
-	fi, err := file.Stat()
-	if err != nil {
-		log.Panic(err)
-	}
-	return fi.Size()
+	return fi.Size(), nil
 }
 
 // ReadLineByOffset reads a line from the file at the given offset.
-func ReadLineByOffset(filename string, offset int64) string {
+func ReadLineByOffset(filename string, offset int64) (string, error) {
 	file, err := os.Open(filename)
 	if err != nil {
-		log.Panic(err)
+		return "", err
 	}
 	defer file.Close()
 
 	_, err = file.Seek(offset, io.SeekStart)
 	if err != nil {
-		log.Panic(err)
+		return "", err
 	}
 	scanner := bufio.NewScanner(file)
 	scanner.Scan()
-	return scanner.Text()
+	return scanner.Text(), scanner.Err()
 }
 
 // StartFileDB creates a temporary .pid file to lock file usage.
-func StartFileDB() {
-	CheckAndCreatePIDFile(pidFileName)
-	AppendToFile(pidFileName, fmt.Sprintf("%v", os.Getpid()))
+func StartFileDB() error {
+	err := CheckAndCreatePIDFile(pidFileName)
+	if err != nil {
+		return err
+	}
+	return AppendToFile(pidFileName, fmt.Sprintf("%v", os.Getpid()))
 }
 
 // CheckAndCreatePIDFile checks for the presence of a .pid file and creates it if it does not exist.
-// If it exists, the function will panic, because only one
+// If it exists, the function returns ErrLocked, because only one
 // instance of the DB should be running at the same time.
-func CheckAndCreatePIDFile(path string) {
+func CheckAndCreatePIDFile(path string) error {
 	if _, err := os.Stat(path); err == nil {
-		log.Panicf("Can't start the database: %s file already exists!", path)
+		return fmt.Errorf("can't start the database, %s file already exists: %w", path, ErrLocked)
 	}
-	CreateFileIfNotExists(path)
+	return CreateFileIfNotExists(path)
 }
 
 // StopFileDB removes the temporary .pid file.
-func StopFileDB() {
-	RemovePIDFile(pidFileName)
+func StopFileDB() error {
+	return RemovePIDFile(pidFileName)
 }
 
 // RemovePIDFile removes the .pid file.
-func RemovePIDFile(path string) {
+func RemovePIDFile(path string) error {
 	err := os.Remove(path)
+	if os.IsNotExist(err) {
+		log.Println("[WARN] .pid file does not exist! Can't remove it")
+		return nil
+	}
 	if err != nil {
-		if os.IsNotExist(err) {
-			log.Println("[WARN] .pid file does not exist! Can't remove it")
-		} else {
-			log.Panicln("Can't stop the DB properly, can't remove the .pid file: ", err)
-		}
+		return fmt.Errorf("can't stop the DB properly, can't remove the .pid file: %w", err)
 	}
+	return nil
 }
 
 // FileInfo is a struct with file information
@@ -169,10 +175,10 @@ type FileInfo struct {
 
 // ListFilesOrdered returns filenames ordered by their name in descending order.
 // Files must have integer names.
-func ListFilesOrdered(dir string, filterBySuffix string) []FileInfo {
+func ListFilesOrdered(dir string, filterBySuffix string) ([]FileInfo, error) {
 	files, err := ioutil.ReadDir(dir)
 	if err != nil {
-		log.Panic(err)
+		return nil, err
 	}
 
 	sort.Slice(files, func(i, j int) bool {
@@ -193,5 +199,5 @@ func ListFilesOrdered(dir string, filterBySuffix string) []FileInfo {
 		}
 	}
 
-	return filenames
+	return filenames, nil
 }
@@ -1,6 +1,7 @@
 package utils
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"path/filepath"
@@ -31,11 +32,11 @@ func TestListFilesOrdered(t *testing.T) {
 	os.MkdirAll(filesDir, os.ModePerm)
 
 	filterBySuffix := ".sstable"
-	assert.Equal(t, []FileInfo{}, ListFilesOrdered(filesDir, filterBySuffix))
+	files, err := ListFilesOrdered(filesDir, filterBySuffix)
+	assert.Nil(t, err)
+	assert.Equal(t, []FileInfo{}, files)
 
-	files := []string{"file.sstable", "another.sstable", "sometmpfile.txt"}
-
-	for _, f := range files {
+	for _, f := range []string{"file.sstable", "another.sstable", "sometmpfile.txt"} {
 		os.OpenFile(filepath.Join(filesDir, f), os.O_RDONLY|os.O_CREATE, 0600)
 	}
 
@@ -50,7 +51,9 @@ func TestListFilesOrdered(t *testing.T) {
 			Size: 0,
 		},
 	}
-	assert.Equal(t, expFiles, ListFilesOrdered(filesDir, filterBySuffix))
+	files, err = ListFilesOrdered(filesDir, filterBySuffix)
+	assert.Nil(t, err)
+	assert.Equal(t, expFiles, files)
 }
 
 func TestListFilesOrderedWithoutSuffix(t *testing.T) {
@@ -62,11 +65,11 @@ func TestListFilesOrderedWithoutSuffix(t *testing.T) {
 	filesDir := "./.test/list-files-test/"
 	os.MkdirAll(filesDir, os.ModePerm)
 
-	assert.Equal(t, []FileInfo{}, ListFilesOrdered(filesDir, ""))
-
-	files := []string{"3.sstable", "2.sstable", "1.txt"}
+	files, err := ListFilesOrdered(filesDir, "")
+	assert.Nil(t, err)
+	assert.Equal(t, []FileInfo{}, files)
 
-	for _, f := range files {
+	for _, f := range []string{"3.sstable", "2.sstable", "1.txt"} {
 		os.OpenFile(filepath.Join(filesDir, f), os.O_RDONLY|os.O_CREATE, 0600)
 	}
 
@@ -85,15 +88,46 @@ func TestListFilesOrderedWithoutSuffix(t *testing.T) {
 			Size: 0,
 		},
 	}
-	assert.Equal(t, expFiles, ListFilesOrdered(filesDir, ""))
+	files, err = ListFilesOrdered(filesDir, "")
+	assert.Nil(t, err)
+	assert.Equal(t, expFiles, files)
 }
 
 func TestGetKeyValueFromString(t *testing.T) {
-	key, value := GetKeyValueFromString("key;value\n")
+	key, value, err := GetKeyValueFromString("key;value\n")
+	assert.Nil(t, err)
 	assert.Equal(t, "key", key)
 	assert.Equal(t, "value", value)
 
-	key, value = GetKeyValueFromString("key;key;key;value")
+	key, value, err = GetKeyValueFromString("key;key;key;value")
+	assert.Nil(t, err)
 	assert.Equal(t, "key", key)
 	assert.Equal(t, "key;key;value", value)
+
+	_, _, err = GetKeyValueFromString("key")
+	assert.True(t, errors.Is(err, ErrCorrupted))
+}
+
+func TestCheckAndCreatePIDFile(t *testing.T) {
+	// the second instance must not be able to start
+	testutils.SetUp()
+	defer testutils.Teardown()
+
+	path := ".test/mdb.pid"
+	assert.Nil(t, CheckAndCreatePIDFile(path))
+
+	err := CheckAndCreatePIDFile(path)
+	assert.True(t, errors.Is(err, ErrLocked))
+
+	assert.Nil(t, RemovePIDFile(path))
+	assert.Nil(t, CheckAndCreatePIDFile(path))
+}
+
+func TestCorruptionError(t *testing.T) {
+	var err error = &CorruptionError{Filename: "file.sstable", Offset: 42, Reason: "checksum mismatch"}
+	wrapped := fmt.Errorf("can't read: %w", err)
+
+	assert.True(t, errors.Is(wrapped, ErrCorrupted))
+	assert.False(t, errors.Is(wrapped, ErrClosed))
+	assert.Equal(t, "file=file.sstable is corrupted at offset=42: checksum mismatch", err.Error())
 }